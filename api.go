@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"os"
 	"path"
 	"path/filepath"
 	"strings"
@@ -14,13 +18,54 @@ import (
 	"github.com/r3labs/sse/v2"
 )
 
-const maxUploadSize = 10 << 20
+// Default limit for uploads to /objects/, see WithMaxUploadSize.
+const defaultMaxUploadSize = 10 << 20
 
-func NewAPI(path string, secret []byte) *api {
+const (
+	// Memory multipart forms are parsed into before spilling to temp files
+	maxFormMemory = 10 << 20
+	// Room for the boundaries and other fields of a multipart form on top of
+	// the size limit of the file in it
+	multipartFormOverhead = 1 << 20
+)
+
+// APIOption configures an api before its routes are set up.
+type APIOption func(*api)
+
+// WithS3Credentials requires requests to the S3 API to be signed with SigV4
+// by one of credentials, a map of access key IDs to secret keys.
+func WithS3Credentials(credentials map[string]string) APIOption {
+	return func(a *api) {
+		a.s3Credentials = credentials
+	}
+}
+
+// WithMaxUploadSize limits the size of uploads to /objects/, on top of the
+// object size limits of the store. -1 removes the limit.
+func WithMaxUploadSize(n int64) APIOption {
+	return func(a *api) {
+		a.maxUploadSize = n
+	}
+}
+
+// WithAzureAccounts serves the Azure Blob API under /{account}/ for each of
+// accounts, a map of account names to base64 encoded keys requests must be
+// signed with.
+func WithAzureAccounts(accounts map[string]string) APIOption {
+	return func(a *api) {
+		a.azureAccounts = accounts
+	}
+}
+
+func NewAPI(store *Store, secret []byte, options ...APIOption) *api {
 	a := &api{
-		mux:    http.NewServeMux(),
-		path:   path,
-		secret: secret,
+		mux:           http.NewServeMux(),
+		store:         store,
+		secret:        secret,
+		maxUploadSize: defaultMaxUploadSize,
+	}
+	for _, option := range options {
+		option(a)
 	}
 	a.init()
 	return a
@@ -33,8 +78,14 @@ type ErrorResponse struct {
 type api struct {
 	mux    *http.ServeMux
 	secret []byte
-	path   string
+	store  *Store
 	events *sse.Server
+	// Largest upload accepted by /objects/, unlimited when not positive
+	maxUploadSize int64
+	// Access key ID to secret, the S3 API is unauthenticated when empty
+	s3Credentials map[string]string
+	// Account name to base64 encoded key, shadowing buckets of the same name
+	azureAccounts map[string]string
 }
 
 func (a *api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -47,6 +98,12 @@ func (a *api) publishCreated(id string) {
 	})
 }
 
+func (a *api) publishDeleted(id string) {
+	a.events.Publish("updates", &sse.Event{
+		Data: []byte(fmt.Sprintf(`{"event": "FileDeleted", "id": "%s"}`, id)),
+	})
+}
+
 func (a *api) init() {
 
 	// SSE Event Stream
@@ -60,11 +117,45 @@ func (a *api) init() {
 	a.mux.HandleFunc("/pre-signed", a.CreatePresigned)
 	a.mux.HandleFunc("/pre-signed/", a.Presigned)
 	a.mux.HandleFunc("/objects/", a.Objects)
+	a.mux.HandleFunc("/buckets", a.Buckets)
+	a.mux.HandleFunc("/buckets/", a.Buckets)
 	a.mux.HandleFunc("/publish/", a.PublishCreated)
+	a.mux.HandleFunc("/trash", a.Trash)
+	a.mux.HandleFunc("/trash/", a.Trash)
+	a.mux.HandleFunc("/admin/compact", a.Compact)
+	a.mux.HandleFunc("/admin/fsck", a.Fsck)
+	a.mux.HandleFunc("/admin/gc", a.CollectGarbage)
+	// Google Cloud Storage JSON API
+	a.mux.HandleFunc(gcsPrefix, a.GCS)
+	a.mux.HandleFunc(gcsUploadPrefix, a.GCSUpload)
+	a.mux.HandleFunc(gcsDownloadPrefix, a.GCSDownload)
+	// Azure Blob Storage API
+	for account := range a.azureAccounts {
+		a.mux.HandleFunc("/"+account, a.Azure)
+		a.mux.HandleFunc("/"+account+"/", a.Azure)
+	}
+	// Everything else is the S3 compatible API
+	a.mux.HandleFunc("/", a.S3)
 }
 
 func (a *api) Objects(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodGet {
+	if strings.HasSuffix(r.URL.Path, "/tags") {
+		a.ObjectTags(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/retention") || strings.HasSuffix(r.URL.Path, "/legal-hold") {
+		a.ObjectLock(w, r)
+		return
+	}
+	if strings.Contains(strings.TrimPrefix(r.URL.Path, "/objects/"), "/versions") {
+		a.ObjectVersions(w, r)
+		return
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		if strings.HasSuffix(r.URL.Path, "/metadata") {
+			a.GetObjectMetadata(w, r)
+			return
+		}
 		a.GetObject(w, r)
 		return
 	} else if r.Method == http.MethodPost {
@@ -92,16 +183,20 @@ func (a *api) Objects(w http.ResponseWriter, r *http.Request) {
 
 func (a *api) CopyObject(w http.ResponseWriter, r *http.Request) {
 	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/objects/"), "/copy")
-	if id == "" {
+	if id == "" || !a.inBucket(r, id) {
 		http.NotFound(w, r)
 		return
 	}
-	newFile, err := CopyFile(id)
+	newFile, err := a.store.CopyFile(id)
 	if err != nil {
 		if errors.Is(err, errNotExist) {
 			http.NotFound(w, r)
 			return
 		}
+		if errors.Is(err, errTooLarge) {
+			entityTooLarge(w, r, "%s", err)
+			return
+		}
 		internalError(err, w, r)
 		return
 	}
@@ -115,18 +210,67 @@ func (a *api) GetObject(w http.ResponseWriter, r *http.Request) {
 	id := strings.TrimPrefix(r.URL.Path, "/objects/")
 	// List files
 	if len(id) < 1 {
-		files, err := ListFiles()
-		if err != nil {
-			internalError(err, w, r)
+		a.ListObjects(w, r)
+		return
+	}
+
+	if !a.inBucket(r, id) {
+		http.NotFound(w, r)
+		return
+	}
+	var (
+		f   *os.File
+		sf  *storedFile
+		err error
+	)
+	if versionID := r.URL.Query().Get("versionId"); versionID != "" {
+		f, sf, err = a.store.OpenVersion(id, versionID)
+	} else {
+		f, sf, err = a.store.OpenFile(id)
+	}
+	if err != nil {
+		if errors.Is(err, errNotExist) || errors.Is(err, errVersionNotExist) || errors.Is(err, os.ErrNotExist) {
+			http.NotFound(w, r)
 			return
 		}
-		w.Header().Add("Content-Type", "application/json")
-		enc := json.NewEncoder(w)
-		enc.Encode(files)
+		internalError(err, w, r)
 		return
 	}
+	defer f.Close()
+	w.Header().Set("X-Created", sf.Created.UTC().Format(http.TimeFormat))
+	if sf.VersionID != "" {
+		w.Header().Set(versionIDHeader, sf.VersionID)
+	}
+	setMetadataHeaders(w.Header(), metadataHeaderPrefix, sf.Metadata)
+	if len(sf.Tags) > 0 {
+		w.Header().Set(tagsHeader, formatTags(sf.Tags))
+	}
+	serveObject(w, r, f, sf)
+}
+
+// serveObject writes the content of an object, or the ranges of it asked for
+// with Range, along with Accept-Ranges, Content-Length, ETag and
+// Last-Modified. Conditional requests are answered with 304 or 412, HEAD
+// requests only get the headers. Content-Type and Content-Disposition come
+// from the record.
+func serveObject(w http.ResponseWriter, r *http.Request, f *os.File, sf *storedFile) {
+	w.Header().Set("ETag", objectETag(sf))
+	w.Header().Set("Content-Type", sf.contentType())
+	if disposition := sf.contentDisposition(); disposition != "" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	http.ServeContent(w, r, filepath.Base(sf.Path), sf.lastModified(), f)
+}
 
-	if err := ReadFile(id, w, w.Header()); err != nil {
+// GetObjectMetadata returns the full record of an object as JSON.
+func (a *api) GetObjectMetadata(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/objects/"), "/metadata")
+	if id == "" || !a.inBucket(r, id) {
+		http.NotFound(w, r)
+		return
+	}
+	sf, err := a.store.GetFileMetadata(id)
+	if err != nil {
 		if errors.Is(err, errNotExist) {
 			http.NotFound(w, r)
 			return
@@ -134,41 +278,113 @@ func (a *api) GetObject(w http.ResponseWriter, r *http.Request) {
 		internalError(err, w, r)
 		return
 	}
+	w.Header().Add("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(sf)
 }
 
 type CreateObjectResponse struct {
-	ID string `json:"id"`
+	ID       string `json:"id"`
+	Size     int64  `json:"size,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
 }
 
+// CreateObject stores the "file" field of a multipart/form-data body, any
+// other body is streamed as is into a file named after X-Filename.
 func (a *api) CreateObject(w http.ResponseWriter, r *http.Request) {
 	if len(strings.TrimPrefix(r.URL.Path, "/objects/")) > 0 {
 		methodNotAllowed(w, r)
 		return
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	bucket := requestBucket(r)
+	limit := a.uploadSizeLimit(bucket)
+
+	var (
+		file        io.Reader
+		fileName    string
+		contentType string
+	)
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		// Keeps oversized forms from being spilled to disk, the file in it
+		// is checked against the limit when stored
+		if limit > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, limit+multipartFormOverhead)
+		}
+		if err := r.ParseMultipartForm(maxFormMemory); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				requestTooLarge(w, r, limit)
+				return
+			}
+			badRequest(w, r, "Error while parsing multipart: '%s'", err)
+			return
+		}
 
-	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
-		badRequest(w, r, "Error while parsing multipart: '%s'", err)
-		return
-	}
+		formFile, fileHeader, err := r.FormFile("file")
 
-	file, fileHeader, err := r.FormFile("file")
+		if err != nil {
+			badRequest(w, r, "Malformed request payload due to: '%s'", err)
+			return
+		}
+		if limit > 0 && fileHeader.Size > limit {
+			formFile.Close()
+			requestTooLarge(w, r, limit)
+			return
+		}
 
+		defer formFile.Close()
+		file = formFile
+		fileName = path.Base(fileHeader.Filename)
+		contentType = fileHeader.Header.Get("Content-Type")
+	} else {
+		fileName = path.Base(r.Header.Get("X-Filename"))
+		if fileName == "." || fileName == "/" || fileName == ".." {
+			badRequest(w, r, "X-Filename header is required for uploads that aren't multipart/form-data")
+			return
+		}
+		if !contentLengthAllowed(w, r, limit, 0) {
+			return
+		}
+		if a.maxUploadSize > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, a.maxUploadSize)
+		}
+		file = r.Body
+		contentType = r.Header.Get("Content-Type")
+	}
+
+	dir := a.store.Dir()
+	if bucket != "" {
+		dir = a.store.BucketDir(bucket)
+	}
+	options, err := headerFileOptions(r.Header, metadataHeaderPrefix, tagsHeader)
 	if err != nil {
-		badRequest(w, r, "Malformed request payload due to: '%s'", err)
+		badRequest(w, r, "Malformed %s header", tagsHeader)
 		return
 	}
-
-	defer file.Close()
-	fileName := path.Base(fileHeader.Filename)
-	storedFile, err := CreateFile(path.Join(a.path, fileName), file)
+	expires, err := expiresOption(r.Header)
+	if err != nil {
+		badRequest(w, r, "%s", err)
+		return
+	}
+	options = append(options, expires)
+	options = append(options, WithContentType(contentType), WithFileName(fileName))
+	storedFile, err := a.store.CreateFile(path.Join(dir, fileName), file, options...)
 
 	if err != nil {
 		if errors.Is(err, errExist) {
 			badRequest(w, r, "File with name '%s' already exists", fileName)
 			return
 		}
+		if errors.Is(err, errTooLarge) {
+			entityTooLarge(w, r, "%s", err)
+			return
+		}
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			requestTooLarge(w, r, maxBytesErr.Limit)
+			return
+		}
 		internalError(err, w, r)
 		return
 	}
@@ -178,7 +394,9 @@ func (a *api) CreateObject(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 	enc := json.NewEncoder(w)
 	enc.Encode(CreateObjectResponse{
-		ID: storedFile.ID,
+		ID:       storedFile.ID,
+		Size:     storedFile.Size,
+		Checksum: storedFile.Checksum,
 	})
 }
 
@@ -189,7 +407,7 @@ func (a *api) PublishCreated(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := GetFileMetadata(id)
+	_, err := a.store.GetFileMetadata(id)
 	if err != nil {
 		if errors.Is(err, errNotExist) {
 			http.NotFound(w, r)
@@ -207,12 +425,47 @@ func (a *api) OverwriteObject(w http.ResponseWriter, r *http.Request) {
 		methodNotAllowed(w, r)
 		return
 	}
-	if err := UpdateFile(id, r.Body, true); err != nil {
+	sf, err := a.store.GetFileMetadata(id)
+	if err != nil || !a.inBucket(r, id) {
+		http.NotFound(w, r)
+		return
+	}
+	if !contentLengthAllowed(w, r, a.store.ObjectSizeLimit(sf.Bucket), 0) {
+		return
+	}
+	options, err := headerFileOptions(r.Header, metadataHeaderPrefix, tagsHeader)
+	if err != nil {
+		badRequest(w, r, "Malformed %s header", tagsHeader)
+		return
+	}
+	expires, err := expiresOption(r.Header)
+	if err != nil {
+		badRequest(w, r, "%s", err)
+		return
+	}
+	options = append(options, expires)
+	options = append(options, WithContentType(r.Header.Get("Content-Type")))
+	options = append(options, bypassOptions(r.Header, bypassGovernanceHeader)...)
+	options = append(options, writePreconditions(r.Header)...)
+	if err := a.store.UpdateFile(id, r.Body, true, options...); err != nil {
 		if errors.Is(err, errNotExist) {
 			http.NotFound(w, r)
 			return
 		}
+		if errors.Is(err, errPreconditionFailed) {
+			preconditionFailed(w, r, "%s", err)
+			return
+		}
+		if errors.Is(err, errLocked) {
+			forbidden(w, r, "%s", err)
+			return
+		}
+		if errors.Is(err, errTooLarge) {
+			entityTooLarge(w, r, "%s", err)
+			return
+		}
 		internalError(err, w, r)
+		return
 	}
 	w.WriteHeader(200)
 }
@@ -223,12 +476,34 @@ func (a *api) UpdateFile(w http.ResponseWriter, r *http.Request) {
 		methodNotAllowed(w, r)
 		return
 	}
-	if err := UpdateFile(id, r.Body, false); err != nil {
+	sf, err := a.store.GetFileMetadata(id)
+	if err != nil || !a.inBucket(r, id) {
+		http.NotFound(w, r)
+		return
+	}
+	if !contentLengthAllowed(w, r, a.store.ObjectSizeLimit(sf.Bucket), sf.Size) {
+		return
+	}
+	options := append(bypassOptions(r.Header, bypassGovernanceHeader), writePreconditions(r.Header)...)
+	if err := a.store.UpdateFile(id, r.Body, false, options...); err != nil {
 		if errors.Is(err, errNotExist) {
 			http.NotFound(w, r)
 			return
 		}
+		if errors.Is(err, errPreconditionFailed) {
+			preconditionFailed(w, r, "%s", err)
+			return
+		}
+		if errors.Is(err, errLocked) {
+			forbidden(w, r, "%s", err)
+			return
+		}
+		if errors.Is(err, errTooLarge) {
+			entityTooLarge(w, r, "%s", err)
+			return
+		}
 		internalError(err, w, r)
+		return
 	}
 	w.WriteHeader(200)
 }
@@ -239,14 +514,243 @@ func (a *api) DeleteObject(w http.ResponseWriter, r *http.Request) {
 		methodNotAllowed(w, r)
 		return
 	}
+	if versionID := r.URL.Query().Get("versionId"); versionID != "" {
+		a.DeleteObjectVersion(w, r, id, versionID)
+		return
+	}
+	if !a.inBucket(r, id) {
+		http.NotFound(w, r)
+		return
+	}
 
-	if err := DeleteFile(id); err != nil {
+	options := append(bypassOptions(r.Header, bypassGovernanceHeader), writePreconditions(r.Header)...)
+	if err := a.store.DeleteFile(id, options...); err != nil {
 		if errors.Is(err, errNotExist) {
 			http.NotFound(w, r)
 			return
 		}
+		if errors.Is(err, errPreconditionFailed) {
+			preconditionFailed(w, r, "%s", err)
+			return
+		}
+		if errors.Is(err, errLocked) {
+			forbidden(w, r, "%s", err)
+			return
+		}
 		internalError(err, w, r)
+		return
+	}
+	a.publishDeleted(id)
+}
+
+type bucketContextKey struct{}
+
+// requestBucket returns the bucket a request under /buckets/{name}/objects/
+// is scoped to, empty for the unscoped /objects/ routes.
+func requestBucket(r *http.Request) string {
+	bucket, _ := r.Context().Value(bucketContextKey{}).(string)
+	return bucket
+}
+
+// inBucket reports whether the object belongs to the bucket the request is
+// scoped to. Unscoped requests can reach every object.
+func (a *api) inBucket(r *http.Request, id string) bool {
+	bucket := requestBucket(r)
+	if bucket == "" {
+		return true
 	}
+	sf, err := a.store.GetFileMetadata(id)
+	return err == nil && sf.Bucket == bucket
+}
+
+func (a *api) Buckets(w http.ResponseWriter, r *http.Request) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/buckets"), "/"), "/")
+	if name == "" {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, r)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.Encode(a.store.ListBuckets())
+		return
+	}
+
+	if rest == "" {
+		a.Bucket(w, r, name)
+		return
+	}
+	if rest != "objects" && !strings.HasPrefix(rest, "objects/") {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := a.store.GetBucket(name); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	scoped := r.Clone(context.WithValue(r.Context(), bucketContextKey{}, name))
+	scoped.URL.Path = "/objects/" + strings.TrimPrefix(strings.TrimPrefix(rest, "objects"), "/")
+	a.Objects(w, scoped)
+}
+
+func (a *api) Bucket(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		b, err := a.store.GetBucket(name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.Encode(b)
+	case http.MethodPut:
+		var settings BucketSettings
+		if !decodeBucketSettings(w, r, &settings) {
+			return
+		}
+		b, err := a.store.CreateBucket(name)
+		if err != nil {
+			if errors.Is(err, errInvalidBucketName) {
+				badRequest(w, r, "Invalid bucket name '%s'", name)
+				return
+			}
+			if errors.Is(err, errBucketExist) {
+				conflict(w, r, "Bucket '%s' already exists", name)
+				return
+			}
+			internalError(err, w, r)
+			return
+		}
+		if settings != (BucketSettings{}) {
+			if b, err = a.store.UpdateBucket(name, settings.apply); err != nil {
+				internalError(err, w, r)
+				return
+			}
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		enc := json.NewEncoder(w)
+		enc.Encode(b)
+	case http.MethodPatch:
+		var settings BucketSettings
+		if !decodeBucketSettings(w, r, &settings) {
+			return
+		}
+		b, err := a.store.UpdateBucket(name, settings.apply)
+		if err != nil {
+			if errors.Is(err, errBucketNotExist) {
+				http.NotFound(w, r)
+				return
+			}
+			internalError(err, w, r)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.Encode(b)
+	case http.MethodDelete:
+		if err := a.store.DeleteBucket(name, r.URL.Query().Get("force") == "true"); err != nil {
+			if errors.Is(err, errBucketNotExist) {
+				http.NotFound(w, r)
+				return
+			}
+			if errors.Is(err, errBucketNotEmpty) {
+				conflict(w, r, "Bucket '%s' is not empty", name)
+				return
+			}
+			if errors.Is(err, errLocked) {
+				forbidden(w, r, "Bucket '%s' holds a locked object", name)
+				return
+			}
+			internalError(err, w, r)
+		}
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// BucketSettings are the settings of a bucket accepted when it is created or
+// patched. Settings that aren't given are left as they are.
+type BucketSettings struct {
+	// Largest object accepted by the bucket, zero defers to -max-object-size
+	MaxObjectSize *int64           `json:"maxObjectSize,omitempty"`
+	Versioning    *bool            `json:"versioning,omitempty"`
+	Lifecycle     *[]LifecycleRule `json:"lifecycle,omitempty"`
+}
+
+func (s BucketSettings) apply(b *bucket) {
+	if s.MaxObjectSize != nil {
+		b.MaxObjectSize = *s.MaxObjectSize
+	}
+	if s.Versioning != nil {
+		b.Versioning = *s.Versioning
+	}
+	if s.Lifecycle != nil {
+		b.Lifecycle = *s.Lifecycle
+	}
+}
+
+// decodeBucketSettings decodes the optional JSON body of a bucket request,
+// writing the error and returning false when it is malformed.
+func decodeBucketSettings(w http.ResponseWriter, r *http.Request, settings *BucketSettings) bool {
+	if r.ContentLength == 0 {
+		return true
+	}
+	if err := json.NewDecoder(r.Body).Decode(settings); err != nil && !errors.Is(err, io.EOF) {
+		badRequest(w, r, "Malformed bucket settings due to: '%s'", err)
+		return false
+	}
+	if settings.MaxObjectSize != nil && *settings.MaxObjectSize < 0 {
+		badRequest(w, r, "maxObjectSize can't be negative")
+		return false
+	}
+	if settings.Lifecycle != nil {
+		for _, rule := range *settings.Lifecycle {
+			if rule.ExpireAfter <= 0 {
+				badRequest(w, r, "expireAfter of lifecycle rules must be positive")
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (a *api) Compact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
+		return
+	}
+	result, err := a.store.Compact()
+	if err != nil {
+		internalError(err, w, r)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(result)
+}
+
+// Fsck reports on GET and repairs on POST, according to the adopt and delete
+// query parameters.
+func (a *api) Fsck(w http.ResponseWriter, r *http.Request) {
+	var options FsckOptions
+	if r.Method == http.MethodPost {
+		query := r.URL.Query()
+		options.Adopt = query.Get("adopt") == "true"
+		options.Delete = query.Get("delete") == "true"
+	} else if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+	report, err := a.store.Fsck(options)
+	if err != nil {
+		internalError(err, w, r)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(report)
 }
 
 type CreateSignedURLRequest struct {
@@ -309,7 +813,7 @@ func (a *api) Presigned(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, `{"error": "link expired"}`)
 		return
 	}
-	filePath := filepath.Join(a.path, payload.Path)
+	filePath := filepath.Join(a.store.Dir(), payload.Path)
 
 	// Handlers
 	if r.Method != http.MethodPut {
@@ -318,13 +822,44 @@ func (a *api) Presigned(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, created, err := UpsertFile(filePath, r.Body)
+	if !contentLengthAllowed(w, r, a.store.ObjectSizeLimit(a.store.BucketOf(filePath)), 0) {
+		return
+	}
+	options, err := headerFileOptions(r.Header, metadataHeaderPrefix, tagsHeader)
 	if err != nil {
+		badRequest(w, r, "Malformed %s header", tagsHeader)
+		return
+	}
+	expires, err := expiresOption(r.Header)
+	if err != nil {
+		badRequest(w, r, "%s", err)
+		return
+	}
+	options = append(options, expires)
+	options = append(options, WithContentType(r.Header.Get("Content-Type")))
+	options = append(options, bypassOptions(r.Header, bypassGovernanceHeader)...)
+	options = append(options, writePreconditions(r.Header)...)
+	result, created, err := a.store.UpsertFile(filePath, r.Body, options...)
+	if err != nil {
+		if errors.Is(err, errPreconditionFailed) {
+			preconditionFailed(w, r, "%s", err)
+			return
+		}
+		if errors.Is(err, errLocked) {
+			forbidden(w, r, "%s", err)
+			return
+		}
+		if errors.Is(err, errTooLarge) {
+			entityTooLarge(w, r, "%s", err)
+			return
+		}
 		internalError(err, w, r)
 		return
 	}
 
 	w.Header().Add("Content-Type", "application/json")
+	w.Header().Set("ETag", objectETag(result))
+	w.Header().Set("Last-Modified", result.lastModified().UTC().Format(http.TimeFormat))
 	if created {
 		a.publishCreated(result.ID)
 		w.WriteHeader(http.StatusCreated)
@@ -355,6 +890,67 @@ func badRequest(w http.ResponseWriter, r *http.Request, message string, extras .
 	})
 }
 
+func conflict(w http.ResponseWriter, r *http.Request, message string, extras ...any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	enc := json.NewEncoder(w)
+	enc.Encode(ErrorResponse{
+		Error: fmt.Sprintf(message, extras...),
+	})
+}
+
+func forbidden(w http.ResponseWriter, r *http.Request, message string, extras ...any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	enc := json.NewEncoder(w)
+	enc.Encode(ErrorResponse{
+		Error: fmt.Sprintf(message, extras...),
+	})
+}
+
+func preconditionFailed(w http.ResponseWriter, r *http.Request, message string, extras ...any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusPreconditionFailed)
+	enc := json.NewEncoder(w)
+	enc.Encode(ErrorResponse{
+		Error: fmt.Sprintf(message, extras...),
+	})
+}
+
+func entityTooLarge(w http.ResponseWriter, r *http.Request, message string, extras ...any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	enc := json.NewEncoder(w)
+	enc.Encode(ErrorResponse{
+		Error: fmt.Sprintf(message, extras...),
+	})
+}
+
+func requestTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	entityTooLarge(w, r, "Upload is larger than the limit of %d bytes", limit)
+}
+
+// uploadSizeLimit returns the largest upload /objects/ accepts into bucket,
+// the smaller of the upload and object size limits, zero when there is none.
+func (a *api) uploadSizeLimit(bucket string) int64 {
+	limit := a.store.ObjectSizeLimit(bucket)
+	if a.maxUploadSize > 0 && (limit == 0 || a.maxUploadSize < limit) {
+		return a.maxUploadSize
+	}
+	return limit
+}
+
+// contentLengthAllowed rejects requests whose Content-Length would take an
+// object already holding size bytes past limit before any of the body is
+// read. Bodies of unknown length are checked while they are stored.
+func contentLengthAllowed(w http.ResponseWriter, r *http.Request, limit, size int64) bool {
+	if limit > 0 && r.ContentLength > limit-size {
+		requestTooLarge(w, r, limit)
+		return false
+	}
+	return true
+}
+
 func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
 	status := http.StatusMethodNotAllowed
 	w.WriteHeader(status)
@@ -2,14 +2,18 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
-	"path"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 
@@ -19,13 +23,12 @@ import (
 )
 
 func TestAPI(t *testing.T) {
-	storageDir := t.TempDir()
-
-	storedFiles = make(map[string]storedFile)
-	aoFile, _ = os.OpenFile(path.Join(storageDir, "_db"), os.O_CREATE|os.O_WRONLY, 0600)
-	defer aoFile.Close()
+	t.Parallel()
+	store, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
 
-	api := NewAPI(storageDir, []byte("testing"))
+	api := NewAPI(store, []byte("testing"))
 	server := httptest.NewServer(api)
 	url := server.URL
 
@@ -69,3 +72,243 @@ func TestAPI(t *testing.T) {
 	// Ensure 2 calls
 	wg.Wait()
 }
+
+func TestBucketAPI(t *testing.T) {
+	t.Parallel()
+	store, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+
+	server := httptest.NewServer(NewAPI(store, []byte("testing")))
+	defer server.Close()
+	url := server.URL
+
+	for _, name := range []string{"first", "second"} {
+		resp := doRequest(t, http.MethodPut, url+"/buckets/"+name, nil)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+	resp := doRequest(t, http.MethodPut, url+"/buckets/first", nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	// Shadowed by the S3 API's routes
+	resp = doRequest(t, http.MethodPut, url+"/buckets/objects", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	id := uploadMultipart(t, url+"/buckets/first/objects/", "test.txt", "in first")
+	uploadMultipart(t, url+"/buckets/second/objects/", "test.txt", "in second")
+
+	resp = doRequest(t, http.MethodGet, url+"/buckets/first/objects/"+id, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	b, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "in first", string(b))
+
+	resp = doRequest(t, http.MethodGet, url+"/buckets/second/objects/"+id, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = doRequest(t, http.MethodGet, url+"/buckets/missing/objects/", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, url+"/buckets/first/objects/", nil)
+	var files []storedFile
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&files))
+	require.Len(t, files, 1)
+	assert.Equal(t, id, files[0].ID)
+
+	resp = doRequest(t, http.MethodDelete, url+"/buckets/first", nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp = doRequest(t, http.MethodDelete, url+"/buckets/first?force=true", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, url+"/buckets", nil)
+	var buckets []bucket
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&buckets))
+	require.Len(t, buckets, 1)
+	assert.Equal(t, "second", buckets[0].Name)
+}
+
+func TestRawUpload(t *testing.T) {
+	t.Parallel()
+	store, err := NewStore(t.TempDir(), WithMaxObjectSize(16))
+	require.NoError(t, err)
+	defer store.Close()
+
+	server := httptest.NewServer(NewAPI(store, []byte("testing")))
+	defer server.Close()
+	url := server.URL
+
+	resp := doRequest(t, http.MethodPost, url+"/objects/", strings.NewReader("raw content"),
+		"Content-Type", "text/plain", "X-Filename", "../raw.txt")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var created CreateObjectResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	assert.Equal(t, int64(11), created.Size)
+	sum := sha256.Sum256([]byte("raw content"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), created.Checksum)
+
+	sf, err := store.GetFileMetadata(created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(store.Dir(), "raw.txt"), sf.Path)
+
+	resp = doRequest(t, http.MethodPost, url+"/objects/", strings.NewReader("raw content"))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPost, url+"/objects/", strings.NewReader("more than sixteen bytes"),
+		"X-Filename", "big.bin")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	_, err = store.GetFileByPath(filepath.Join(store.Dir(), "big.bin"))
+	assert.ErrorIs(t, err, errNotExist)
+	_, err = os.Stat(filepath.Join(store.Dir(), "big.bin"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Appending past the limit is rejected by Content-Length up front
+	resp = doRequest(t, http.MethodPatch, url+"/objects/"+created.ID, strings.NewReader(" and more"))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	resp = doRequest(t, http.MethodPatch, url+"/objects/"+created.ID, strings.NewReader("!"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Buckets can raise the limit
+	resp = doRequest(t, http.MethodPut, url+"/buckets/large", strings.NewReader(`{"maxObjectSize": 64}`))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = doRequest(t, http.MethodPost, url+"/buckets/large/objects/", strings.NewReader("more than sixteen bytes"),
+		"X-Filename", "big.bin")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	// Patching other settings keeps the limit
+	resp = doRequest(t, http.MethodPatch, url+"/buckets/large", strings.NewReader(`{"versioning": true}`))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var b bucket
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&b))
+	assert.Equal(t, int64(64), b.MaxObjectSize)
+	resp = doRequest(t, http.MethodPatch, url+"/buckets/large", strings.NewReader(`{"maxObjectSize": 0}`))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	b = bucket{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&b))
+	assert.Zero(t, b.MaxObjectSize)
+
+	t.Run("upload limit", func(t *testing.T) {
+		limited := httptest.NewServer(NewAPI(store, []byte("testing"), WithMaxUploadSize(8)))
+		defer limited.Close()
+		resp := doRequest(t, http.MethodPost, limited.URL+"/objects/", strings.NewReader("raw content"),
+			"X-Filename", "limited.txt")
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		// Without a Content-Length the body is cut off once it goes over
+		resp = doRequest(t, http.MethodPost, limited.URL+"/objects/", io.MultiReader(strings.NewReader("raw content")),
+			"X-Filename", "limited.txt")
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		_, err := store.GetFileByPath(filepath.Join(store.Dir(), "limited.txt"))
+		assert.ErrorIs(t, err, errNotExist)
+		// Only uploads to /objects/ are limited
+		resp = doRequest(t, http.MethodPut, limited.URL+"/objects/"+created.ID, strings.NewReader("raw content"))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
+
+func doRequest(t *testing.T, method, url string, body io.Reader, headers ...string) *http.Response {
+	req, err := http.NewRequest(method, url, body)
+	require.NoError(t, err)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func uploadMultipart(t *testing.T, url, fileName, content string) string {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("file", fileName)
+	require.NoError(t, err)
+	_, err = fmt.Fprint(fw, content)
+	require.NoError(t, err)
+	mw.Close()
+
+	resp := doRequest(t, http.MethodPost, url, &buf, "Content-Type", mw.FormDataContentType())
+	if !assert.Equal(t, http.StatusCreated, resp.StatusCode) {
+		s, _ := io.ReadAll(resp.Body)
+		require.Fail(t, string(s))
+	}
+	var created CreateObjectResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	return created.ID
+}
+
+func TestRangeRequests(t *testing.T) {
+	t.Parallel()
+	store, url := setupS3(t)
+	id := uploadMultipart(t, url+"/objects/", "digits.txt", "0123456789")
+
+	resp := doRequest(t, http.MethodGet, url+"/objects/"+id, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+	assert.Equal(t, "10", resp.Header.Get("Content-Length"))
+
+	resp = doRequest(t, http.MethodGet, url+"/objects/"+id, nil, "Range", "bytes=2-4")
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 2-4/10", resp.Header.Get("Content-Range"))
+	b, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "234", string(b))
+
+	resp = doRequest(t, http.MethodGet, url+"/objects/"+id, nil, "Range", "bytes=-3")
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	b, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, "789", string(b))
+
+	resp = doRequest(t, http.MethodGet, url+"/objects/"+id, nil, "Range", "bytes=0-1,8-")
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	var parts []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, _ := io.ReadAll(part)
+		parts = append(parts, string(b))
+	}
+	assert.Equal(t, []string{"01", "89"}, parts)
+
+	resp = doRequest(t, http.MethodGet, url+"/objects/"+id, nil, "Range", "bytes=20-")
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+
+	// The other APIs serve ranges too
+	_, err = store.CreateBucket("ranges")
+	require.NoError(t, err)
+	resp = doRequest(t, http.MethodPut, url+"/ranges/digits.txt", strings.NewReader("0123456789"))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodGet, url+"/ranges/digits.txt", nil, "Range", "bytes=5-")
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	b, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, "56789", string(b))
+}
+
+func TestObjectMetadata(t *testing.T) {
+	t.Parallel()
+	_, url := setupS3(t)
+	id := uploadMultipart(t, url+"/objects/", "report.json", `{"ok": true}`)
+
+	resp := doRequest(t, http.MethodHead, url+"/objects/"+id, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "12", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.NotEmpty(t, resp.Header.Get("ETag"))
+	assert.NotEmpty(t, resp.Header.Get("Last-Modified"))
+	assert.NotEmpty(t, resp.Header.Get("X-Created"))
+	b, _ := io.ReadAll(resp.Body)
+	assert.Empty(t, b)
+
+	resp = doRequest(t, http.MethodGet, url+"/objects/"+id+"/metadata", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var sf storedFile
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&sf))
+	assert.Equal(t, id, sf.ID)
+	assert.Equal(t, int64(12), sf.Size)
+	assert.NotEmpty(t, sf.Checksum)
+
+	resp = doRequest(t, http.MethodHead, url+"/objects/missing", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = doRequest(t, http.MethodGet, url+"/objects/missing/metadata", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Azure Blob Storage REST API, path style like Azurite:
+// /{account}/{container}/{blob}. Containers are the same buckets served by
+// the S3 API, blocks are staged next to the data until a block list commits
+// them. See https://learn.microsoft.com/en-us/rest/api/storageservices/blob-service-rest-api
+const (
+	azureVersion    = "2021-12-02"
+	azureMaxResults = 5000
+)
+
+type azureError struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+type azureContainerProperties struct {
+	LastModified string `xml:"Last-Modified"`
+	Etag         string `xml:"Etag"`
+	LeaseStatus  string `xml:"LeaseStatus"`
+	LeaseState   string `xml:"LeaseState"`
+}
+
+type azureContainer struct {
+	Name       string                   `xml:"Name"`
+	Properties azureContainerProperties `xml:"Properties"`
+}
+
+type azureContainerList struct {
+	XMLName         xml.Name         `xml:"EnumerationResults"`
+	ServiceEndpoint string           `xml:"ServiceEndpoint,attr"`
+	Prefix          string           `xml:"Prefix,omitempty"`
+	Marker          string           `xml:"Marker,omitempty"`
+	MaxResults      int              `xml:"MaxResults"`
+	Containers      []azureContainer `xml:"Containers>Container"`
+	NextMarker      string           `xml:"NextMarker"`
+}
+
+type azureBlobProperties struct {
+	CreationTime  string `xml:"Creation-Time"`
+	LastModified  string `xml:"Last-Modified"`
+	Etag          string `xml:"Etag"`
+	ContentLength int64  `xml:"Content-Length"`
+	ContentType   string `xml:"Content-Type"`
+	BlobType      string `xml:"BlobType"`
+	AccessTier    string `xml:"AccessTier"`
+	LeaseStatus   string `xml:"LeaseStatus"`
+	LeaseState    string `xml:"LeaseState"`
+}
+
+type azureBlob struct {
+	Name       string              `xml:"Name"`
+	Properties azureBlobProperties `xml:"Properties"`
+}
+
+type azureBlobPrefix struct {
+	Name string `xml:"Name"`
+}
+
+type azureBlobList struct {
+	XMLName         xml.Name          `xml:"EnumerationResults"`
+	ServiceEndpoint string            `xml:"ServiceEndpoint,attr"`
+	ContainerName   string            `xml:"ContainerName,attr"`
+	Prefix          string            `xml:"Prefix,omitempty"`
+	Marker          string            `xml:"Marker,omitempty"`
+	MaxResults      int               `xml:"MaxResults"`
+	Delimiter       string            `xml:"Delimiter,omitempty"`
+	Blobs           []azureBlob       `xml:"Blobs>Blob"`
+	BlobPrefixes    []azureBlobPrefix `xml:"Blobs>BlobPrefix"`
+	NextMarker      string            `xml:"NextMarker"`
+}
+
+// azureBlockListRequest keeps the Committed, Uncommitted and Latest entries
+// in the order they were listed.
+type azureBlockListRequest struct {
+	XMLName xml.Name `xml:"BlockList"`
+	Blocks  []struct {
+		XMLName xml.Name
+		ID      string `xml:",chardata"`
+	} `xml:",any"`
+}
+
+type azureBlock struct {
+	Name string `xml:"Name"`
+	Size int64  `xml:"Size"`
+}
+
+type azureBlockList struct {
+	XMLName           xml.Name     `xml:"BlockList"`
+	CommittedBlocks   []azureBlock `xml:"CommittedBlocks>Block"`
+	UncommittedBlocks []azureBlock `xml:"UncommittedBlocks>Block"`
+}
+
+// Azure serves every account configured with WithAzureAccounts under
+// /{account}/.
+func (a *api) Azure(w http.ResponseWriter, r *http.Request) {
+	account, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	w.Header().Set("X-Ms-Request-Id", generateRandomUUID())
+	w.Header().Set("X-Ms-Version", azureVersion)
+	if !a.azureAuthenticate(w, r, account) {
+		return
+	}
+	query := r.URL.Query()
+	containerName, blobName, _ := strings.Cut(rest, "/")
+	if containerName == "" {
+		if r.Method != http.MethodGet || query.Get("comp") != "list" {
+			azureWriteError(w, r, http.StatusBadRequest, "UnsupportedHttpVerb", "The resource doesn't support specified Http Verb.")
+			return
+		}
+		a.AzureListContainers(w, r, account)
+		return
+	}
+	if blobName == "" {
+		if query.Get("restype") != "container" {
+			azureWriteError(w, r, http.StatusBadRequest, "InvalidQueryParameterValue", "Value for one of the query parameters specified in the request URI is invalid.")
+			return
+		}
+		if query.Get("comp") == "list" {
+			if r.Method != http.MethodGet {
+				azureWriteError(w, r, http.StatusMethodNotAllowed, "UnsupportedHttpVerb", "The resource doesn't support specified Http Verb.")
+				return
+			}
+			a.AzureListBlobs(w, r, account, containerName)
+			return
+		}
+		a.AzureContainer(w, r, containerName)
+		return
+	}
+
+	if _, err := a.store.GetBucket(containerName); err != nil {
+		azureWriteError(w, r, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+		return
+	}
+	p, ok := a.keyPath(containerName, blobName)
+	if !ok {
+		azureWriteError(w, r, http.StatusBadRequest, "InvalidResourceName", "The specified resource name contains invalid characters.")
+		return
+	}
+	switch comp := query.Get("comp"); {
+	case comp == "block" && r.Method == http.MethodPut:
+		a.AzurePutBlock(w, r, containerName, blobName)
+	case comp == "blocklist" && r.Method == http.MethodPut:
+		a.AzurePutBlockList(w, r, containerName, blobName, p)
+	case comp == "blocklist" && r.Method == http.MethodGet:
+		a.AzureGetBlockList(w, r, containerName, blobName)
+	case comp != "":
+		azureWriteError(w, r, http.StatusBadRequest, "InvalidQueryParameterValue", "Value for one of the query parameters specified in the request URI is invalid.")
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		a.AzureGetBlob(w, r, p)
+	case r.Method == http.MethodPut:
+		a.AzurePutBlob(w, r, p)
+	case r.Method == http.MethodDelete:
+		a.AzureDeleteBlob(w, r, p)
+	default:
+		azureWriteError(w, r, http.StatusMethodNotAllowed, "UnsupportedHttpVerb", "The resource doesn't support specified Http Verb.")
+	}
+}
+
+// azureAuthenticate verifies the SharedKey signature of the request, writing
+// the Azure error and returning false when it doesn't hold.
+func (a *api) azureAuthenticate(w http.ResponseWriter, r *http.Request, account string) bool {
+	err := verifySharedKey(r, account, a.azureAccounts, time.Now())
+	if err == nil {
+		return true
+	}
+	var keyErr *sharedKeyError
+	if errors.As(err, &keyErr) {
+		azureWriteError(w, r, keyErr.status, keyErr.code, keyErr.message)
+		return false
+	}
+	azureInternalError(err, w, r)
+	return false
+}
+
+func (a *api) AzureListContainers(w http.ResponseWriter, r *http.Request, account string) {
+	query := r.URL.Query()
+	maxResults, ok := azureMaxResultsParam(w, r)
+	if !ok {
+		return
+	}
+	buckets := a.store.ListBuckets()
+	names := make([]string, 0, len(buckets))
+	byName := make(map[string]bucket, len(buckets))
+	for _, b := range buckets {
+		names = append(names, b.Name)
+		byName[b.Name] = b
+	}
+	sort.Strings(names)
+
+	result := azureContainerList{
+		ServiceEndpoint: gcsBaseURL(r) + "/" + account + "/",
+		Prefix:          query.Get("prefix"),
+		Marker:          query.Get("marker"),
+		MaxResults:      maxResults,
+		Containers:      []azureContainer{},
+	}
+	listing := listKeys(names, result.Prefix, "", result.Marker, maxResults)
+	for _, name := range listing.Keys {
+		b := byName[name]
+		result.Containers = append(result.Containers, azureContainer{
+			Name:       name,
+			Properties: azureContainerResource(b),
+		})
+	}
+	if listing.Truncated {
+		result.NextMarker = listing.NextMarker
+	}
+	azureWriteXML(w, http.StatusOK, result)
+}
+
+func (a *api) AzureContainer(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodPut:
+		if a.azureAccounts[name] != "" {
+			azureWriteError(w, r, http.StatusBadRequest, "InvalidResourceName", "The specified resource name contains invalid characters.")
+			return
+		}
+		b, err := a.store.CreateBucket(name)
+		if err != nil {
+			if errors.Is(err, errInvalidBucketName) {
+				azureWriteError(w, r, http.StatusBadRequest, "InvalidResourceName", "The specified resource name contains invalid characters.")
+				return
+			}
+			if errors.Is(err, errBucketExist) {
+				azureWriteError(w, r, http.StatusConflict, "ContainerAlreadyExists", "The specified container already exists.")
+				return
+			}
+			azureInternalError(err, w, r)
+			return
+		}
+		azureContainerHeaders(w.Header(), *b)
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		b, err := a.store.GetBucket(name)
+		if err != nil {
+			azureWriteError(w, r, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+			return
+		}
+		azureContainerHeaders(w.Header(), *b)
+		w.Header().Set("X-Ms-Lease-Status", "unlocked")
+		w.Header().Set("X-Ms-Lease-State", "available")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		// Azure deletes containers along with their blobs
+		if err := a.store.DeleteBucket(name, true); err != nil {
+			if errors.Is(err, errBucketNotExist) {
+				azureWriteError(w, r, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+				return
+			}
+			azureStoreError(err, w, r)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		azureWriteError(w, r, http.StatusMethodNotAllowed, "UnsupportedHttpVerb", "The resource doesn't support specified Http Verb.")
+	}
+}
+
+func (a *api) AzureListBlobs(w http.ResponseWriter, r *http.Request, account, containerName string) {
+	if _, err := a.store.GetBucket(containerName); err != nil {
+		azureWriteError(w, r, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+		return
+	}
+	query := r.URL.Query()
+	maxResults, ok := azureMaxResultsParam(w, r)
+	if !ok {
+		return
+	}
+
+	files, err := a.store.ListFiles()
+	if err != nil {
+		azureInternalError(err, w, r)
+		return
+	}
+	byKey := make(map[string]storedFile)
+	keys := make([]string, 0, len(files))
+	for _, sf := range files {
+		if sf.Bucket != containerName {
+			continue
+		}
+		key, ok := a.objectKey(sf)
+		if !ok {
+			continue
+		}
+		byKey[key] = sf
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := azureBlobList{
+		ServiceEndpoint: gcsBaseURL(r) + "/" + account + "/",
+		ContainerName:   containerName,
+		Prefix:          query.Get("prefix"),
+		Marker:          query.Get("marker"),
+		MaxResults:      maxResults,
+		Delimiter:       query.Get("delimiter"),
+		Blobs:           []azureBlob{},
+	}
+	listing := listKeys(keys, result.Prefix, result.Delimiter, result.Marker, maxResults)
+	for _, key := range listing.Keys {
+		sf := byKey[key]
+		result.Blobs = append(result.Blobs, azureBlob{
+			Name: key,
+			Properties: azureBlobProperties{
+				CreationTime:  sf.Created.UTC().Format(http.TimeFormat),
+				LastModified:  sf.lastModified().UTC().Format(http.TimeFormat),
+				Etag:          objectETag(&sf),
+				ContentLength: sf.Size,
+				ContentType:   sf.contentType(),
+				BlobType:      "BlockBlob",
+				AccessTier:    "Hot",
+				LeaseStatus:   "unlocked",
+				LeaseState:    "available",
+			},
+		})
+	}
+	for _, prefix := range listing.CommonPrefixes {
+		result.BlobPrefixes = append(result.BlobPrefixes, azureBlobPrefix{Name: prefix})
+	}
+	if listing.Truncated {
+		result.NextMarker = listing.NextMarker
+	}
+	azureWriteXML(w, http.StatusOK, result)
+}
+
+func (a *api) AzureGetBlob(w http.ResponseWriter, r *http.Request, p string) {
+	sf, err := a.store.GetFileByPath(p)
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			azureWriteError(w, r, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+			return
+		}
+		azureInternalError(err, w, r)
+		return
+	}
+	header := w.Header()
+	azureBlobHeaders(header, sf)
+	header.Set("Content-Length", strconv.FormatInt(sf.Size, 10))
+	header.Set("Content-Type", sf.contentType())
+	header.Set("X-Ms-Creation-Time", sf.Created.UTC().Format(http.TimeFormat))
+	header.Set("X-Ms-Blob-Type", "BlockBlob")
+	setMetadataHeaders(header, azureMetadataHeaderPrefix, sf.Metadata)
+	header.Set("X-Ms-Lease-Status", "unlocked")
+	header.Set("X-Ms-Lease-State", "available")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	f, sf, err := a.store.OpenFile(sf.ID)
+	if err != nil {
+		if errors.Is(err, errNotExist) || errors.Is(err, os.ErrNotExist) {
+			azureWriteError(w, r, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+			return
+		}
+		azureInternalError(err, w, r)
+		return
+	}
+	defer f.Close()
+	serveObject(w, r, f, sf)
+}
+
+// AzurePutBlob writes a block blob in a single request, the other blob types
+// aren't supported.
+func (a *api) AzurePutBlob(w http.ResponseWriter, r *http.Request, p string) {
+	switch r.Header.Get("X-Ms-Blob-Type") {
+	case "BlockBlob":
+	case "":
+		azureWriteError(w, r, http.StatusBadRequest, "MissingRequiredHeader", "An HTTP header that's mandatory for this request is not specified.")
+		return
+	default:
+		azureWriteError(w, r, http.StatusBadRequest, "InvalidHeaderValue", "Only BlockBlob is supported for x-ms-blob-type.")
+		return
+	}
+	sf, created, err := a.store.UpsertFile(p, r.Body, azureFileOptions(r.Header)...)
+	if err != nil {
+		azureStoreError(err, w, r)
+		return
+	}
+	if created {
+		a.publishCreated(sf.ID)
+	}
+	azureBlobHeaders(w.Header(), sf)
+	w.Header().Set("X-Ms-Request-Server-Encrypted", "false")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (a *api) AzurePutBlock(w http.ResponseWriter, r *http.Request, containerName, blobName string) {
+	blockID, ok := azureBlockID(r.URL.Query().Get("blockid"))
+	if !ok {
+		azureWriteError(w, r, http.StatusBadRequest, "InvalidQueryParameterValue", "Value for one of the query parameters specified in the request URI is invalid.")
+		return
+	}
+	if _, err := a.store.StageBlock(containerName, blobName, blockID, r.Body); err != nil {
+		azureInternalError(err, w, r)
+		return
+	}
+	w.Header().Set("X-Ms-Request-Server-Encrypted", "false")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// AzurePutBlockList commits staged blocks into the blob. Blocks are dropped
+// once committed, so only the staged ones can be listed, whether as Latest,
+// Uncommitted or Committed.
+func (a *api) AzurePutBlockList(w http.ResponseWriter, r *http.Request, containerName, blobName, p string) {
+	var req azureBlockListRequest
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		azureWriteError(w, r, http.StatusBadRequest, "InvalidXmlDocument", "XML specified is not syntactically valid.")
+		return
+	}
+	blockIDs := make([]string, 0, len(req.Blocks))
+	for _, block := range req.Blocks {
+		id, ok := azureBlockID(block.ID)
+		if !ok {
+			azureWriteError(w, r, http.StatusBadRequest, "InvalidXmlNodeValue", "The value for one of the XML nodes is not in the correct format.")
+			return
+		}
+		blockIDs = append(blockIDs, id)
+	}
+	sf, created, err := a.store.CommitBlocks(containerName, blobName, p, blockIDs, azureFileOptions(r.Header)...)
+	if err != nil {
+		if errors.Is(err, errInvalidBlockList) {
+			azureWriteError(w, r, http.StatusBadRequest, "InvalidBlockList", "The specified block list is invalid.")
+			return
+		}
+		azureStoreError(err, w, r)
+		return
+	}
+	if created {
+		a.publishCreated(sf.ID)
+	}
+	azureBlobHeaders(w.Header(), sf)
+	w.Header().Set("X-Ms-Request-Server-Encrypted", "false")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// AzureGetBlockList lists the staged blocks, committed ones aren't tracked.
+func (a *api) AzureGetBlockList(w http.ResponseWriter, r *http.Request, containerName, blobName string) {
+	blocks, err := a.store.ListBlocks(containerName, blobName)
+	if err != nil {
+		azureInternalError(err, w, r)
+		return
+	}
+	result := azureBlockList{
+		CommittedBlocks:   []azureBlock{},
+		UncommittedBlocks: []azureBlock{},
+	}
+	if r.URL.Query().Get("blocklisttype") != "committed" {
+		for _, block := range blocks {
+			result.UncommittedBlocks = append(result.UncommittedBlocks, azureBlock{
+				Name: base64.StdEncoding.EncodeToString([]byte(block.ID)),
+				Size: block.Size,
+			})
+		}
+	}
+	azureWriteXML(w, http.StatusOK, result)
+}
+
+func (a *api) AzureDeleteBlob(w http.ResponseWriter, r *http.Request, p string) {
+	sf, err := a.store.GetFileByPath(p)
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			azureWriteError(w, r, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+			return
+		}
+		azureInternalError(err, w, r)
+		return
+	}
+	if err := a.store.DeleteFile(sf.ID); err == nil {
+		a.publishDeleted(sf.ID)
+	} else if !errors.Is(err, errNotExist) {
+		azureStoreError(err, w, r)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// azureBlockID decodes a base64 block ID.
+func azureBlockID(s string) (string, bool) {
+	id, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(id) == 0 || len(id) > maxBlockIDLength {
+		return "", false
+	}
+	return string(id), true
+}
+
+func azureMaxResultsParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	maxResults := azureMaxResults
+	if v := r.URL.Query().Get("maxresults"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			azureWriteError(w, r, http.StatusBadRequest, "OutOfRangeQueryParameterValue", "One of the query parameters specified in the request URI is outside the permissible range.")
+			return 0, false
+		}
+		if n < maxResults {
+			maxResults = n
+		}
+	}
+	return maxResults, true
+}
+
+// azureContainerETag stands in for the container ETag, which only changes
+// with its metadata here.
+func azureContainerETag(b bucket) string {
+	return fmt.Sprintf(`"0x%X"`, b.Created.UnixNano())
+}
+
+func azureContainerResource(b bucket) azureContainerProperties {
+	return azureContainerProperties{
+		LastModified: b.Created.UTC().Format(http.TimeFormat),
+		Etag:         azureContainerETag(b),
+		LeaseStatus:  "unlocked",
+		LeaseState:   "available",
+	}
+}
+
+func azureContainerHeaders(header http.Header, b bucket) {
+	header.Set("ETag", azureContainerETag(b))
+	header.Set("Last-Modified", b.Created.UTC().Format(http.TimeFormat))
+}
+
+// azureFileOptions returns the content type and metadata declared for a blob
+// by Put Blob and Put Block List.
+func azureFileOptions(header http.Header) []FileOption {
+	return []FileOption{
+		WithContentType(header.Get("X-Ms-Blob-Content-Type")),
+		WithMetadata(metadataFromHeader(header, azureMetadataHeaderPrefix)),
+	}
+}
+
+func azureBlobHeaders(header http.Header, sf *storedFile) {
+	header.Set("ETag", objectETag(sf))
+	header.Set("Last-Modified", sf.lastModified().UTC().Format(http.TimeFormat))
+}
+
+func azureWriteXML(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprint(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Encode(v)
+}
+
+func azureWriteError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	w.Header().Set("X-Ms-Error-Code", code)
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	azureWriteXML(w, status, azureError{
+		Code:    code,
+		Message: message,
+	})
+}
+
+// azureStoreError answers with the Azure error matching an error from the
+// store or an internal error.
+func azureStoreError(err error, w http.ResponseWriter, r *http.Request) {
+	switch {
+	case errors.Is(err, errTooLarge):
+		azureWriteError(w, r, http.StatusRequestEntityTooLarge, "RequestBodyTooLarge", "The request body is too large and exceeds the maximum permissible limit.")
+	case errors.Is(err, errLocked):
+		azureWriteError(w, r, http.StatusConflict, "BlobImmutableDueToPolicy", "This operation is not permitted as the blob is immutable due to a policy.")
+	default:
+		azureInternalError(err, w, r)
+	}
+}
+
+func azureInternalError(err error, w http.ResponseWriter, r *http.Request) {
+	log.Printf("Internal Server Error: '%s'\n", err)
+	azureWriteError(w, r, http.StatusInternalServerError, "InternalError", "The server encountered an internal error. Please retry the request.")
+}
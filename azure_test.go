@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAzureAPI(t *testing.T) {
+	t.Parallel()
+	store, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+	server := httptest.NewServer(NewAPI(store, []byte("testing"), WithAzureAccounts(testAzureAccounts)))
+	defer server.Close()
+	url := server.URL + "/devaccount"
+
+	do := func(method, url string, body string, headers ...string) *http.Response {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+		r, err := http.NewRequest(method, url, reader)
+		require.NoError(t, err)
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		signSharedKey(r, "devaccount", testAzureAccounts["devaccount"], time.Now())
+		resp, err := http.DefaultClient.Do(r)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	errorCode := func(resp *http.Response) string {
+		var azureErr azureError
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&azureErr))
+		return azureErr.Code
+	}
+	blockID := func(id string) string {
+		return base64.StdEncoding.EncodeToString([]byte(id))
+	}
+
+	resp := do(http.MethodPut, url+"/media?restype=container", "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = do(http.MethodPut, url+"/media?restype=container", "")
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Equal(t, "ContainerAlreadyExists", errorCode(resp))
+
+	t.Run("unsigned", func(t *testing.T) {
+		resp := doRequest(t, http.MethodGet, url+"?comp=list", nil)
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.Equal(t, "NoAuthenticationInformation", errorCode(resp))
+	})
+
+	t.Run("put blob", func(t *testing.T) {
+		resp := do(http.MethodPut, url+"/media/docs/readme.txt", "hello")
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, "MissingRequiredHeader", errorCode(resp))
+
+		resp = do(http.MethodPut, url+"/media/docs/readme.txt", "hello", "X-Ms-Blob-Type", "BlockBlob")
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get("ETag"))
+
+		resp = do(http.MethodGet, url+"/media/docs/readme.txt", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "BlockBlob", resp.Header.Get("X-Ms-Blob-Type"))
+		b, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "hello", string(b))
+	})
+
+	t.Run("block list", func(t *testing.T) {
+		resp := do(http.MethodPut, url+"/media/video.bin?comp=block&blockid="+blockID("0001"), "first ")
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		resp = do(http.MethodPut, url+"/media/video.bin?comp=block&blockid="+blockID("0002"), "second")
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		resp = do(http.MethodGet, url+"/media/video.bin?comp=blocklist&blocklisttype=all", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var blocks azureBlockList
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&blocks))
+		require.Len(t, blocks.UncommittedBlocks, 2)
+		assert.Equal(t, blockID("0001"), blocks.UncommittedBlocks[0].Name)
+		assert.Equal(t, int64(6), blocks.UncommittedBlocks[1].Size)
+
+		resp = do(http.MethodPut, url+"/media/video.bin?comp=blocklist",
+			"<BlockList><Latest>"+blockID("0001")+"</Latest><Latest>"+blockID("0003")+"</Latest></BlockList>")
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, "InvalidBlockList", errorCode(resp))
+
+		resp = do(http.MethodPut, url+"/media/video.bin?comp=blocklist",
+			"<BlockList><Uncommitted>"+blockID("0001")+"</Uncommitted><Latest>"+blockID("0002")+"</Latest></BlockList>",
+			"X-Ms-Blob-Content-Type", "video/mp4", "X-Ms-Meta-Camera", "front")
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		resp = do(http.MethodGet, url+"/media/video.bin", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "video/mp4", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "front", resp.Header.Get("X-Ms-Meta-Camera"))
+		b, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "first second", string(b))
+	})
+
+	t.Run("list blobs", func(t *testing.T) {
+		resp := do(http.MethodGet, url+"/media?restype=container&comp=list&delimiter=/", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var result azureBlobList
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&result))
+		require.Len(t, result.Blobs, 1)
+		assert.Equal(t, "video.bin", result.Blobs[0].Name)
+		assert.Equal(t, int64(12), result.Blobs[0].Properties.ContentLength)
+		require.Len(t, result.BlobPrefixes, 1)
+		assert.Equal(t, "docs/", result.BlobPrefixes[0].Name)
+
+		resp = do(http.MethodGet, url+"/media?restype=container&comp=list&maxresults=1", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		result = azureBlobList{}
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&result))
+		require.Len(t, result.Blobs, 1)
+		assert.Equal(t, "docs/readme.txt", result.Blobs[0].Name)
+		assert.NotEmpty(t, result.NextMarker)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		resp := do(http.MethodDelete, url+"/media/docs/readme.txt", "")
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+		resp = do(http.MethodGet, url+"/media/docs/readme.txt", "")
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.Equal(t, "BlobNotFound", errorCode(resp))
+
+		resp = do(http.MethodDelete, url+"/media?restype=container", "")
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+		resp = do(http.MethodGet, url+"/media?restype=container&comp=list", "")
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Content is stored once per distinct SHA-256 in
+// .blobs/<first two hex digits>/<next two>/<hash> inside the data directory,
+// records point at it through storedFile.Blob. Blobs are never written to
+// after being stored, writes store a new one.
+const blobsDirName = ".blobs"
+
+// Where content was kept before the blob store, see migrateContent
+const (
+	legacyTrashDirName    = ".trash"
+	legacyVersionsDirName = ".versions"
+)
+
+func (db *Store) blobPath(hash string) string {
+	return filepath.Join(db.dir, blobsDirName, hash[:2], hash[2:4], hash)
+}
+
+// openBlob opens a blob for reading. Records without one, whose content was
+// already missing when it was migrated, fail like a missing file.
+func (db *Store) openBlob(hash string) (*os.File, error) {
+	if hash == "" {
+		return nil, &fs.PathError{Op: "open", Path: "blob", Err: fs.ErrNotExist}
+	}
+	return os.Open(db.blobPath(hash))
+}
+
+// writeBlob streams reader into a temp file, syncs it and renames it into
+// place under the hash of its content. It returns the size and hex encoded
+// SHA-256 of what was written. Content that is already stored is kept as is
+// and the copy dropped.
+func (db *Store) writeBlob(reader io.Reader) (int64, string, error) {
+	dir := filepath.Join(db.dir, blobsDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, "", err
+	}
+	tmpPath := tempFilePath(filepath.Join(dir, "blob"))
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, "", err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), reader)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, "", err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	p := db.blobPath(hash)
+	if _, err := os.Stat(p); err == nil {
+		os.Remove(tmpPath)
+		return n, hash, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		os.Remove(tmpPath)
+		return 0, "", err
+	}
+	if err := os.Rename(tmpPath, p); err != nil {
+		os.Remove(tmpPath)
+		return 0, "", err
+	}
+	syncDir(filepath.Dir(p))
+	return n, hash, nil
+}
+
+// storeFile copies the file at p into the blob store, see writeBlob.
+func (db *Store) storeFile(p string) (int64, string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	return db.writeBlob(f)
+}
+
+// reference takes a reference on a blob for a record being indexed.
+func (db *Store) reference(hash string) {
+	if hash != "" {
+		db.refs[hash]++
+	}
+}
+
+// dereference drops a reference on a blob. Blobs left without any are
+// removed once the manifest no longer refers to them, see appendRecord.
+func (db *Store) dereference(hash string) {
+	if hash == "" {
+		return
+	}
+	if db.refs[hash]--; db.refs[hash] <= 0 {
+		delete(db.refs, hash)
+		db.released = append(db.released, hash)
+	}
+}
+
+// removeReleased removes the blobs that lost their last reference, unless a
+// record took a new one since.
+func (db *Store) removeReleased() {
+	for _, hash := range db.released {
+		if db.refs[hash] > 0 {
+			continue
+		}
+		if err := os.Remove(db.blobPath(hash)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to remove blob '%s': '%s'\n", hash, err)
+		}
+	}
+	db.released = nil
+}
+
+// The index is only changed through the helpers below so every record holds
+// exactly one reference on its blob. Records replacing others take their
+// reference before the replaced one is dropped.
+
+func (db *Store) putFile(id string, sf storedFile) {
+	db.reference(sf.Blob)
+	if old, ok := db.storedFiles[id]; ok {
+		db.dereference(old.Blob)
+	}
+	db.storedFiles[id] = sf
+}
+
+func (db *Store) dropFile(id string) {
+	if old, ok := db.storedFiles[id]; ok {
+		db.dereference(old.Blob)
+		delete(db.storedFiles, id)
+	}
+}
+
+func (db *Store) putTrash(id string, sf storedFile) {
+	db.reference(sf.Blob)
+	if old, ok := db.trash[id]; ok {
+		db.dereference(old.Blob)
+	}
+	db.trash[id] = sf
+}
+
+func (db *Store) dropTrash(id string) {
+	if old, ok := db.trash[id]; ok {
+		db.dereference(old.Blob)
+		delete(db.trash, id)
+	}
+}
+
+func (db *Store) putVersion(id string, v objectVersion) {
+	db.reference(v.blob())
+	db.versions[id] = append(db.versions[id], v)
+}
+
+// collectGarbage removes the blobs no record refers to and temp files left
+// behind by writes that never finished, returning how many there were.
+func (db *Store) collectGarbage() (int, error) {
+	removed := 0
+	err := filepath.WalkDir(filepath.Join(db.dir, blobsDirName), func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if !isTempFile(d.Name()) && db.refs[d.Name()] > 0 {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// CollectGarbage removes the blobs no record refers to. Blobs are removed as
+// soon as they lose their last reference, this only finds the ones left
+// behind by a crash.
+func (db *Store) CollectGarbage() (int, error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.aoFile == nil {
+		return 0, errExiting
+	}
+	return db.collectGarbage()
+}
+
+type CollectGarbageResponse struct {
+	Removed int `json:"removed"`
+}
+
+// CollectGarbage runs a garbage collection on POST /admin/gc.
+func (a *api) CollectGarbage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
+		return
+	}
+	removed, err := a.store.CollectGarbage()
+	if err != nil {
+		internalError(err, w, r)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(CollectGarbageResponse{Removed: removed})
+}
+
+// migrateContent moves the content of records written before the blob store
+// into it: objects stored at their path, trashed objects in .trash/<id> and
+// versions in .versions/<id>/<version id>. Records whose content is missing
+// are left for fsck to report. It returns the files that can be removed
+// once the migrated records are in the manifest.
+func (db *Store) migrateContent() ([]string, error) {
+	var migrated []string
+	// Only called for records without a blob, so no reference is dropped
+	migrate := func(sf *storedFile, p string) error {
+		size, hash, err := db.storeFile(p)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		sf.Blob = hash
+		if sf.Checksum == "" {
+			// Records from before checksums were tracked
+			sf.Size, sf.Checksum = size, hash
+		}
+		migrated = append(migrated, p)
+		return nil
+	}
+	for id, sf := range db.storedFiles {
+		if sf.Blob != "" {
+			continue
+		}
+		if err := migrate(&sf, sf.Path); err != nil {
+			return nil, err
+		}
+		db.putFile(id, sf)
+	}
+	for id, sf := range db.trash {
+		if sf.Blob != "" {
+			continue
+		}
+		if err := migrate(&sf, filepath.Join(db.dir, legacyTrashDirName, id)); err != nil {
+			return nil, err
+		}
+		db.putTrash(id, sf)
+	}
+	for id, versions := range db.versions {
+		for i := range versions {
+			v := &versions[i]
+			if v.DeleteMarker || v.File.Blob != "" {
+				continue
+			}
+			if err := migrate(&v.File, filepath.Join(db.dir, legacyVersionsDirName, id, v.VersionID)); err != nil {
+				return nil, err
+			}
+			db.reference(v.File.Blob)
+		}
+	}
+	return migrated, nil
+}
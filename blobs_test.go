@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// storedBlobs returns the hashes of the blobs on disk.
+func storedBlobs(t *testing.T, store *Store) []string {
+	var hashes []string
+	err := filepath.WalkDir(filepath.Join(store.Dir(), blobsDirName), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		hashes = append(hashes, d.Name())
+		return nil
+	})
+	require.NoError(t, err)
+	return hashes
+}
+
+func TestBlobStore(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	store, err := NewStore(dir)
+	require.NoError(t, err)
+	defer func() { store.Close() }()
+
+	a, err := store.CreateFile(filepath.Join(dir, "a.txt"), strings.NewReader("same"))
+	require.NoError(t, err)
+	b, err := store.CreateFile(filepath.Join(dir, "b.txt"), strings.NewReader("same"))
+	require.NoError(t, err)
+	assert.Equal(t, a.Blob, b.Blob)
+	assert.Equal(t, a.Checksum, a.Blob)
+	assert.FileExists(t, filepath.Join(dir, blobsDirName, a.Blob[:2], a.Blob[2:4], a.Blob))
+	assert.NoFileExists(t, a.Path)
+
+	copied, err := store.CopyFile(a.ID)
+	require.NoError(t, err)
+	assert.Equal(t, a.Blob, copied.Blob)
+	assert.Equal(t, []string{a.Blob}, storedBlobs(t, store))
+
+	// The blob stays until the last record referencing it is gone
+	require.NoError(t, store.DeleteFile(a.ID))
+	require.NoError(t, store.UpdateFile(b.ID, strings.NewReader("different"), true))
+	assert.Len(t, storedBlobs(t, store), 2)
+	var buf bytes.Buffer
+	require.NoError(t, store.ReadFile(copied.ID, &buf))
+	assert.Equal(t, "same", buf.String())
+	require.NoError(t, store.DeleteFile(copied.ID))
+	updated, err := store.GetFileMetadata(b.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{updated.Blob}, storedBlobs(t, store))
+
+	t.Run("garbage collected on start", func(t *testing.T) {
+		// Left behind by a crash between the manifest and the blob store
+		stray := filepath.Join(dir, blobsDirName, "ab", "cd", "abcd")
+		require.NoError(t, os.MkdirAll(filepath.Dir(stray), 0700))
+		require.NoError(t, os.WriteFile(stray, []byte("stray"), 0600))
+		partial := tempFilePath(filepath.Join(dir, blobsDirName, "blob"))
+		require.NoError(t, os.WriteFile(partial, []byte("part"), 0600))
+		require.NoError(t, store.Close())
+
+		store, err = NewStore(dir)
+		require.NoError(t, err)
+		assert.Equal(t, []string{updated.Blob}, storedBlobs(t, store))
+	})
+}
+
+func TestBlobMigration(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	legacy := storedFile{ID: "legacy", Path: filepath.Join(dir, "fixtures", "legacy.txt"), Size: 6}
+	trashed := storedFile{ID: "trashed", Path: filepath.Join(dir, "trashed.txt"), Size: 7}
+	missing := storedFile{ID: "missing", Path: filepath.Join(dir, "missing.txt"), Size: 1}
+	version := objectVersion{VersionID: "v1", File: legacy}
+	manifest := manifestHeader()
+	for _, rec := range []manifestRecord{
+		{Action: "ADD", ID: legacy.ID, File: &legacy},
+		{Action: "ADD_VERSION", ID: legacy.ID, Version: &version},
+		{Action: "TRASH", ID: trashed.ID, File: &trashed},
+		{Action: "ADD", ID: missing.ID, File: &missing},
+	} {
+		manifest = append(manifest, encodeRecord(rec)...)
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, dbFileName), manifest, 0600))
+	for p, content := range map[string]string{
+		legacy.Path: "legacy",
+		filepath.Join(dir, legacyTrashDirName, trashed.ID):         "trashed",
+		filepath.Join(dir, legacyVersionsDirName, legacy.ID, "v1"): "older",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0700))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0600))
+	}
+
+	store, err := NewStore(dir)
+	require.NoError(t, err)
+	defer store.Close()
+	assert.Len(t, storedBlobs(t, store), 3)
+	assert.NoFileExists(t, legacy.Path)
+	assert.NoDirExists(t, filepath.Join(dir, legacyTrashDirName))
+	assert.NoDirExists(t, filepath.Join(dir, legacyVersionsDirName))
+
+	var buf bytes.Buffer
+	require.NoError(t, store.ReadFile(legacy.ID, &buf))
+	assert.Equal(t, "legacy", buf.String())
+	sf, err := store.GetFileMetadata(legacy.ID)
+	require.NoError(t, err)
+	assert.Equal(t, sf.Blob, sf.Checksum)
+	f, _, err := store.OpenVersion(legacy.ID, "v1")
+	require.NoError(t, err)
+	f.Close()
+	restored, err := store.RestoreTrash(trashed.ID)
+	require.NoError(t, err)
+	assert.NotEmpty(t, restored.Blob)
+
+	report, err := store.Fsck(FsckOptions{})
+	require.NoError(t, err)
+	require.Len(t, report.Dangling, 1)
+	assert.Equal(t, missing.ID, report.Dangling[0].ID)
+	assert.Empty(t, report.Orphaned)
+	assert.Empty(t, report.Mismatched)
+}
+
+func TestCollectGarbageAPI(t *testing.T) {
+	t.Parallel()
+	store, url := setupS3(t)
+	stray := filepath.Join(store.Dir(), blobsDirName, "ab", "cd", "abcd")
+	require.NoError(t, os.MkdirAll(filepath.Dir(stray), 0700))
+	require.NoError(t, os.WriteFile(stray, []byte("stray"), 0600))
+
+	resp := doRequest(t, http.MethodPost, url+"/admin/gc", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var result CollectGarbageResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, 1, result.Removed)
+	assert.NoFileExists(t, stray)
+	resp = doRequest(t, http.MethodGet, url+"/admin/gc", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Blocks are staged in .blocks/<hash of bucket and key>/ until a block list
+// commits them into the object, Azure Block Blob style. Unlike multipart
+// uploads there is no upload to start, blocks belong to the object they are
+// staged for and are dropped once a block list is committed.
+
+const (
+	blocksDirName = ".blocks"
+	// Longest block ID accepted, Azure allows 64 bytes before encoding
+	maxBlockIDLength = 64
+)
+
+var (
+	errInvalidBlockID   = errors.New("Block ID must be between 1 and 64 bytes")
+	errInvalidBlockList = errors.New("Block list references a block that isn't staged")
+)
+
+type stagedBlock struct {
+	ID           string
+	Size         int64
+	LastModified time.Time
+}
+
+func (db *Store) blocksDir(bucket, key string) string {
+	sum := sha256.Sum256([]byte(bucket + "/" + key))
+	return filepath.Join(db.dir, blocksDirName, hex.EncodeToString(sum[:]))
+}
+
+// StageBlock stores a block for key in bucket, replacing a block staged
+// earlier under the same ID.
+func (db *Store) StageBlock(bucket, key, blockID string, reader io.Reader) (*stagedBlock, error) {
+	if len(blockID) == 0 || len(blockID) > maxBlockIDLength {
+		return nil, errInvalidBlockID
+	}
+	dir := db.blocksDir(bucket, key)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	blockPath := filepath.Join(dir, hex.EncodeToString([]byte(blockID)))
+	tmpPath := blockPath + "." + generateRandomUUID() + partTmpSuffix
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(f, reader)
+	f.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, blockPath); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	// Keeps the directory from expiring while blocks are being staged
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+	return &stagedBlock{ID: blockID, Size: n, LastModified: now}, nil
+}
+
+// ListBlocks lists the blocks staged for key in bucket by ID.
+func (db *Store) ListBlocks(bucket, key string) ([]stagedBlock, error) {
+	entries, err := os.ReadDir(db.blocksDir(bucket, key))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	blocks := []stagedBlock{}
+	for _, entry := range entries {
+		id, err := hex.DecodeString(entry.Name())
+		if err != nil {
+			// In flight
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		blocks = append(blocks, stagedBlock{ID: string(id), Size: info.Size(), LastModified: info.ModTime()})
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].ID < blocks[j].ID
+	})
+	return blocks, nil
+}
+
+// CommitBlocks writes the listed blocks, in order, to the object at p with the
+// declared options and drops every block staged for it. A block may be listed
+// more than once.
+func (db *Store) CommitBlocks(bucket, key, p string, blockIDs []string, options ...FileOption) (*storedFile, bool, error) {
+	dir := db.blocksDir(bucket, key)
+	readers := make([]io.Reader, 0, len(blockIDs))
+	for _, id := range blockIDs {
+		f, err := os.Open(filepath.Join(dir, hex.EncodeToString([]byte(id))))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, false, errInvalidBlockList
+			}
+			return nil, false, err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	sf, created, err := db.upsertFile(p, io.MultiReader(readers...), options...)
+	if err != nil {
+		return nil, false, err
+	}
+	os.RemoveAll(dir)
+	return sf, created, nil
+}
+
+// DiscardExpiredBlocks drops blocks of objects nothing was staged for in ttl
+// and returns for how many objects.
+func (db *Store) DiscardExpiredBlocks(ttl time.Duration) (int, error) {
+	entries, err := os.ReadDir(filepath.Join(db.dir, blocksDirName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	discarded := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < ttl {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(db.dir, blocksDirName, entry.Name())); err != nil {
+			return discarded, err
+		}
+		discarded++
+	}
+	return discarded, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlocks(t *testing.T) {
+	t.Parallel()
+	store, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+	_, err = store.CreateBucket("blobs")
+	require.NoError(t, err)
+	p := filepath.Join(store.BucketDir("blobs"), "big.bin")
+
+	t.Run("commit", func(t *testing.T) {
+		_, err := store.StageBlock("blobs", "big.bin", "b", strings.NewReader("stale"))
+		require.NoError(t, err)
+		// Staging a block again replaces it
+		_, err = store.StageBlock("blobs", "big.bin", "b", strings.NewReader("world"))
+		require.NoError(t, err)
+		_, err = store.StageBlock("blobs", "big.bin", "a", strings.NewReader("hello "))
+		require.NoError(t, err)
+		_, err = store.StageBlock("blobs", "big.bin", "unused", strings.NewReader("!"))
+		require.NoError(t, err)
+
+		blocks, err := store.ListBlocks("blobs", "big.bin")
+		require.NoError(t, err)
+		require.Len(t, blocks, 3)
+		assert.Equal(t, "a", blocks[0].ID)
+		assert.Equal(t, int64(5), blocks[1].Size)
+
+		_, _, err = store.CommitBlocks("blobs", "big.bin", p, []string{"a", "missing"})
+		assert.ErrorIs(t, err, errInvalidBlockList)
+
+		sf, created, err := store.CommitBlocks("blobs", "big.bin", p, []string{"a", "b", "a"})
+		require.NoError(t, err)
+		assert.True(t, created)
+		assert.Equal(t, "blobs", sf.Bucket)
+		var buf bytes.Buffer
+		require.NoError(t, store.ReadFile(sf.ID, &buf))
+		assert.Equal(t, "hello worldhello ", buf.String())
+
+		// Blocks left out of the list are dropped too
+		blocks, err = store.ListBlocks("blobs", "big.bin")
+		require.NoError(t, err)
+		assert.Empty(t, blocks)
+	})
+
+	t.Run("invalid block ID", func(t *testing.T) {
+		_, err := store.StageBlock("blobs", "big.bin", "", strings.NewReader("x"))
+		assert.ErrorIs(t, err, errInvalidBlockID)
+		_, err = store.StageBlock("blobs", "big.bin", strings.Repeat("x", maxBlockIDLength+1), strings.NewReader("x"))
+		assert.ErrorIs(t, err, errInvalidBlockID)
+	})
+
+	t.Run("discard expired", func(t *testing.T) {
+		_, err := store.StageBlock("blobs", "old.bin", "a", strings.NewReader("old"))
+		require.NoError(t, err)
+		_, err = store.StageBlock("blobs", "new.bin", "a", strings.NewReader("new"))
+		require.NoError(t, err)
+		past := time.Now().Add(-2 * time.Hour)
+		require.NoError(t, os.Chtimes(store.blocksDir("blobs", "old.bin"), past, past))
+
+		discarded, err := store.DiscardExpiredBlocks(time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, 1, discarded)
+		blocks, err := store.ListBlocks("blobs", "old.bin")
+		require.NoError(t, err)
+		assert.Empty(t, blocks)
+		blocks, err = store.ListBlocks("blobs", "new.bin")
+		require.NoError(t, err)
+		assert.Len(t, blocks, 1)
+	})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	errBucketNotExist    = errors.New("Bucket does not exist")
+	errBucketExist       = errors.New("Bucket already exists")
+	errBucketNotEmpty    = errors.New("Bucket is not empty")
+	errInvalidBucketName = errors.New("Invalid bucket name")
+)
+
+// Same rules as S3, minus the IP address check.
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// Bucket names that would be shadowed by the other routes.
+var reservedBucketNames = map[string]bool{
+	"admin":      true,
+	"buckets":    true,
+	"download":   true,
+	"events":     true,
+	"objects":    true,
+	"pre-signed": true,
+	"publish":    true,
+	"storage":    true,
+	"trash":      true,
+	"upload":     true,
+}
+
+// bucket is a namespace for objects, stored as a subdirectory of the data
+// directory named after the bucket.
+type bucket struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	// Largest object accepted by the bucket, the store wide limit applies
+	// when zero.
+	MaxObjectSize int64 `json:"maxObjectSize,omitempty"`
+	// Keep what writes and deletes replace as versions of the object
+	Versioning bool `json:"versioning,omitempty"`
+	// Rules deleting objects by age
+	Lifecycle []LifecycleRule `json:"lifecycle,omitempty"`
+}
+
+func validBucketName(name string) bool {
+	return bucketNamePattern.MatchString(name) && !strings.Contains(name, "..") && !reservedBucketNames[name]
+}
+
+// BucketDir returns the directory objects of the bucket are written to.
+func (db *Store) BucketDir(name string) string {
+	return filepath.Join(db.dir, name)
+}
+
+// BucketOf returns the bucket an object at p belongs to, empty for objects
+// outside of any bucket.
+func (db *Store) BucketOf(p string) string {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+	return db.bucketOf(p)
+}
+
+func (db *Store) bucketOf(p string) string {
+	rel, err := filepath.Rel(db.dir, p)
+	if err != nil {
+		return ""
+	}
+	parts := strings.SplitN(filepath.ToSlash(rel), "/", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	if _, ok := db.buckets[parts[0]]; !ok {
+		return ""
+	}
+	return parts[0]
+}
+
+func (db *Store) CreateBucket(name string) (*bucket, error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.aoFile == nil {
+		return nil, errExiting
+	}
+	if !validBucketName(name) {
+		return nil, errInvalidBucketName
+	}
+	if _, ok := db.buckets[name]; ok {
+		return nil, errBucketExist
+	}
+	if err := os.MkdirAll(db.BucketDir(name), 0700); err != nil {
+		return nil, err
+	}
+	b := bucket{
+		Name:    name,
+		Created: time.Now(),
+	}
+	db.buckets[name] = b
+	if err := db.appendRecord(manifestRecord{Action: "ADD_BUCKET", ID: name, Bucket: &b}); err != nil {
+		delete(db.buckets, name)
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (db *Store) GetBucket(name string) (*bucket, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+	b, ok := db.buckets[name]
+	if !ok {
+		return nil, errBucketNotExist
+	}
+	return &b, nil
+}
+
+// UpdateBucket applies update to the settings of a bucket and persists them.
+func (db *Store) UpdateBucket(name string, update func(*bucket)) (*bucket, error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.aoFile == nil {
+		return nil, errExiting
+	}
+	b, ok := db.buckets[name]
+	if !ok {
+		return nil, errBucketNotExist
+	}
+	update(&b)
+	b.Name = name
+	db.buckets[name] = b
+	if err := db.appendRecord(manifestRecord{Action: "ADD_BUCKET", ID: name, Bucket: &b}); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (db *Store) ListBuckets() []bucket {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+	results := make([]bucket, 0, len(db.buckets))
+	for _, b := range db.buckets {
+		results = append(results, b)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
+
+// DeleteBucket removes an empty bucket and its directory. With force the
+// objects in it are deleted first.
+func (db *Store) DeleteBucket(name string, force bool) error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.aoFile == nil {
+		return errExiting
+	}
+	if _, ok := db.buckets[name]; !ok {
+		return errBucketNotExist
+	}
+
+	var ids []string
+	for id, sf := range db.storedFiles {
+		if sf.Bucket == name {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > 0 && !force {
+		return errBucketNotEmpty
+	}
+	// Locked objects keep the whole bucket, not just themselves
+	now := time.Now()
+	for _, id := range ids {
+		sf := db.storedFiles[id]
+		if err := sf.checkLock(now, false); err != nil {
+			return err
+		}
+	}
+	for _, versions := range db.versions {
+		for _, v := range versions {
+			if v.File.Bucket != name {
+				continue
+			}
+			if err := v.File.checkLock(now, false); err != nil {
+				return err
+			}
+		}
+	}
+	for _, id := range ids {
+		if err := db.deleteFile(id); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range db.versionIDs() {
+		if versions := db.versions[id]; versions[0].File.Bucket == name {
+			if err := db.purgeVersions(id); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := os.RemoveAll(db.BucketDir(name)); err != nil {
+		return err
+	}
+	delete(db.buckets, name)
+	return db.appendRecord(manifestRecord{Action: "DEL_BUCKET", ID: name})
+}
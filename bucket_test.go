@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuckets(t *testing.T) {
+	t.Parallel()
+	storageDir := t.TempDir()
+	store, err := NewStore(storageDir)
+	require.NoError(t, err)
+
+	t.Run("create bucket", func(t *testing.T) {
+		b, err := store.CreateBucket("create")
+		require.NoError(t, err)
+		assert.Equal(t, "create", b.Name)
+
+		info, err := os.Stat(store.BucketDir("create"))
+		require.NoError(t, err)
+		assert.True(t, info.IsDir())
+
+		_, err = store.CreateBucket("create")
+		assert.ErrorIs(t, err, errBucketExist)
+	})
+
+	t.Run("invalid names", func(t *testing.T) {
+		for _, name := range []string{"", "a", "_db", "UPPER", "../escape", "a..b", "-dash", "objects", "admin", "trash"} {
+			_, err := store.CreateBucket(name)
+			assert.ErrorIs(t, err, errInvalidBucketName, name)
+		}
+	})
+
+	t.Run("objects are scoped", func(t *testing.T) {
+		_, err := store.CreateBucket("first")
+		require.NoError(t, err)
+		_, err = store.CreateBucket("second")
+		require.NoError(t, err)
+
+		first, err := store.CreateFile(path.Join(store.BucketDir("first"), "same"), strings.NewReader("1"))
+		require.NoError(t, err)
+		second, err := store.CreateFile(path.Join(store.BucketDir("second"), "same"), strings.NewReader("2"))
+		require.NoError(t, err)
+		root, err := store.CreateFile(path.Join(storageDir, "same"), strings.NewReader("3"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "first", first.Bucket)
+		assert.Equal(t, "second", second.Bucket)
+		assert.Empty(t, root.Bucket)
+
+		copied, err := store.CopyFile(first.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "first", copied.Bucket)
+	})
+
+	t.Run("delete bucket", func(t *testing.T) {
+		_, err := store.CreateBucket("delete")
+		require.NoError(t, err)
+		sf, err := store.CreateFile(path.Join(store.BucketDir("delete"), "file"), strings.NewReader("1"))
+		require.NoError(t, err)
+
+		assert.ErrorIs(t, store.DeleteBucket("delete", false), errBucketNotEmpty)
+		require.NoError(t, store.DeleteBucket("delete", true))
+
+		_, err = store.GetFileMetadata(sf.ID)
+		assert.ErrorIs(t, err, errNotExist)
+		_, err = os.Stat(store.BucketDir("delete"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		assert.ErrorIs(t, store.DeleteBucket("delete", false), errBucketNotExist)
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		require.NoError(t, store.Close())
+		reloaded, err := NewStore(storageDir)
+		require.NoError(t, err)
+		defer reloaded.Close()
+
+		var names []string
+		for _, b := range reloaded.ListBuckets() {
+			names = append(names, b.Name)
+		}
+		assert.Equal(t, []string{"create", "first", "second"}, names)
+		result, err := reloaded.Compact()
+		require.NoError(t, err)
+		assert.Equal(t, len(reloaded.buckets)+len(reloaded.storedFiles), result.RecordsAfter)
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"sort"
+)
+
+const (
+	// Manifests smaller than this are never compacted automatically.
+	defaultCompactMinSize int64 = 1 << 20
+	// Fraction of dead records that triggers an automatic compaction.
+	defaultCompactRatio float64 = 0.5
+)
+
+// WithCompaction sets when the manifest is compacted automatically: once it is
+// at least minSize bytes and at least ratio of its records are dead. A
+// minSize below zero disables automatic compaction.
+func WithCompaction(minSize int64, ratio float64) StoreOption {
+	return func(db *Store) {
+		db.compactMinSize = minSize
+		db.compactRatio = ratio
+	}
+}
+
+type CompactionResult struct {
+	RecordsBefore int   `json:"recordsBefore"`
+	RecordsAfter  int   `json:"recordsAfter"`
+	SizeBefore    int64 `json:"sizeBefore"`
+	SizeAfter     int64 `json:"sizeAfter"`
+}
+
+// Compact rewrites the manifest so it only holds live records.
+func (db *Store) Compact() (*CompactionResult, error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	return db.compact()
+}
+
+func (db *Store) garbageRatio() float64 {
+	if db.records == 0 {
+		return 0
+	}
+	return float64(db.records-db.liveRecordCount()) / float64(db.records)
+}
+
+func (db *Store) needsCompaction() bool {
+	if db.compactMinSize < 0 || db.aoFile == nil {
+		return false
+	}
+	info, err := db.aoFile.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Size() >= db.compactMinSize && db.garbageRatio() >= db.compactRatio
+}
+
+func (db *Store) compact() (*CompactionResult, error) {
+	if db.aoFile == nil {
+		return nil, errExiting
+	}
+	info, err := db.aoFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	live := db.liveRecords()
+	result := &CompactionResult{
+		RecordsBefore: db.records,
+		RecordsAfter:  len(live),
+		SizeBefore:    info.Size(),
+	}
+
+	manifestPath := db.manifestPath()
+	tmpPath := manifestPath + ".compact"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	w.Write(manifestHeader())
+	for _, rec := range live {
+		w.Write(encodeRecord(rec))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		info, err = f.Stat()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	if err := os.Rename(tmpPath, manifestPath); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	syncDir(db.dir)
+
+	// The old handle points at the unlinked manifest, swap it for the new one.
+	db.aoFile.Close()
+	db.aoFile, err = os.OpenFile(manifestPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	db.records = len(live)
+	result.SizeAfter = info.Size()
+	return result, nil
+}
+
+func (db *Store) liveRecordCount() int {
+	count := len(db.buckets) + len(db.storedFiles) + len(db.trash)
+	for _, versions := range db.versions {
+		count += len(versions)
+	}
+	return count
+}
+
+// liveRecords returns the records needed to rebuild the current state, buckets
+// first so objects never reference a bucket that doesn't exist yet.
+func (db *Store) liveRecords() []manifestRecord {
+	records := make([]manifestRecord, 0, db.liveRecordCount())
+	names := make([]string, 0, len(db.buckets))
+	for name := range db.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b := db.buckets[name]
+		records = append(records, manifestRecord{Action: "ADD_BUCKET", ID: name, Bucket: &b})
+	}
+
+	ids := make([]string, 0, len(db.storedFiles))
+	for id := range db.storedFiles {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		sf := db.storedFiles[id]
+		records = append(records, manifestRecord{Action: "ADD", ID: id, File: &sf})
+	}
+	trashed := make([]string, 0, len(db.trash))
+	for id := range db.trash {
+		trashed = append(trashed, id)
+	}
+	sort.Strings(trashed)
+	for _, id := range trashed {
+		sf := db.trash[id]
+		records = append(records, manifestRecord{Action: "TRASH", ID: id, File: &sf})
+	}
+	for _, id := range db.versionIDs() {
+		for _, v := range db.versions[id] {
+			v := v
+			records = append(records, manifestRecord{Action: "ADD_VERSION", ID: id, Version: &v})
+		}
+	}
+	return records
+}
+
+// syncDir flushes directory entries so a rename survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompact(t *testing.T) {
+	t.Parallel()
+	storageDir := t.TempDir()
+	store, err := NewStore(storageDir, WithCompaction(-1, 0))
+	require.NoError(t, err)
+
+	kept, err := store.CreateFile(fname(t, storageDir, "kept"), strings.NewReader("1"))
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		sf, err := store.CreateFile(fname(t, storageDir, "deleted"), strings.NewReader("1"))
+		require.NoError(t, err)
+		require.NoError(t, store.DeleteFile(sf.ID))
+	}
+
+	result, err := store.Compact()
+	require.NoError(t, err)
+	assert.Equal(t, 11, result.RecordsBefore)
+	assert.Equal(t, 1, result.RecordsAfter)
+	assert.Less(t, result.SizeAfter, result.SizeBefore)
+
+	// Writes after compaction land in the new manifest
+	added, err := store.CreateFile(fname(t, storageDir, "added"), strings.NewReader("1"))
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	reloaded, err := NewStore(storageDir)
+	require.NoError(t, err)
+	defer reloaded.Close()
+	assert.Equal(t, normalizeTimes(store.storedFiles), normalizeTimes(reloaded.storedFiles))
+	assert.Contains(t, reloaded.storedFiles, kept.ID)
+	assert.Contains(t, reloaded.storedFiles, added.ID)
+}
+
+func TestAutomaticCompaction(t *testing.T) {
+	t.Parallel()
+	storageDir := t.TempDir()
+	store, err := NewStore(storageDir, WithCompaction(0, 0.5))
+	require.NoError(t, err)
+	defer store.Close()
+
+	sf, err := store.CreateFile(fname(t, storageDir), strings.NewReader("1"))
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteFile(sf.ID))
+
+	info, err := os.Stat(store.manifestPath())
+	require.NoError(t, err)
+	assert.Equal(t, int64(manifestHeaderSize), info.Size())
+	assert.Zero(t, store.records)
+}
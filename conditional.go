@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Conditional writes for optimistic concurrency, RFC 9110 section 13. Reads
+// are handled by http.ServeContent in serveObject.
+
+var errPreconditionFailed = errors.New("Precondition failed")
+
+// WithPrecondition makes a write or delete fail unless check passes on the
+// object it replaces, nil when nothing is stored yet. It runs under the write
+// lock, so nothing can change the object in between.
+func WithPrecondition(check func(existing *storedFile) error) FileOption {
+	return func(sf *storedFile) {
+		sf.preconditions = append(sf.preconditions, check)
+	}
+}
+
+// checkPreconditions runs the checks added by WithPrecondition to options
+// against existing.
+func checkPreconditions(existing *storedFile, options []FileOption) error {
+	var probe storedFile
+	for _, option := range options {
+		option(&probe)
+	}
+	for _, check := range probe.preconditions {
+		if err := check(existing); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePreconditions returns If-Match, If-None-Match and If-Unmodified-Since
+// of header as a precondition, nil when there are none.
+func writePreconditions(header http.Header) []FileOption {
+	ifMatch, ifNoneMatch := header.Get("If-Match"), header.Get("If-None-Match")
+	since, sinceErr := http.ParseTime(header.Get("If-Unmodified-Since"))
+	if ifMatch == "" && ifNoneMatch == "" && sinceErr != nil {
+		return nil
+	}
+	return []FileOption{WithPrecondition(func(existing *storedFile) error {
+		if ifMatch != "" {
+			if existing == nil || !etagListMatches(ifMatch, objectETag(existing), false) {
+				return fmt.Errorf("%w: If-Match doesn't match the current ETag", errPreconditionFailed)
+			}
+		} else if sinceErr == nil && existing != nil {
+			if existing.lastModified().Truncate(time.Second).After(since) {
+				return fmt.Errorf("%w: Object has been modified since %s", errPreconditionFailed, since.UTC().Format(http.TimeFormat))
+			}
+		}
+		if ifNoneMatch != "" && existing != nil && etagListMatches(ifNoneMatch, objectETag(existing), true) {
+			return fmt.Errorf("%w: If-None-Match matches the current ETag", errPreconditionFailed)
+		}
+		return nil
+	})}
+}
+
+// etagListMatches reports whether a comma separated list of entity tags, or
+// "*", matches etag. Unless weak is set weak tags never match, as If-Match
+// needs a strong comparison.
+func etagListMatches(list, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
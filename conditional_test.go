@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConditionalRequests(t *testing.T) {
+	t.Parallel()
+	_, url := setupS3(t)
+	id := uploadMultipart(t, url+"/objects/", "doc.txt", "version 1")
+
+	resp := doRequest(t, http.MethodGet, url+"/objects/"+id, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+	lastModified := resp.Header.Get("Last-Modified")
+	require.NotEmpty(t, lastModified)
+
+	t.Run("reads", func(t *testing.T) {
+		resp := doRequest(t, http.MethodGet, url+"/objects/"+id, nil, "If-None-Match", etag)
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+		resp = doRequest(t, http.MethodGet, url+"/objects/"+id, nil, "If-Modified-Since", lastModified)
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+		resp = doRequest(t, http.MethodGet, url+"/objects/"+id, nil, "If-None-Match", `"other"`)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("writes", func(t *testing.T) {
+		resp := doRequest(t, http.MethodPut, url+"/objects/"+id, strings.NewReader("version 2"), "If-Match", `"stale"`)
+		assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+		past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+		resp = doRequest(t, http.MethodPatch, url+"/objects/"+id, strings.NewReader("!"), "If-Unmodified-Since", past)
+		assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+		resp = doRequest(t, http.MethodPut, url+"/objects/"+id, strings.NewReader("version 2"), "If-Match", etag)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		// The ETag changed with the content
+		resp = doRequest(t, http.MethodDelete, url+"/objects/"+id, nil, "If-Match", etag)
+		assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+		resp = doRequest(t, http.MethodGet, url+"/objects/"+id, nil, "If-None-Match", etag)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.NotEqual(t, etag, resp.Header.Get("ETag"))
+	})
+
+	t.Run("presigned create only", func(t *testing.T) {
+		signed := string(toURL([]byte("testing"), &signedURL{Path: "new.txt", Expiry: time.Now().Add(time.Minute)}))
+		resp := doRequest(t, http.MethodPut, url+signed, strings.NewReader("first"), "If-None-Match", "*")
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get("ETag"))
+		resp = doRequest(t, http.MethodPut, url+signed, strings.NewReader("second"), "If-None-Match", "*")
+		assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	})
+}
+
+func TestWithPrecondition(t *testing.T) {
+	t.Parallel()
+	storageDir := t.TempDir()
+	store, err := NewStore(storageDir)
+	require.NoError(t, err)
+	defer store.Close()
+
+	sf, err := store.CreateFile(fname(t, storageDir), strings.NewReader("original"))
+	require.NoError(t, err)
+	stale := WithPrecondition(func(existing *storedFile) error {
+		if existing == nil || objectETag(existing) != `"stale"` {
+			return errPreconditionFailed
+		}
+		return nil
+	})
+
+	assert.ErrorIs(t, store.UpdateFile(sf.ID, strings.NewReader("changed"), true, stale), errPreconditionFailed)
+	_, _, err = store.UpsertFile(sf.Path, strings.NewReader("changed"), stale)
+	assert.ErrorIs(t, err, errPreconditionFailed)
+	_, _, err = store.UpsertFile(fname(t, storageDir, "new"), strings.NewReader("changed"), stale)
+	assert.ErrorIs(t, err, errPreconditionFailed)
+	_, err = store.CopyFileTo(sf.ID, fname(t, storageDir, "copy"), stale)
+	assert.ErrorIs(t, err, errPreconditionFailed)
+	assert.ErrorIs(t, store.DeleteFile(sf.ID, stale), errPreconditionFailed)
+
+	// Nothing was written
+	require.Len(t, store.storedFiles, 1)
+	var b strings.Builder
+	require.NoError(t, store.ReadFile(sf.ID, &b))
+	assert.Equal(t, "original", b.String())
+
+	// The check sees the object as it is when the write happens
+	var seen string
+	current := WithPrecondition(func(existing *storedFile) error {
+		seen = objectETag(existing)
+		return nil
+	})
+	require.NoError(t, store.UpdateFile(sf.ID, strings.NewReader("changed"), true))
+	updated, err := store.GetFileMetadata(sf.ID)
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteFile(sf.ID, current))
+	assert.Equal(t, objectETag(updated), seen)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+)
+
+const (
+	// sniffLen is how much content http.DetectContentType looks at.
+	sniffLen           = 512
+	defaultContentType = "application/octet-stream"
+)
+
+// FileOption sets metadata declared by whoever writes an object.
+type FileOption func(*storedFile)
+
+// WithContentType records the declared media type of an object. Without one
+// the type goes by the extension of its name or is sniffed from its content.
+// application/octet-stream is what most clients send when they don't know
+// better, so it doesn't count as declared.
+func WithContentType(contentType string) FileOption {
+	return func(sf *storedFile) {
+		if contentType != "" && contentType != defaultContentType {
+			sf.ContentType = contentType
+		}
+	}
+}
+
+// WithFileName records the name an object was uploaded under, served back in
+// Content-Disposition.
+func WithFileName(name string) FileOption {
+	return func(sf *storedFile) {
+		if name != "" {
+			sf.FileName = name
+		}
+	}
+}
+
+// contentType returns the media type of an object, going by the extension of
+// its path for records written before types were stored.
+func (sf *storedFile) contentType() string {
+	if sf.ContentType != "" {
+		return sf.ContentType
+	}
+	if t := mime.TypeByExtension(filepath.Ext(sf.Path)); t != "" {
+		return t
+	}
+	return defaultContentType
+}
+
+// contentDisposition returns the Content-Disposition serving an object under
+// its original name, empty when none was recorded.
+func (sf *storedFile) contentDisposition() string {
+	if sf.FileName == "" {
+		return ""
+	}
+	return mime.FormatMediaType("inline", map[string]string{"filename": sf.FileName})
+}
+
+// applyFileOptions sets the declared metadata on sf. Without a declared content
+// type it goes by the extension of the name, sniffing head as a last resort.
+func applyFileOptions(sf *storedFile, head []byte, options []FileOption) {
+	for _, option := range options {
+		option(sf)
+	}
+	// Only checked before the write, see BypassGovernance and WithPrecondition
+	sf.bypassGovernance = false
+	sf.preconditions = nil
+	if sf.ContentType != "" {
+		return
+	}
+	name := sf.FileName
+	if name == "" {
+		name = sf.Path
+	}
+	if sf.ContentType = mime.TypeByExtension(filepath.Ext(name)); sf.ContentType == "" {
+		sf.ContentType = http.DetectContentType(head)
+	}
+}
+
+// sniffer keeps the first sniffLen bytes read through it.
+type sniffer struct {
+	reader io.Reader
+	head   []byte
+}
+
+func (s *sniffer) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	if missing := sniffLen - len(s.head); missing > 0 && n > 0 {
+		if missing > n {
+			missing = n
+		}
+		s.head = append(s.head, p[:missing]...)
+	}
+	return n, err
+}
+
+// fileOptions returns options carrying the declared metadata and tags of sf
+// over to a copy.
+func (sf *storedFile) fileOptions() []FileOption {
+	return []FileOption{
+		WithContentType(sf.ContentType),
+		WithFileName(sf.FileName),
+		WithMetadata(sf.Metadata),
+		WithTags(sf.Tags),
+	}
+}
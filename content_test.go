@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentMetadata(t *testing.T) {
+	t.Parallel()
+	store, url := setupS3(t)
+
+	t.Run("declared, by extension and sniffed", func(t *testing.T) {
+		declared, err := store.CreateFile(filepath.Join(store.Dir(), "declared"), strings.NewReader("a,b"), WithContentType("text/csv"))
+		require.NoError(t, err)
+		assert.Equal(t, "text/csv", declared.ContentType)
+
+		byExtension, err := store.CreateFile(filepath.Join(store.Dir(), "page.html"), strings.NewReader("plain"), WithContentType(defaultContentType))
+		require.NoError(t, err)
+		assert.Equal(t, "text/html; charset=utf-8", byExtension.ContentType)
+
+		sniffed, err := store.CreateFile(filepath.Join(store.Dir(), "sniffed"), strings.NewReader("%PDF-1.7"))
+		require.NoError(t, err)
+		assert.Equal(t, "application/pdf", sniffed.ContentType)
+
+		// Overwrites take the new type, appends keep the old one
+		require.NoError(t, store.UpdateFile(sniffed.ID, strings.NewReader(" more"), false))
+		sf, err := store.GetFileMetadata(sniffed.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "application/pdf", sf.ContentType)
+		require.NoError(t, store.UpdateFile(sniffed.ID, strings.NewReader("<html></html>"), true))
+		sf, err = store.GetFileMetadata(sniffed.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "text/html; charset=utf-8", sf.ContentType)
+
+		copied, err := store.CopyFile(declared.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "text/csv", copied.ContentType)
+	})
+
+	t.Run("native uploads", func(t *testing.T) {
+		resp := doRequest(t, http.MethodPost, url+"/objects/", strings.NewReader("x,y"), "X-Filename", "My Data.csv", "Content-Type", "text/csv")
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var created CreateObjectResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+
+		resp = doRequest(t, http.MethodGet, url+"/objects/"+created.ID, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+		assert.Equal(t, `inline; filename="My Data.csv"`, resp.Header.Get("Content-Disposition"))
+
+		id := uploadMultipart(t, url+"/objects/", "notes.txt", "hello")
+		resp = doRequest(t, http.MethodGet, url+"/objects/", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var files []storedFile
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&files))
+		var listed *storedFile
+		for i := range files {
+			if files[i].ID == id {
+				listed = &files[i]
+			}
+		}
+		require.NotNil(t, listed)
+		assert.Equal(t, "text/plain; charset=utf-8", listed.ContentType)
+		assert.Equal(t, "notes.txt", listed.FileName)
+		assert.Equal(t, int64(5), listed.Size)
+	})
+
+	t.Run("persisted", func(t *testing.T) {
+		dir := t.TempDir()
+		first, err := NewStore(dir)
+		require.NoError(t, err)
+		sf, err := first.CreateFile(filepath.Join(dir, "data"), strings.NewReader("{}"), WithContentType("application/json"), WithFileName("data.json"))
+		require.NoError(t, err)
+		require.NoError(t, first.Close())
+
+		second, err := NewStore(dir)
+		require.NoError(t, err)
+		defer second.Close()
+		reloaded, err := second.GetFileMetadata(sf.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "application/json", reloaded.ContentType)
+		assert.Equal(t, "data.json", reloaded.FileName)
+	})
+
+	t.Run("S3", func(t *testing.T) {
+		resp := doRequest(t, http.MethodPut, url+"/typed", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = doRequest(t, http.MethodPut, url+"/typed/image", strings.NewReader("GIF89a"), "Content-Type", "image/gif")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = doRequest(t, http.MethodHead, url+"/typed/image", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "image/gif", resp.Header.Get("Content-Type"))
+	})
+}
@@ -1,22 +1,26 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"mime"
+	"log"
 	"net/http"
 	"os"
-	"os/signal"
 	"path"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
 
-const dbFileName string = "_db"
+const (
+	dbFileName string = "_db"
+	// Suffix of the files writes are staged in before being renamed into place
+	tempFileSuffix = ".tmp"
+)
 
 // Errors
 var (
@@ -26,94 +30,253 @@ var (
 	errExiting        = errors.New("Server is exiting")
 )
 
-// State
-var (
-	rwlock      = new(sync.RWMutex)
+// Store is a single object store rooted at a directory. It owns its own
+// lock, in memory index and append only manifest, so any number of stores
+// can be served side by side in one process.
+type Store struct {
+	rwlock      sync.RWMutex
+	dir         string
 	storedFiles map[string]storedFile
-	aoFile      *os.File
-)
+	buckets     map[string]bucket
+	// Noncurrent versions by object ID, oldest first
+	versions map[string][]objectVersion
+	// Deleted objects by ID, see WithTrash
+	trash map[string]storedFile
+	// Number of records referencing each blob, and the blobs that lost their
+	// last reference since the last record was appended
+	refs     map[string]int
+	released []string
+	aoFile   *os.File
+
+	// Number of records in the manifest, live or not.
+	records int
+	// Compaction thresholds, see WithCompaction.
+	compactMinSize int64
+	compactRatio   float64
+	// Largest object accepted outside of buckets with their own limit, see
+	// WithMaxObjectSize.
+	maxObjectSize int64
+	trashEnabled  bool
+}
 
-func InitializeDB(filepath string) error {
-	rwlock.Lock()
-	defer rwlock.Unlock()
-	storedFiles = make(map[string]storedFile)
-	f, err := os.OpenFile(filepath, os.O_RDONLY, 0600)
+// StoreOption configures a Store before its manifest is replayed.
+type StoreOption func(*Store)
 
+// NewStore creates dir if needed and replays the manifest found in it.
+func NewStore(dir string, options ...StoreOption) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	db := &Store{
+		dir:            dir,
+		compactMinSize: defaultCompactMinSize,
+		compactRatio:   defaultCompactRatio,
+	}
+	for _, option := range options {
+		option(db)
+	}
+	if err := db.initialize(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Dir is the directory objects are written to.
+func (db *Store) Dir() string {
+	return db.dir
+}
+
+func (db *Store) manifestPath() string {
+	return path.Join(db.dir, dbFileName)
+}
+
+func (db *Store) initialize() error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	db.storedFiles = make(map[string]storedFile)
+	db.buckets = make(map[string]bucket)
+	db.versions = make(map[string][]objectVersion)
+	db.trash = make(map[string]storedFile)
+	db.refs = make(map[string]int)
+	filepath := db.manifestPath()
+	legacy, err := loadManifest(filepath, db.apply)
+	if err != nil {
+		return err
+	}
+	db.aoFile, err = os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	migrated, err := db.migrateContent()
+	if err != nil {
+		return err
+	}
+	// Rewriting a legacy manifest migrates it to the framed format
+	if legacy || len(migrated) > 0 || db.needsCompaction() {
+		if _, err = db.compact(); err != nil {
 			return err
 		}
-		aoFile, err = os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
-		return err
 	}
-	defer f.Close()
-	scanner := bufio.NewScanner(f)
+	// The manifest no longer refers to content outside the blob store
+	for _, p := range migrated {
+		os.Remove(p)
+	}
+	if len(migrated) > 0 {
+		os.RemoveAll(path.Join(db.dir, legacyTrashDirName))
+		os.RemoveAll(path.Join(db.dir, legacyVersionsDirName))
+	}
+	// Blobs released while replaying are gone already or left by a crash
+	db.released = nil
+	_, err = db.collectGarbage()
+	return err
+}
 
-	for scanner.Scan() {
-		text := scanner.Text()
-		if text == "" {
-			continue
+// apply replays a single manifest record onto the index.
+func (db *Store) apply(rec manifestRecord) error {
+	switch rec.Action {
+	case "ADD":
+		if rec.File == nil {
+			return fmt.Errorf("%w; ADD record for '%s' has no file", errCorruptManifest, rec.ID)
 		}
-		var (
-			action string
-			id     string
-			js     []byte
-			sf     storedFile
-		)
-		_, err := fmt.Sscanf(text, "%s %s %s", &action, &id, &js)
-		if err != nil {
-			continue
+		db.putFile(rec.ID, *rec.File)
+		// Objects restored from the trash
+		db.dropTrash(rec.ID)
+	case "DEL":
+		db.dropFile(rec.ID)
+	case "ADD_BUCKET":
+		if rec.Bucket == nil {
+			return fmt.Errorf("%w; ADD_BUCKET record for '%s' has no bucket", errCorruptManifest, rec.ID)
 		}
-
-		if action == "ADD" {
-			if err := json.Unmarshal(js, &sf); err != nil {
-				return fmt.Errorf("File is corrupt '%s'; Attempting to parse '%s'", err.Error(), js)
+		db.buckets[rec.ID] = *rec.Bucket
+	case "DEL_BUCKET":
+		delete(db.buckets, rec.ID)
+	case "TRASH":
+		if rec.File == nil {
+			return fmt.Errorf("%w; TRASH record for '%s' has no file", errCorruptManifest, rec.ID)
+		}
+		db.putTrash(rec.ID, *rec.File)
+		db.dropFile(rec.ID)
+	case "DEL_TRASH":
+		db.dropTrash(rec.ID)
+	case "ADD_VERSION":
+		if rec.Version == nil {
+			return fmt.Errorf("%w; ADD_VERSION record for '%s' has no version", errCorruptManifest, rec.ID)
+		}
+		db.putVersion(rec.ID, *rec.Version)
+	case "DEL_VERSION":
+		if rec.Version == nil {
+			return fmt.Errorf("%w; DEL_VERSION record for '%s' has no version", errCorruptManifest, rec.ID)
+		}
+		for i, v := range db.versions[rec.ID] {
+			if v.VersionID == rec.Version.VersionID {
+				db.removeVersion(rec.ID, i)
+				break
 			}
-			storedFiles[id] = sf
-		} else if action == "DEL" {
-			delete(storedFiles, id)
-		} else {
-			return fmt.Errorf("Storage file is corrupt; Received action: '%s'", action)
 		}
+	default:
+		return fmt.Errorf("Storage file is corrupt; Received action: '%s'", rec.Action)
 	}
-	f.Close()
-	aoFile, err = os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
-	if err != nil {
+	db.records++
+	return nil
+}
+
+// appendRecord writes a single record to the manifest and compacts it once
+// enough of it is garbage.
+func (db *Store) appendRecord(rec manifestRecord) error {
+	if _, err := db.aoFile.Write(encodeRecord(rec)); err != nil {
 		return err
 	}
-
-	c := make(chan os.Signal, 1)
-	go func() {
-		<-c
-		rwlock.Lock()
-		defer rwlock.Unlock()
-		aoFile.Close()
-		aoFile = nil
-		os.Exit(0)
-	}()
-	signal.Notify(c, os.Interrupt, os.Kill)
+	if err := db.aoFile.Sync(); err != nil {
+		return err
+	}
+	db.removeReleased()
+	db.records++
+	if db.needsCompaction() {
+		if _, err := db.compact(); err != nil {
+			log.Printf("Failed to compact manifest: '%s'\n", err)
+		}
+	}
 	return nil
 }
 
+// Close closes the manifest, after which every write fails with errExiting.
+func (db *Store) Close() error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.aoFile == nil {
+		return nil
+	}
+	err := db.aoFile.Close()
+	db.aoFile = nil
+	return err
+}
+
 type storedFile struct {
 	ID      string    `json:"id"`
 	Path    string    `json:"path"`
+	Bucket  string    `json:"bucket,omitempty"`
 	Created time.Time `json:"created"`
+	// When the content last changed, zero for records written before it was
+	// tracked, see lastModified.
+	LastModified time.Time `json:"lastModified"`
+	Size         int64     `json:"size"`
+	// Hex encoded SHA-256 of the content, empty for records written before
+	// checksums were tracked.
+	Checksum string `json:"checksum,omitempty"`
+	// Overrides the checksum as ETag until the content changes, e.g. the
+	// "<md5>-<parts>" ETag of a multipart upload.
+	ETag string `json:"etag,omitempty"`
+	// Declared or sniffed media type, empty for records written before it
+	// was tracked, see contentType.
+	ContentType string `json:"contentType,omitempty"`
+	// Name the object was uploaded under, if it was given one.
+	FileName string `json:"fileName,omitempty"`
+	// User defined metadata, replaced by overwrites
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Tags to find objects by, kept across overwrites
+	Tags map[string]string `json:"tags,omitempty"`
+	// Changes with every write to a versioned bucket, empty elsewhere
+	VersionID string `json:"versionId,omitempty"`
+	// When the object was moved to the trash, only set for objects in it
+	Deleted *time.Time `json:"deleted,omitempty"`
+	// When the object is deleted, see WithExpires
+	Expires *time.Time `json:"expires,omitempty"`
+	// Hex encoded SHA-256 of the blob holding the content, see blobPath.
+	// Only empty for records whose content was missing when they were
+	// migrated to the blob store.
+	Blob string `json:"blob,omitempty"`
+	// Writes and deletes fail with errLocked while either applies
+	Retention *ObjectRetention `json:"retention,omitempty"`
+	LegalHold bool             `json:"legalHold,omitempty"`
+
+	// Set by BypassGovernance for the write at hand, never stored
+	bypassGovernance bool
+	// Set by WithPrecondition for the write at hand, never stored
+	preconditions []func(existing *storedFile) error
+}
+
+// lastModified returns when the content last changed, falling back to when
+// the object was created for old records.
+func (sf *storedFile) lastModified() time.Time {
+	if sf.LastModified.IsZero() {
+		return sf.Created
+	}
+	return sf.LastModified
 }
 
-func GetFileMetadata(id string) (s *storedFile, err error) {
-	rwlock.RLock()
-	defer rwlock.RUnlock()
-	return getFileMetadata(id)
+func (db *Store) GetFileMetadata(id string) (s *storedFile, err error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+	return db.getFileMetadata(id)
 }
 
-func getFileMetadata(id string) (s *storedFile, err error) {
-	if storedFiles == nil {
+func (db *Store) getFileMetadata(id string) (s *storedFile, err error) {
+	if db.storedFiles == nil {
 		err = errNotInitialized
 		return
 	}
 
-	f, ok := storedFiles[id]
+	f, ok := db.storedFiles[id]
 	if !ok {
 		err = errNotExist
 		return
@@ -121,34 +284,38 @@ func getFileMetadata(id string) (s *storedFile, err error) {
 	return &f, nil
 }
 
-func ListFiles() ([]storedFile, error) {
-	rwlock.RLock()
-	defer rwlock.RUnlock()
-	if storedFiles == nil {
+// GetFileByPath returns the object stored at p.
+func (db *Store) GetFileByPath(p string) (*storedFile, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+	return db.getFileByPath(p)
+}
+
+func (db *Store) getFileByPath(p string) (*storedFile, error) {
+	if db.storedFiles == nil {
 		return nil, errNotInitialized
 	}
-	results := make([]storedFile, len(storedFiles))
-	i := 0
-	for _, sf := range storedFiles {
-		results[i] = sf
-		i++
+	for _, sf := range db.storedFiles {
+		if sf.Path == p {
+			return &sf, nil
+		}
 	}
-	return results, nil
+	return nil, errNotExist
 }
 
-func ReadFile(id string, writer io.Writer, header ...http.Header) error {
-	rwlock.RLock()
-	defer rwlock.RUnlock()
-	metadata, err := getFileMetadata(id)
+func (db *Store) ReadFile(id string, writer io.Writer, header ...http.Header) error {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+	metadata, err := db.getFileMetadata(id)
 	if err != nil {
 		return err
 	}
 
 	if len(header) > 0 {
-		header[0].Set("Content-Type", mime.TypeByExtension(metadata.Path))
+		header[0].Set("Content-Type", metadata.contentType())
 	}
 
-	f, err := os.Open(metadata.Path)
+	f, err := db.openBlob(metadata.Blob)
 	if err != nil {
 		return err
 	}
@@ -158,125 +325,298 @@ func ReadFile(id string, writer io.Writer, header ...http.Header) error {
 	return err
 }
 
-func CreateFile(path string, reader io.Reader) (*storedFile, error) {
-	rwlock.Lock()
-	defer rwlock.Unlock()
-	return createFile(path, reader)
+// OpenFile opens the content of an object for reading along with its record.
+// Overwrites store a new blob, so the returned file keeps the content it was
+// opened with.
+func (db *Store) OpenFile(id string) (*os.File, *storedFile, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+	metadata, err := db.getFileMetadata(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := db.openBlob(metadata.Blob)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, metadata, nil
+}
+
+func (db *Store) CreateFile(path string, reader io.Reader, options ...FileOption) (*storedFile, error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	return db.createFile(path, reader, options...)
 }
 
-func createFile(path string, reader io.Reader) (*storedFile, error) {
-	if aoFile == nil {
+func (db *Store) createFile(path string, reader io.Reader, options ...FileOption) (*storedFile, error) {
+	if db.aoFile == nil {
 		return nil, errExiting
 	}
-	for _, sf := range storedFiles {
+	for _, sf := range db.storedFiles {
 		if sf.Path == path {
 			return nil, errExist
 		}
 	}
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	sniff := &sniffer{reader: reader}
+	n, hash, err := db.writeBlob(db.limitObjectSize(path, 0, sniff))
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	_, err = io.Copy(f, reader)
-	if err != nil {
-		f.Close()
-		os.Remove(path)
+	return db.createRecord(path, n, hash, sniff.head, options...)
+}
+
+// createRecord records a new object at path holding a blob that is already
+// stored, head being the start of its content for sniffing the type.
+func (db *Store) createRecord(path string, size int64, hash string, head []byte, options ...FileOption) (*storedFile, error) {
+	now := time.Now()
+	s := storedFile{
+		ID:           generateRandomUUID(),
+		Path:         path,
+		Bucket:       db.bucketOf(path),
+		Created:      now,
+		LastModified: now,
+		Size:         size,
+		Checksum:     hash,
+		Blob:         hash,
+	}
+	applyFileOptions(&s, head, options)
+	if db.versioned(s.Bucket) {
+		s.VersionID = generateRandomUUID()
+	}
+	db.putFile(s.ID, s)
+	if err := db.appendRecord(manifestRecord{Action: "ADD", ID: s.ID, File: &s}); err != nil {
+		db.dropFile(s.ID)
+		db.removeReleased()
 		return nil, err
 	}
-	id := generateRandomUUID()
-	s := storedFile{
-		ID:      id,
-		Path:    path,
-		Created: time.Now(),
-	}
-	storedFiles[id] = s
-	b, _ := json.Marshal(s)
-	fmt.Fprintf(aoFile, "\nADD %s %s", id, b)
-	aoFile.Sync()
 	return &s, nil
 }
 
-func UpdateFile(id string, reader io.Reader, overwrite bool) error {
-	rwlock.Lock()
-	defer rwlock.Unlock()
-	return updateFile(id, reader, overwrite)
+func (db *Store) UpdateFile(id string, reader io.Reader, overwrite bool, options ...FileOption) error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	_, err := db.updateFile(id, reader, overwrite, options...)
+	return err
 }
 
-func CopyFile(id string) (*storedFile, error) {
-	rwlock.Lock()
-	defer rwlock.Unlock()
-	s, err := getFileMetadata(id)
+// CopyFile copies an object next to itself under a new name. Copies share
+// the blob of the original, only the record is written.
+func (db *Store) CopyFile(id string) (*storedFile, error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.aoFile == nil {
+		return nil, errExiting
+	}
+	s, err := db.getFileMetadata(id)
 	if err != nil {
 		return nil, err
 	}
-	f, err := os.Open(s.Path)
-	if err != nil {
+	p := path.Join(filepath.Dir(s.Path), fmt.Sprintf("copy_%s_%s", generateRandomUUID(), filepath.Base(s.Path)))
+	// The limit may have been lowered since the original was written
+	if err := db.checkObjectSize(p, s.Size); err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	return db.createRecord(p, s.Size, s.Blob, nil, s.fileOptions()...)
+}
 
-	p := path.Join(filepath.Dir(s.Path), fmt.Sprintf("copy_%s_%s", generateRandomUUID(), filepath.Base(s.Path)))
-	return createFile(p, f)
+// CopyFileTo copies an object to dest, overwriting whatever is stored there.
+// Like CopyFile only the record is written. Only the preconditions of options
+// apply, the copy keeps the metadata of the original.
+func (db *Store) CopyFileTo(id, dest string, options ...FileOption) (*storedFile, error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.aoFile == nil {
+		return nil, errExiting
+	}
+	s, err := db.getFileMetadata(id)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := db.getFileByPath(dest)
+	if err != nil && !errors.Is(err, errNotExist) {
+		return nil, err
+	}
+	if err := checkPreconditions(existing, options); err != nil {
+		return nil, err
+	}
+	if s.Path == dest {
+		return s, nil
+	}
+	if err := db.checkObjectSize(dest, s.Size); err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if err := existing.checkLock(time.Now(), false); err != nil {
+			return nil, err
+		}
+		return db.replaceContent(existing, s.Size, s.Blob, nil, true, s.fileOptions()...)
+	}
+	return db.createRecord(dest, s.Size, s.Blob, nil, s.fileOptions()...)
 }
 
-func updateFile(id string, reader io.Reader, overwrite bool) error {
-	if aoFile == nil {
-		return errExiting
+// updateFile replaces or appends to the content of an object. Overwrites drop
+// the recorded content type and metadata for the ones declared in options,
+// appends keep them.
+func (db *Store) updateFile(id string, reader io.Reader, overwrite bool, options ...FileOption) (*storedFile, error) {
+	if db.aoFile == nil {
+		return nil, errExiting
 	}
 
-	s, err := getFileMetadata(id)
+	s, err := db.getFileMetadata(id)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	flags := os.O_WRONLY
-	if overwrite {
-		flags = flags | os.O_TRUNC
-	} else {
-		// Append
-		flags = flags | os.O_APPEND
+	if err := checkPreconditions(s, options); err != nil {
+		return nil, err
+	}
+	if err := s.checkLock(time.Now(), bypassing(options)); err != nil {
+		return nil, err
 	}
 
-	f, err := os.OpenFile(s.Path, flags, 0600)
+	if !overwrite {
+		// Appends store the whole content as a new blob, the old one is
+		// left untouched
+		f, err := db.openBlob(s.Blob)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		reader = io.MultiReader(f, reader)
+	}
+	sniff := &sniffer{reader: reader}
+	n, hash, err := db.writeBlob(db.limitObjectSize(s.Path, 0, sniff))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer f.Close()
-	_, err = io.Copy(f, reader)
-	return err
+	return db.replaceContent(s, n, hash, sniff.head, overwrite, options...)
 }
 
-func UpsertFile(filepath string, reader io.Reader) (result *storedFile, created bool, err error) {
-	rwlock.Lock()
-	defer rwlock.Unlock()
-	for _, sf := range storedFiles {
-		if sf.Path == filepath {
-			result = &sf
-			err = updateFile(sf.ID, reader, true)
-			return
+// replaceContent points the record of an object at a blob that is already
+// stored, keeping what it replaces as a version in versioned buckets.
+func (db *Store) replaceContent(s *storedFile, size int64, hash string, head []byte, overwrite bool, options ...FileOption) (*storedFile, error) {
+	if db.versioned(s.Bucket) {
+		if err := db.addVersion(s.ID, db.archiveVersion(s)); err != nil {
+			return nil, err
 		}
+		s.VersionID = generateRandomUUID()
+	} else {
+		s.VersionID = ""
+	}
+	s.Size, s.Checksum, s.Blob = size, hash, hash
+	if overwrite {
+		s.ContentType = ""
+		s.Metadata = nil
+	}
+	s.ETag = ""
+	applyFileOptions(s, head, options)
+	s.LastModified = time.Now()
+	db.putFile(s.ID, *s)
+	if err := db.appendRecord(manifestRecord{Action: "ADD", ID: s.ID, File: s}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (db *Store) UpsertFile(filepath string, reader io.Reader, options ...FileOption) (result *storedFile, created bool, err error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	return db.upsertFile(filepath, reader, options...)
+}
+
+func (db *Store) upsertFile(filepath string, reader io.Reader, options ...FileOption) (result *storedFile, created bool, err error) {
+	if existing, err := db.getFileByPath(filepath); err == nil {
+		result, err = db.updateFile(existing.ID, reader, true, options...)
+		return result, false, err
+	}
+	if err := checkPreconditions(nil, options); err != nil {
+		return nil, false, err
 	}
 	created = true
-	result, err = createFile(filepath, reader)
+	result, err = db.createFile(filepath, reader, options...)
 	return
 }
 
-func DeleteFile(id string) error {
+// UpdateMetadata applies update to the record of an object and persists it.
+func (db *Store) UpdateMetadata(id string, update func(*storedFile)) (*storedFile, error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	return db.updateMetadata(id, update)
+}
+
+func (db *Store) updateMetadata(id string, update func(*storedFile)) (*storedFile, error) {
+	if db.aoFile == nil {
+		return nil, errExiting
+	}
+	s, err := db.getFileMetadata(id)
+	if err != nil {
+		return nil, err
+	}
+	update(s)
+	s.ID = id
+	db.putFile(id, *s)
+	if err := db.appendRecord(manifestRecord{Action: "ADD", ID: id, File: s}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// DeleteFile removes an object, failing with errLocked while it is under a
+// legal hold or retention, see BypassGovernance, and with errPreconditionFailed
+// when a WithPrecondition check fails.
+func (db *Store) DeleteFile(id string, options ...FileOption) error {
 	// Could stripe, who cares right now?
-	rwlock.Lock()
-	defer rwlock.Unlock()
-	if aoFile == nil {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	return db.deleteFile(id, options...)
+}
+
+func (db *Store) deleteFile(id string, options ...FileOption) error {
+	if db.aoFile == nil {
 		return errExiting
 	}
-	metadata, err := getFileMetadata(id)
+	metadata, err := db.getFileMetadata(id)
 	if err != nil {
 		return err
 	}
-	err = os.Remove(metadata.Path)
-	if err == nil {
-		delete(storedFiles, id)
+	if err := checkPreconditions(metadata, options); err != nil {
+		return err
 	}
-	fmt.Fprintf(aoFile, "\nDEL %s %s", id, "{}")
-	return err
+	if err := metadata.checkLock(time.Now(), bypassing(options)); err != nil {
+		return err
+	}
+	if err := db.markDeleted(metadata); err != nil {
+		return err
+	}
+	if db.trashEnabled {
+		return db.trashFile(metadata)
+	}
+	// The blob goes once no other record refers to it
+	db.dropFile(id)
+	return db.appendRecord(manifestRecord{Action: "DEL", ID: id})
+}
+
+// tempFilePath returns a unique path for a hidden temp file next to p.
+func tempFilePath(p string) string {
+	return filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+"."+generateRandomUUID()+tempFileSuffix)
+}
+
+// isTempFile reports whether name is a temp file left behind by a write that
+// never finished.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, tempFileSuffix)
+}
+
+// hashFile returns the size and hex encoded SHA-256 of the file at path.
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"os"
 	"path"
 	"path/filepath"
@@ -13,12 +14,14 @@ import (
 )
 
 func TestFreshInitialize(t *testing.T) {
-	storageDir := t.TempDir()
-	err := InitializeDB(path.Join(storageDir, "_db"))
+	t.Parallel()
+	store, err := NewStore(t.TempDir())
 	require.NoError(t, err)
+	defer store.Close()
 }
 
 func TestInitializeExistingDB(t *testing.T) {
+	t.Parallel()
 	storageDir := t.TempDir()
 	filepath := path.Join(storageDir, "_db")
 
@@ -26,98 +29,122 @@ func TestInitializeExistingDB(t *testing.T) {
 ADD 739375fe-ac9d-41e8-9360-357c7575d866 {}
 	`), 0600))
 
-	err := InitializeDB(filepath)
+	store, err := NewStore(storageDir)
+	require.NoError(t, err)
+	defer store.Close()
+	_, err = store.GetFileMetadata("739375fe-ac9d-41e8-9360-357c7575d866")
 	require.NoError(t, err)
 }
 
+func TestIsolatedStores(t *testing.T) {
+	t.Parallel()
+	first, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+	defer first.Close()
+	second, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+	defer second.Close()
+
+	storedFile, err := first.CreateFile(fname(t, first.Dir()), strings.NewReader("1"))
+	require.NoError(t, err)
+
+	_, err = second.GetFileMetadata(storedFile.ID)
+	assert.ErrorIs(t, err, errNotExist)
+	files, err := second.ListFiles()
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
 func TestOperations(t *testing.T) {
+	t.Parallel()
 	storageDir := t.TempDir()
-	manifestPath := path.Join(storageDir, "db")
-	err := InitializeDB(manifestPath)
+	store, err := NewStore(storageDir)
 	require.NoError(t, err)
 
 	t.Run("create file", func(t *testing.T) {
-		storedFile, err := CreateFile(fname(t, storageDir), strings.NewReader(`{"foo": "bar"}`))
+		storedFile, err := store.CreateFile(fname(t, storageDir), strings.NewReader(`{"foo": "bar"}`))
 		require.NoError(t, err)
 		assert.NotNil(t, storedFile)
 	})
 
 	t.Run("create test get metadata", func(t *testing.T) {
-		storedFile, err := CreateFile(fname(t, storageDir), strings.NewReader(`{"foo": "bar"}`))
+		storedFile, err := store.CreateFile(fname(t, storageDir), strings.NewReader(`{"foo": "bar"}`))
 		require.NoError(t, err)
-		fetched, err := GetFileMetadata(storedFile.ID)
+		fetched, err := store.GetFileMetadata(storedFile.ID)
 		require.NoError(t, err)
 		assert.Equal(t, storedFile, fetched)
 	})
 
 	t.Run("read file", func(t *testing.T) {
-		storedFile, err := CreateFile(fname(t, storageDir), strings.NewReader(`1`))
+		storedFile, err := store.CreateFile(fname(t, storageDir), strings.NewReader(`1`))
 		require.NoError(t, err)
 
 		buf := bytes.NewBuffer(nil)
-		require.NoError(t, ReadFile(storedFile.ID, buf))
+		require.NoError(t, store.ReadFile(storedFile.ID, buf))
 		assert.Equal(t, "1", buf.String())
 	})
 
 	t.Run("update file append", func(t *testing.T) {
-		storedFile, err := CreateFile(fname(t, storageDir), strings.NewReader(`1`))
+		storedFile, err := store.CreateFile(fname(t, storageDir), strings.NewReader(`1`))
 		require.NoError(t, err)
-		require.NoError(t, UpdateFile(storedFile.ID, strings.NewReader("\n2"), false))
+		require.NoError(t, store.UpdateFile(storedFile.ID, strings.NewReader("\n2"), false))
 
 		buf := bytes.NewBuffer(nil)
-		require.NoError(t, ReadFile(storedFile.ID, buf))
+		require.NoError(t, store.ReadFile(storedFile.ID, buf))
 		assert.Equal(t, "1\n2", buf.String())
 	})
 
 	t.Run("update file overwrite", func(t *testing.T) {
-		storedFile, err := CreateFile(fname(t, storageDir), strings.NewReader(`1`))
+		storedFile, err := store.CreateFile(fname(t, storageDir), strings.NewReader(`1`))
 		require.NoError(t, err)
-		require.NoError(t, UpdateFile(storedFile.ID, strings.NewReader("\n2"), true))
+		require.NoError(t, store.UpdateFile(storedFile.ID, strings.NewReader("\n2"), true))
 
 		buf := bytes.NewBuffer(nil)
-		require.NoError(t, ReadFile(storedFile.ID, buf))
+		require.NoError(t, store.ReadFile(storedFile.ID, buf))
 		assert.Equal(t, "\n2", buf.String())
 	})
 
 	t.Run("copy file", func(t *testing.T) {
-		storedFile, err := CreateFile(fname(t, storageDir), strings.NewReader(`1`))
+		storedFile, err := store.CreateFile(fname(t, storageDir), strings.NewReader(`1`))
 		require.NoError(t, err)
 
-		copiedFile, err := CopyFile(storedFile.ID)
+		copiedFile, err := store.CopyFile(storedFile.ID)
 		require.NoError(t, err)
 
 		buf := bytes.NewBuffer(nil)
-		require.NoError(t, ReadFile(copiedFile.ID, buf))
+		require.NoError(t, store.ReadFile(copiedFile.ID, buf))
 		assert.Equal(t, "1", buf.String())
 	})
 
 	t.Run("upsert file new", func(t *testing.T) {
-		storedFile, created, err := UpsertFile(fname(t, storageDir), strings.NewReader(`{"foo": "bar"}`))
+		storedFile, created, err := store.UpsertFile(fname(t, storageDir), strings.NewReader(`{"foo": "bar"}`))
 		require.NoError(t, err)
 		assert.NotNil(t, storedFile)
 		assert.True(t, created)
 	})
 
 	t.Run("upsert file existing", func(t *testing.T) {
-		storedFile, err := CreateFile(fname(t, storageDir), strings.NewReader(`{"foo": "bar"}`))
+		storedFile, err := store.CreateFile(fname(t, storageDir), strings.NewReader(`{"foo": "bar"}`))
 		require.NoError(t, err)
 
-		upsertedFile, created, err := UpsertFile(storedFile.Path, strings.NewReader("1"))
+		upsertedFile, created, err := store.UpsertFile(storedFile.Path, strings.NewReader("1"))
 		require.NoError(t, err)
-		assert.Equal(t, storedFile, upsertedFile)
+		assert.Equal(t, storedFile.ID, upsertedFile.ID)
+		assert.Equal(t, storedFile.Path, upsertedFile.Path)
+		assert.Equal(t, int64(1), upsertedFile.Size)
 		assert.False(t, created)
 
 		buf := bytes.NewBuffer(nil)
-		require.NoError(t, ReadFile(storedFile.ID, buf))
+		require.NoError(t, store.ReadFile(storedFile.ID, buf))
 		assert.Equal(t, "1", buf.String())
 	})
 
 	t.Run("delete file", func(t *testing.T) {
-		storedFile, err := CreateFile(fname(t, storageDir), strings.NewReader(`{"foo": "bar"}`))
+		storedFile, err := store.CreateFile(fname(t, storageDir), strings.NewReader(`{"foo": "bar"}`))
 		require.NoError(t, err)
 
-		require.NoError(t, DeleteFile(storedFile.ID))
-		_, err = GetFileMetadata(storedFile.ID)
+		require.NoError(t, store.DeleteFile(storedFile.ID))
+		_, err = store.GetFileMetadata(storedFile.ID)
 		assert.ErrorIs(t, err, errNotExist)
 
 		_, err = os.Stat(storedFile.Path)
@@ -125,29 +152,25 @@ func TestOperations(t *testing.T) {
 	})
 
 	t.Run("list files", func(t *testing.T) {
-		files, err := ListFiles()
+		files, err := store.ListFiles()
 		require.NoError(t, err)
 
 		m := make(map[string]storedFile, len(files))
 		for _, file := range files {
 			m[file.ID] = file
 		}
-		assert.Equal(t, storedFiles, m)
+		assert.Equal(t, store.storedFiles, m)
 	})
 
 	t.Run("test reload", func(t *testing.T) {
-		aoFile.Close()
-		aoFile = nil
+		require.NoError(t, store.Close())
 
-		currentMap := storedFiles
-		for key, sf := range currentMap {
-			sf.Created = sf.Created.Round(0)
-			currentMap[key] = sf
-		}
-		require.NoError(t, InitializeDB(manifestPath))
+		reloaded, err := NewStore(storageDir)
+		require.NoError(t, err)
+		defer reloaded.Close()
 
 		// Ensure append only file generates the same map of objects
-		assert.Equal(t, currentMap, storedFiles)
+		assert.Equal(t, normalizeTimes(store.storedFiles), normalizeTimes(reloaded.storedFiles))
 	})
 }
 
@@ -158,3 +181,59 @@ func fname(t *testing.T, storageDir string, extras ...string) string {
 	}
 	return path.Join(storageDir, n)
 }
+
+// normalizeTimes strips monotonic readings and locations so records read back
+// from the manifest compare equal to the ones created in memory.
+func normalizeTimes(files map[string]storedFile) map[string]storedFile {
+	result := make(map[string]storedFile, len(files))
+	for key, sf := range files {
+		sf.Created = sf.Created.Round(0).UTC()
+		sf.LastModified = sf.LastModified.Round(0).UTC()
+		result[key] = sf
+	}
+	return result
+}
+
+// failingReader returns data and then fails, like a client disconnecting
+// mid-upload.
+type failingReader struct {
+	data string
+	read bool
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.read {
+		return 0, errors.New("connection reset")
+	}
+	r.read = true
+	return copy(p, r.data), nil
+}
+
+func TestAtomicWrites(t *testing.T) {
+	t.Parallel()
+	store, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+	p := filepath.Join(store.Dir(), "atomic.txt")
+
+	_, err = store.CreateFile(p, &failingReader{data: "partial"})
+	require.Error(t, err)
+	_, err = os.Stat(p)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	sf, err := store.CreateFile(p, strings.NewReader("original"))
+	require.NoError(t, err)
+	for _, overwrite := range []bool{true, false} {
+		require.Error(t, store.UpdateFile(sf.ID, &failingReader{data: "partial"}, overwrite))
+		var buf bytes.Buffer
+		require.NoError(t, store.ReadFile(sf.ID, &buf))
+		assert.Equal(t, "original", buf.String())
+	}
+
+	// No temp files are left behind
+	entries, err := os.ReadDir(filepath.Join(store.Dir(), blobsDirName))
+	require.NoError(t, err)
+	for _, entry := range entries {
+		assert.False(t, isTempFile(entry.Name()), entry.Name())
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Time to live of an object from the write it comes with, e.g. "1h"
+const expiresAfterHeader = "X-Expires-After"
+
+// How often expired objects are swept unless -expiry-interval says otherwise
+const defaultExpiryInterval = time.Minute
+
+// WithExpires has an object deleted once t has passed. Objects keep their
+// expiry across writes unless a new one is given.
+func WithExpires(t time.Time) FileOption {
+	return func(sf *storedFile) {
+		if !t.IsZero() {
+			sf.Expires = &t
+		}
+	}
+}
+
+// expiresOption returns the expiry asked for with X-Expires-After, doing
+// nothing without the header.
+func expiresOption(header http.Header) (FileOption, error) {
+	v := header.Get(expiresAfterHeader)
+	if v == "" {
+		return WithExpires(time.Time{}), nil
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl <= 0 {
+		return nil, fmt.Errorf("%s must be a positive duration like 1h", expiresAfterHeader)
+	}
+	return WithExpires(time.Now().Add(ttl)), nil
+}
+
+// duration is a time.Duration written as a string like "24h" in JSON.
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// LifecycleRule deletes the objects of a bucket with keys starting with
+// Prefix once they haven't been written to for ExpireAfter.
+type LifecycleRule struct {
+	Prefix      string   `json:"prefix"`
+	ExpireAfter duration `json:"expireAfter"`
+}
+
+// expired reports whether sf is due for deletion at now, by its own expiry
+// or a lifecycle rule of its bucket.
+func (db *Store) expired(sf *storedFile, now time.Time) bool {
+	if sf.Expires != nil && !sf.Expires.After(now) {
+		return true
+	}
+	b, ok := db.buckets[sf.Bucket]
+	if !ok || len(b.Lifecycle) == 0 {
+		return false
+	}
+	rel, err := filepath.Rel(db.BucketDir(sf.Bucket), sf.Path)
+	if err != nil {
+		return false
+	}
+	key := filepath.ToSlash(rel)
+	for _, rule := range b.Lifecycle {
+		if strings.HasPrefix(key, rule.Prefix) && now.Sub(sf.lastModified()) >= time.Duration(rule.ExpireAfter) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpireObjects deletes every object due for deletion at now, through the
+// same path as any other delete, and returns them.
+func (db *Store) ExpireObjects(now time.Time) ([]storedFile, error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.aoFile == nil {
+		return nil, errExiting
+	}
+	var due []storedFile
+	for _, sf := range db.storedFiles {
+		// Locked objects are kept until they can be deleted
+		if db.expired(&sf, now) && sf.checkLock(now, false) == nil {
+			due = append(due, sf)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].ID < due[j].ID
+	})
+	for i, sf := range due {
+		if err := db.deleteFile(sf.ID); err != nil {
+			return due[:i], err
+		}
+	}
+	return due, nil
+}
+
+// SweepExpired deletes expired objects every interval, publishing an event
+// for each like any other delete. It never returns unless interval is zero
+// or less.
+func (a *api) SweepExpired(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		a.sweepExpired(time.Now())
+	}
+}
+
+func (a *api) sweepExpired(now time.Time) {
+	expired, err := a.store.ExpireObjects(now)
+	if err != nil {
+		log.Printf("Error while deleting expired objects due to '%s'\n", err)
+	}
+	for _, sf := range expired {
+		a.publishDeleted(sf.ID)
+	}
+	if len(expired) > 0 {
+		log.Printf("Deleted %d expired objects\n", len(expired))
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiry(t *testing.T) {
+	t.Parallel()
+	store, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+	now := time.Now()
+
+	short, err := store.CreateFile(filepath.Join(store.Dir(), "short"), strings.NewReader("1"), WithExpires(now.Add(time.Minute)))
+	require.NoError(t, err)
+	long, err := store.CreateFile(filepath.Join(store.Dir(), "long"), strings.NewReader("1"), WithExpires(now.Add(time.Hour)))
+	require.NoError(t, err)
+	// Writes keep the expiry
+	require.NoError(t, store.UpdateFile(short.ID, strings.NewReader("2"), true))
+
+	_, err = store.CreateBucket("builds")
+	require.NoError(t, err)
+	_, err = store.UpdateBucket("builds", func(b *bucket) {
+		b.Lifecycle = []LifecycleRule{{Prefix: "tmp/", ExpireAfter: duration(30 * time.Minute)}}
+	})
+	require.NoError(t, err)
+	tmp, err := store.CreateFile(filepath.Join(store.BucketDir("builds"), "tmp", "a"), strings.NewReader("1"))
+	require.NoError(t, err)
+	kept, err := store.CreateFile(filepath.Join(store.BucketDir("builds"), "release", "a"), strings.NewReader("1"))
+	require.NoError(t, err)
+
+	expired, err := store.ExpireObjects(now)
+	require.NoError(t, err)
+	assert.Empty(t, expired)
+
+	expired, err = store.ExpireObjects(now.Add(31 * time.Minute))
+	require.NoError(t, err)
+	var ids []string
+	for _, sf := range expired {
+		ids = append(ids, sf.ID)
+	}
+	assert.ElementsMatch(t, []string{short.ID, tmp.ID}, ids)
+	_, err = store.GetFileMetadata(short.ID)
+	assert.ErrorIs(t, err, errNotExist)
+
+	expired, err = store.ExpireObjects(now.Add(2 * time.Hour))
+	require.NoError(t, err)
+	require.Len(t, expired, 1)
+	assert.Equal(t, long.ID, expired[0].ID)
+	_, err = store.GetFileMetadata(kept.ID)
+	assert.NoError(t, err)
+}
+
+func TestExpiryAPI(t *testing.T) {
+	t.Parallel()
+	store, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	api := NewAPI(store, []byte("testing"))
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	url := server.URL
+
+	resp := doRequest(t, http.MethodPost, url+"/objects/", strings.NewReader("x"), "X-Filename", "scratch", "X-Expires-After", "1h")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var created CreateObjectResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	sf, err := store.GetFileMetadata(created.ID)
+	require.NoError(t, err)
+	require.NotNil(t, sf.Expires)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *sf.Expires, time.Minute)
+
+	resp = doRequest(t, http.MethodPost, url+"/objects/", strings.NewReader("x"), "X-Filename", "bad", "X-Expires-After", "soon")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPut, url+"/buckets/rules", strings.NewReader(`{"lifecycle": [{"prefix": "logs/", "expireAfter": "24h"}]}`))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var b bucket
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&b))
+	require.Len(t, b.Lifecycle, 1)
+	assert.Equal(t, duration(24*time.Hour), b.Lifecycle[0].ExpireAfter)
+	resp = doRequest(t, http.MethodPatch, url+"/buckets/rules", strings.NewReader(`{"lifecycle": [{"prefix": "", "expireAfter": "0s"}]}`))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPut, url+"/rules/scratch.txt", strings.NewReader("x"), "X-Expires-After", "1h")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	s3Object, err := store.GetFileByPath(filepath.Join(store.BucketDir("rules"), "scratch.txt"))
+	require.NoError(t, err)
+	require.NotNil(t, s3Object.Expires)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *s3Object.Expires, time.Minute)
+	resp = doRequest(t, http.MethodPut, url+"/rules/bad.txt", strings.NewReader("x"), "X-Expires-After", "soon")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	api.sweepExpired(time.Now().Add(2 * time.Hour))
+	_, err = store.GetFileMetadata(created.ID)
+	assert.ErrorIs(t, err, errNotExist)
+	_, err = store.GetFileMetadata(s3Object.ID)
+	assert.ErrorIs(t, err, errNotExist)
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type FsckOptions struct {
+	// Adopt registers orphaned files and rewrites records whose size or
+	// checksum no longer match what is on disk.
+	Adopt bool
+	// Delete removes orphaned files and drops dangling records. Adopt wins
+	// for orphaned files when both are set.
+	Delete bool
+}
+
+type FsckMismatch struct {
+	File     storedFile `json:"file"`
+	Size     int64      `json:"size"`
+	Checksum string     `json:"checksum"`
+}
+
+// FsckArchived is an object in the trash or a noncurrent version whose blob
+// is missing or no longer matches its record.
+type FsckArchived struct {
+	File storedFile `json:"file"`
+	// Version of the object, empty for objects in the trash
+	VersionID string `json:"versionId,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Checksum  string `json:"checksum,omitempty"`
+}
+
+// FsckReport lists everything the manifest and the data directory disagree
+// on. Problems stay listed after a repair, Repaired tells whether they were
+// acted on.
+type FsckReport struct {
+	// Files in the data directory without a record
+	Orphaned []string `json:"orphaned"`
+	// Records whose blob no longer exists
+	Dangling []storedFile `json:"dangling"`
+	// Records whose size or checksum differ from their blob
+	Mismatched []FsckMismatch `json:"mismatched"`
+	// The same for objects in the trash and noncurrent versions
+	DanglingArchived   []FsckArchived `json:"danglingArchived"`
+	MismatchedArchived []FsckArchived `json:"mismatchedArchived"`
+	Repaired           bool           `json:"repaired"`
+}
+
+func (r *FsckReport) Clean() bool {
+	return len(r.Orphaned) == 0 && len(r.Dangling) == 0 && len(r.Mismatched) == 0 &&
+		len(r.DanglingArchived) == 0 && len(r.MismatchedArchived) == 0
+}
+
+// blobState is what fsck found of a blob, hashed once however many records
+// share it.
+type blobState struct {
+	missing  bool
+	size     int64
+	checksum string
+}
+
+// checkBlob compares the blob of sf with its record, the state is nil when
+// they match or the record can't be verified.
+func (db *Store) checkBlob(sf *storedFile, checked map[string]*blobState) (*blobState, error) {
+	if sf.Blob == "" {
+		return &blobState{missing: true}, nil
+	}
+	state, ok := checked[sf.Blob]
+	if !ok {
+		size, checksum, err := hashFile(db.blobPath(sf.Blob))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		state = &blobState{missing: err != nil, size: size, checksum: checksum}
+		checked[sf.Blob] = state
+	}
+	// Records from before checksums were tracked can't be verified
+	if state.missing || sf.Checksum != "" && (state.size != sf.Size || state.checksum != sf.Checksum) {
+		return state, nil
+	}
+	return nil, nil
+}
+
+// Fsck reconciles the manifest against the data directory, repairing
+// according to options.
+func (db *Store) Fsck(options FsckOptions) (*FsckReport, error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.aoFile == nil {
+		return nil, errExiting
+	}
+
+	report := &FsckReport{
+		Orphaned:   []string{},
+		Dangling:   []storedFile{},
+		Mismatched: []FsckMismatch{},
+
+		DanglingArchived:   []FsckArchived{},
+		MismatchedArchived: []FsckArchived{},
+		Repaired:           options.Adopt || options.Delete,
+	}
+	checked := map[string]*blobState{}
+	for _, sf := range db.storedFiles {
+		state, err := db.checkBlob(&sf, checked)
+		if err != nil {
+			return nil, err
+		}
+		if state == nil {
+			continue
+		}
+		if state.missing {
+			report.Dangling = append(report.Dangling, sf)
+			continue
+		}
+		report.Mismatched = append(report.Mismatched, FsckMismatch{
+			File:     sf,
+			Size:     state.size,
+			Checksum: state.checksum,
+		})
+	}
+	archived := func(sf storedFile, versionID string) error {
+		state, err := db.checkBlob(&sf, checked)
+		if err != nil || state == nil {
+			return err
+		}
+		if state.missing {
+			report.DanglingArchived = append(report.DanglingArchived, FsckArchived{File: sf, VersionID: versionID})
+			return nil
+		}
+		report.MismatchedArchived = append(report.MismatchedArchived, FsckArchived{
+			File:      sf,
+			VersionID: versionID,
+			Size:      state.size,
+			Checksum:  state.checksum,
+		})
+		return nil
+	}
+	for _, sf := range db.trash {
+		if err := archived(sf, ""); err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range db.versionIDs() {
+		for _, v := range db.versions[id] {
+			if v.DeleteMarker {
+				continue
+			}
+			if err := archived(v.File, v.VersionID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	orphaned, err := db.untrackedFiles()
+	if err != nil {
+		return nil, err
+	}
+	report.Orphaned = append(report.Orphaned, orphaned...)
+
+	sort.Strings(report.Orphaned)
+	sort.Slice(report.Dangling, func(i, j int) bool {
+		return report.Dangling[i].ID < report.Dangling[j].ID
+	})
+	sort.Slice(report.Mismatched, func(i, j int) bool {
+		return report.Mismatched[i].File.ID < report.Mismatched[j].File.ID
+	})
+	sortArchived(report.DanglingArchived)
+	sortArchived(report.MismatchedArchived)
+
+	if options.Adopt {
+		for _, p := range report.Orphaned {
+			if _, err := db.adoptFile(p, generateRandomUUID()); err != nil {
+				return nil, err
+			}
+		}
+		for _, m := range report.Mismatched {
+			// The content is stored again under the hash it has now
+			sf := m.File
+			size, hash, err := db.storeFile(db.blobPath(sf.Blob))
+			if err != nil {
+				return nil, err
+			}
+			sf.Size, sf.Checksum, sf.Blob = size, hash, hash
+			sf.ETag = ""
+			sf.LastModified = time.Now()
+			db.putFile(sf.ID, sf)
+			if err := db.appendRecord(manifestRecord{Action: "ADD", ID: sf.ID, File: &sf}); err != nil {
+				return nil, err
+			}
+		}
+		if err := db.adoptArchived(report.MismatchedArchived); err != nil {
+			return nil, err
+		}
+	} else if options.Delete {
+		for _, p := range report.Orphaned {
+			if err := os.Remove(p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if options.Delete {
+		for _, sf := range report.Dangling {
+			db.dropFile(sf.ID)
+			if err := db.appendRecord(manifestRecord{Action: "DEL", ID: sf.ID}); err != nil {
+				return nil, err
+			}
+		}
+		for _, a := range report.DanglingArchived {
+			var err error
+			if a.VersionID == "" {
+				err = db.deleteTrash(a.File.ID)
+			} else {
+				err = db.deleteVersion(a.File.ID, a.VersionID)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// location tells where an archived record is kept in fsck's output.
+func (a FsckArchived) location() string {
+	if a.VersionID == "" {
+		return "trash"
+	}
+	return "version " + a.VersionID
+}
+
+func sortArchived(archived []FsckArchived) {
+	sort.Slice(archived, func(i, j int) bool {
+		if archived[i].File.ID == archived[j].File.ID {
+			return archived[i].VersionID < archived[j].VersionID
+		}
+		return archived[i].File.ID < archived[j].File.ID
+	})
+}
+
+// adoptArchived stores the content of mismatched objects in the trash and
+// versions again under the hash it has now. Versions have no record that
+// replaces them in place, so the manifest is compacted to persist them.
+func (db *Store) adoptArchived(mismatched []FsckArchived) error {
+	versionsChanged := false
+	for _, a := range mismatched {
+		sf := a.File
+		size, hash, err := db.storeFile(db.blobPath(sf.Blob))
+		if err != nil {
+			return err
+		}
+		sf.Size, sf.Checksum, sf.Blob = size, hash, hash
+		sf.ETag = ""
+		if a.VersionID == "" {
+			db.putTrash(sf.ID, sf)
+			if err := db.appendRecord(manifestRecord{Action: "TRASH", ID: sf.ID, File: &sf}); err != nil {
+				return err
+			}
+			continue
+		}
+		for i, v := range db.versions[sf.ID] {
+			if v.VersionID == a.VersionID {
+				db.reference(hash)
+				db.dereference(v.File.Blob)
+				db.versions[sf.ID][i].File = sf
+				versionsChanged = true
+			}
+		}
+	}
+	if versionsChanged {
+		if _, err := db.compact(); err != nil {
+			return err
+		}
+		db.removeReleased()
+	}
+	return nil
+}
+
+// untrackedFiles lists the files in the data directory without a record.
+// Content lives in the blob store, so that is every file outside of it and
+// the other areas the store keeps, but for the adopted files left in place.
+func (db *Store) untrackedFiles() ([]string, error) {
+	// Objects, whether live, trashed or noncurrent, adopted from a file
+	recorded := make(map[string]bool, len(db.storedFiles))
+	for _, sf := range db.storedFiles {
+		recorded[sf.Path] = true
+	}
+	for _, sf := range db.trash {
+		recorded[sf.Path] = true
+	}
+	for _, versions := range db.versions {
+		for _, v := range versions {
+			recorded[v.File.Path] = true
+		}
+	}
+
+	var untracked []string
+	err := filepath.WalkDir(db.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			// The blob store and staging areas like .uploads aren't objects
+			if p != db.dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isManifestFile(db.dir, p) || isTempFile(d.Name()) || recorded[p] {
+			return nil
+		}
+		untracked = append(untracked, p)
+		return nil
+	})
+	return untracked, err
+}
+
+// adoptFile registers a file that already exists on disk under id, copying
+// its content into the blob store. The file is left as it is, it may well be
+// a fixture on a bind mount.
+func (db *Store) adoptFile(p, id string) (*storedFile, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	size, hash, err := db.storeFile(p)
+	if err != nil {
+		return nil, err
+	}
+	s := storedFile{
+		ID:           id,
+		Path:         p,
+		Bucket:       db.bucketOf(p),
+		Created:      info.ModTime(),
+		LastModified: info.ModTime(),
+		Size:         size,
+		Checksum:     hash,
+		Blob:         hash,
+	}
+	db.putFile(id, s)
+	if err := db.appendRecord(manifestRecord{Action: "ADD", ID: id, File: &s}); err != nil {
+		db.dropFile(id)
+		return nil, err
+	}
+	return &s, nil
+}
+
+func isManifestFile(dir, p string) bool {
+	manifest := filepath.Join(dir, dbFileName)
+	p = filepath.Clean(p)
+	return p == manifest || p == manifest+".compact"
+}
+
+// runFsck implements the fsck subcommand and returns the exit code.
+func runFsck(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	filePath := flags.String("path", getEnvWithDefault("FILE_PATH", "/var/data"), "Path where files are written")
+	adopt := flags.Bool("adopt", false, "Register orphaned files and fix records with stale sizes or checksums")
+	del := flags.Bool("delete", false, "Delete orphaned files and drop records whose file is missing")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	store, err := NewStore(*filePath, WithCompaction(-1, 0))
+	if err != nil {
+		fmt.Fprintf(out, "Error while initializing db due to '%s'\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	report, err := store.Fsck(FsckOptions{Adopt: *adopt, Delete: *del})
+	if err != nil {
+		fmt.Fprintf(out, "Error while checking db due to '%s'\n", err)
+		return 1
+	}
+	for _, p := range report.Orphaned {
+		fmt.Fprintf(out, "orphaned  %s\n", p)
+	}
+	for _, sf := range report.Dangling {
+		fmt.Fprintf(out, "dangling  %s %s\n", sf.ID, sf.Path)
+	}
+	for _, m := range report.Mismatched {
+		fmt.Fprintf(out, "mismatch  %s %s size %d/%d checksum %s/%s\n", m.File.ID, m.File.Path, m.File.Size, m.Size, m.File.Checksum, m.Checksum)
+	}
+	for _, a := range report.DanglingArchived {
+		fmt.Fprintf(out, "dangling  %s %s %s\n", a.File.ID, a.location(), a.File.Path)
+	}
+	for _, a := range report.MismatchedArchived {
+		fmt.Fprintf(out, "mismatch  %s %s %s size %d/%d checksum %s/%s\n", a.File.ID, a.location(), a.File.Path, a.File.Size, a.Size, a.File.Checksum, a.Checksum)
+	}
+	if report.Clean() {
+		fmt.Fprintln(out, "ok")
+		return 0
+	}
+	unresolved := (len(report.Orphaned) > 0 && !*adopt && !*del) ||
+		(len(report.Dangling)+len(report.DanglingArchived) > 0 && !*del) ||
+		(len(report.Mismatched)+len(report.MismatchedArchived) > 0 && !*adopt)
+	if unresolved {
+		return 1
+	}
+	fmt.Fprintln(out, "repaired")
+	return 0
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupFsck returns a store with one orphaned file, one dangling record and
+// one record whose content changed behind its back.
+func setupFsck(t *testing.T) (store *Store, orphan string, dangling, mismatched *storedFile) {
+	storageDir := t.TempDir()
+	store, err := NewStore(storageDir)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	orphan = path.Join(storageDir, "orphan")
+	require.NoError(t, os.WriteFile(orphan, []byte("orphan"), 0600))
+
+	dangling, err = store.CreateFile(path.Join(storageDir, "dangling"), strings.NewReader("0"))
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(store.blobPath(dangling.Blob)))
+
+	mismatched, err = store.CreateFile(path.Join(storageDir, "mismatched"), strings.NewReader("1"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(store.blobPath(mismatched.Blob), []byte("12"), 0600))
+	return
+}
+
+func TestFsck(t *testing.T) {
+	t.Parallel()
+
+	t.Run("report", func(t *testing.T) {
+		store, orphan, dangling, mismatched := setupFsck(t)
+		report, err := store.Fsck(FsckOptions{})
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{orphan}, report.Orphaned)
+		require.Len(t, report.Dangling, 1)
+		assert.Equal(t, dangling.ID, report.Dangling[0].ID)
+		require.Len(t, report.Mismatched, 1)
+		assert.Equal(t, mismatched.ID, report.Mismatched[0].File.ID)
+		assert.Equal(t, int64(2), report.Mismatched[0].Size)
+		assert.False(t, report.Repaired)
+
+		// Reporting changes nothing
+		files, err := store.ListFiles()
+		require.NoError(t, err)
+		assert.Len(t, files, 2)
+	})
+
+	t.Run("adopt", func(t *testing.T) {
+		store, orphan, _, mismatched := setupFsck(t)
+		_, err := store.Fsck(FsckOptions{Adopt: true})
+		require.NoError(t, err)
+
+		report, err := store.Fsck(FsckOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, report.Orphaned)
+		assert.Empty(t, report.Mismatched)
+		assert.Len(t, report.Dangling, 1)
+
+		fetched, err := store.GetFileMetadata(mismatched.ID)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), fetched.Size)
+
+		files, err := store.ListFiles()
+		require.NoError(t, err)
+		var paths []string
+		for _, sf := range files {
+			paths = append(paths, sf.Path)
+		}
+		assert.Contains(t, paths, orphan)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		store, orphan, dangling, _ := setupFsck(t)
+		_, err := store.Fsck(FsckOptions{Delete: true})
+		require.NoError(t, err)
+
+		_, err = os.Stat(orphan)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		_, err = store.GetFileMetadata(dangling.ID)
+		assert.ErrorIs(t, err, errNotExist)
+
+		report, err := store.Fsck(FsckOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, report.Orphaned)
+		assert.Empty(t, report.Dangling)
+		assert.Len(t, report.Mismatched, 1)
+	})
+}
+
+func TestFsckArchived(t *testing.T) {
+	t.Parallel()
+	storageDir := t.TempDir()
+	store, err := NewStore(storageDir, WithTrash(true))
+	require.NoError(t, err)
+	defer func() { store.Close() }()
+	_, err = store.CreateBucket("history")
+	require.NoError(t, err)
+	_, err = store.UpdateBucket("history", func(b *bucket) { b.Versioning = true })
+	require.NoError(t, err)
+
+	trashed, err := store.CreateFile(path.Join(storageDir, "trashed"), strings.NewReader("trashed"))
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteFile(trashed.ID))
+	require.NoError(t, os.Remove(store.blobPath(trashed.Blob)))
+
+	versioned, err := store.CreateFile(path.Join(store.BucketDir("history"), "versioned"), strings.NewReader("first"))
+	require.NoError(t, err)
+	require.NoError(t, store.UpdateFile(versioned.ID, strings.NewReader("second"), true))
+	require.NoError(t, os.WriteFile(store.blobPath(versioned.Blob), []byte("changed"), 0600))
+
+	report, err := store.Fsck(FsckOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, report.Dangling)
+	assert.Empty(t, report.Mismatched)
+	require.Len(t, report.DanglingArchived, 1)
+	assert.Equal(t, trashed.ID, report.DanglingArchived[0].File.ID)
+	assert.Empty(t, report.DanglingArchived[0].VersionID)
+	require.Len(t, report.MismatchedArchived, 1)
+	assert.Equal(t, versioned.VersionID, report.MismatchedArchived[0].VersionID)
+	assert.Equal(t, int64(7), report.MismatchedArchived[0].Size)
+	assert.False(t, report.Clean())
+
+	_, err = store.Fsck(FsckOptions{Adopt: true, Delete: true})
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+	store, err = NewStore(storageDir, WithTrash(true))
+	require.NoError(t, err)
+	report, err = store.Fsck(FsckOptions{})
+	require.NoError(t, err)
+	assert.True(t, report.Clean())
+	f, sf, err := store.OpenVersion(versioned.ID, versioned.VersionID)
+	require.NoError(t, err)
+	f.Close()
+	assert.Equal(t, int64(7), sf.Size)
+}
+
+func TestRunFsck(t *testing.T) {
+	t.Parallel()
+	store, orphan, _, _ := setupFsck(t)
+	require.NoError(t, store.Close())
+
+	var out bytes.Buffer
+	assert.Equal(t, 1, runFsck([]string{"-path", store.Dir()}, &out))
+	assert.Contains(t, out.String(), "orphaned  "+orphan)
+
+	out.Reset()
+	assert.Equal(t, 0, runFsck([]string{"-path", store.Dir(), "-adopt", "-delete"}, &out))
+	assert.Contains(t, out.String(), "repaired")
+
+	out.Reset()
+	assert.Equal(t, 0, runFsck([]string{"-path", store.Dir()}, &out))
+	assert.Equal(t, "ok\n", out.String())
+}
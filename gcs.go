@@ -0,0 +1,786 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Google Cloud Storage JSON API, enough of it for storage.NewClient with
+// option.WithEndpoint. Buckets and objects are the same ones served by the
+// S3 API, resumable uploads are staged like S3 multipart uploads. See
+// https://cloud.google.com/storage/docs/json_api/v1
+const (
+	gcsPrefix         = "/storage/v1/"
+	gcsUploadPrefix   = "/upload/storage/v1/"
+	gcsDownloadPrefix = "/download/storage/v1/"
+	gcsMaxResults     = 1000
+	// GCS answers a cancelled resumable upload with 499 Client Closed Request
+	gcsStatusCancelled = 499
+)
+
+type gcsErrorItem struct {
+	Domain  string `json:"domain"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+type gcsErrorBody struct {
+	Code    int            `json:"code"`
+	Message string         `json:"message"`
+	Errors  []gcsErrorItem `json:"errors"`
+}
+
+type gcsErrorResponse struct {
+	Error gcsErrorBody `json:"error"`
+}
+
+type gcsBucket struct {
+	Kind           string `json:"kind"`
+	ID             string `json:"id"`
+	SelfLink       string `json:"selfLink"`
+	Name           string `json:"name"`
+	Location       string `json:"location"`
+	StorageClass   string `json:"storageClass"`
+	Metageneration string `json:"metageneration"`
+	TimeCreated    string `json:"timeCreated"`
+	Updated        string `json:"updated"`
+}
+
+type gcsBuckets struct {
+	Kind  string      `json:"kind"`
+	Items []gcsBucket `json:"items"`
+}
+
+type gcsObject struct {
+	Kind           string `json:"kind"`
+	ID             string `json:"id"`
+	SelfLink       string `json:"selfLink"`
+	MediaLink      string `json:"mediaLink"`
+	Name           string `json:"name"`
+	Bucket         string `json:"bucket"`
+	Generation     string `json:"generation"`
+	Metageneration string `json:"metageneration"`
+	ContentType    string `json:"contentType"`
+	StorageClass   string `json:"storageClass"`
+	Size           string `json:"size"`
+	Etag           string `json:"etag"`
+	TimeCreated    string `json:"timeCreated"`
+	Updated        string `json:"updated"`
+}
+
+type gcsObjects struct {
+	Kind          string      `json:"kind"`
+	Items         []gcsObject `json:"items"`
+	Prefixes      []string    `json:"prefixes"`
+	NextPageToken string      `json:"nextPageToken,omitempty"`
+}
+
+type gcsRewriteResponse struct {
+	Kind                string    `json:"kind"`
+	TotalBytesRewritten string    `json:"totalBytesRewritten"`
+	ObjectSize          string    `json:"objectSize"`
+	Done                bool      `json:"done"`
+	Resource            gcsObject `json:"resource"`
+}
+
+// gcsSegments splits the path after prefix into its unescaped segments.
+// Object names come with their slashes escaped, so they stay one segment.
+func gcsSegments(r *http.Request, prefix string) ([]string, bool) {
+	escaped := strings.TrimPrefix(r.URL.EscapedPath(), prefix)
+	segments := strings.Split(strings.TrimSuffix(escaped, "/"), "/")
+	for i, segment := range segments {
+		s, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, false
+		}
+		segments[i] = s
+	}
+	return segments, len(segments) > 0 && segments[0] == "b"
+}
+
+func (a *api) GCS(w http.ResponseWriter, r *http.Request) {
+	segments, ok := gcsSegments(r, gcsPrefix)
+	if !ok {
+		gcsWriteError(w, http.StatusNotFound, "notFound", "Not Found")
+		return
+	}
+	switch {
+	case len(segments) == 1:
+		a.GCSBuckets(w, r)
+	case len(segments) == 2:
+		a.GCSBucket(w, r, segments[1])
+	case segments[2] != "o":
+		gcsWriteError(w, http.StatusNotFound, "notFound", "Not Found")
+	case len(segments) == 3:
+		if r.Method != http.MethodGet {
+			gcsWriteError(w, http.StatusMethodNotAllowed, "methodNotAllowed", "Method not allowed")
+			return
+		}
+		a.GCSListObjects(w, r, segments[1])
+	case len(segments) == 9 && (segments[4] == "copyTo" || segments[4] == "rewriteTo") && segments[5] == "b" && segments[7] == "o":
+		if r.Method != http.MethodPost {
+			gcsWriteError(w, http.StatusMethodNotAllowed, "methodNotAllowed", "Method not allowed")
+			return
+		}
+		a.GCSCopyObject(w, r, segments[1], segments[3], segments[6], segments[8], segments[4] == "rewriteTo")
+	default:
+		// Tolerate object names whose slashes weren't escaped
+		a.GCSObject(w, r, segments[1], strings.Join(segments[3:], "/"))
+	}
+}
+
+// GCSBuckets lists and creates buckets, the project parameter is ignored.
+func (a *api) GCSBuckets(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		result := gcsBuckets{Kind: "storage#buckets", Items: []gcsBucket{}}
+		for _, b := range a.store.ListBuckets() {
+			result.Items = append(result.Items, a.gcsBucketResource(r, b))
+		}
+		gcsWriteJSON(w, http.StatusOK, result)
+	case http.MethodPost:
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			gcsWriteError(w, http.StatusBadRequest, "parseError", "Parse Error")
+			return
+		}
+		b, err := a.store.CreateBucket(req.Name)
+		if err != nil {
+			if errors.Is(err, errInvalidBucketName) {
+				gcsWriteError(w, http.StatusBadRequest, "invalid", "Invalid bucket name: '"+req.Name+"'")
+				return
+			}
+			if errors.Is(err, errBucketExist) {
+				gcsWriteError(w, http.StatusConflict, "conflict", "Your previous request to create the named bucket succeeded and you already own it.")
+				return
+			}
+			gcsInternalError(err, w)
+			return
+		}
+		gcsWriteJSON(w, http.StatusOK, a.gcsBucketResource(r, *b))
+	default:
+		gcsWriteError(w, http.StatusMethodNotAllowed, "methodNotAllowed", "Method not allowed")
+	}
+}
+
+func (a *api) GCSBucket(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		b, err := a.store.GetBucket(name)
+		if err != nil {
+			gcsWriteError(w, http.StatusNotFound, "notFound", "The specified bucket does not exist.")
+			return
+		}
+		gcsWriteJSON(w, http.StatusOK, a.gcsBucketResource(r, *b))
+	case http.MethodDelete:
+		if err := a.store.DeleteBucket(name, false); err != nil {
+			if errors.Is(err, errBucketNotExist) {
+				gcsWriteError(w, http.StatusNotFound, "notFound", "The specified bucket does not exist.")
+				return
+			}
+			if errors.Is(err, errBucketNotEmpty) {
+				gcsWriteError(w, http.StatusConflict, "conflict", "The bucket you tried to delete is not empty.")
+				return
+			}
+			gcsInternalError(err, w)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		gcsWriteError(w, http.StatusMethodNotAllowed, "methodNotAllowed", "Method not allowed")
+	}
+}
+
+func (a *api) GCSListObjects(w http.ResponseWriter, r *http.Request, bucketName string) {
+	if _, err := a.store.GetBucket(bucketName); err != nil {
+		gcsWriteError(w, http.StatusNotFound, "notFound", "The specified bucket does not exist.")
+		return
+	}
+	query := r.URL.Query()
+	maxResults := gcsMaxResults
+	if v := query.Get("maxResults"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			gcsWriteError(w, http.StatusBadRequest, "invalid", "Invalid maxResults")
+			return
+		}
+		if n < maxResults {
+			maxResults = n
+		}
+	}
+	marker := ""
+	if token := query.Get("pageToken"); token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			gcsWriteError(w, http.StatusBadRequest, "invalid", "Invalid pageToken")
+			return
+		}
+		marker = string(decoded)
+	}
+
+	files, err := a.store.ListFiles()
+	if err != nil {
+		gcsInternalError(err, w)
+		return
+	}
+	byKey := make(map[string]storedFile)
+	keys := make([]string, 0, len(files))
+	for _, sf := range files {
+		if sf.Bucket != bucketName {
+			continue
+		}
+		key, ok := a.objectKey(sf)
+		if !ok {
+			continue
+		}
+		byKey[key] = sf
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	listing := listKeys(keys, query.Get("prefix"), query.Get("delimiter"), marker, maxResults)
+	result := gcsObjects{
+		Kind:     "storage#objects",
+		Items:    []gcsObject{},
+		Prefixes: listing.CommonPrefixes,
+	}
+	for _, key := range listing.Keys {
+		sf := byKey[key]
+		result.Items = append(result.Items, a.gcsObjectResource(r, bucketName, key, &sf))
+	}
+	if listing.Truncated {
+		result.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(listing.NextMarker))
+	}
+	gcsWriteJSON(w, http.StatusOK, result)
+}
+
+func (a *api) GCSObject(w http.ResponseWriter, r *http.Request, bucketName, name string) {
+	p, sf, ok := a.gcsLookup(w, bucketName, name)
+	if !ok {
+		return
+	}
+	if sf == nil {
+		gcsWriteError(w, http.StatusNotFound, "notFound", "No such object: "+bucketName+"/"+name)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("alt") == "media" {
+			a.gcsMedia(w, r, bucketName, sf)
+			return
+		}
+		gcsWriteJSON(w, http.StatusOK, a.gcsObjectResource(r, bucketName, name, sf))
+	case http.MethodDelete:
+		if err := a.deleteByPath(p); err != nil {
+			gcsStoreError(err, w)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		gcsWriteError(w, http.StatusMethodNotAllowed, "methodNotAllowed", "Method not allowed")
+	}
+}
+
+// GCSCopyObject serves both copyTo and rewriteTo, rewrites always finish in
+// a single call.
+func (a *api) GCSCopyObject(w http.ResponseWriter, r *http.Request, srcBucket, srcName, destBucket, destName string, rewrite bool) {
+	_, sf, ok := a.gcsLookup(w, srcBucket, srcName)
+	if !ok {
+		return
+	}
+	if sf == nil {
+		gcsWriteError(w, http.StatusNotFound, "notFound", "No such object: "+srcBucket+"/"+srcName)
+		return
+	}
+	dest, existing, ok := a.gcsLookup(w, destBucket, destName)
+	if !ok {
+		return
+	}
+	copied, err := a.store.CopyFileTo(sf.ID, dest, gcsPreconditions(r)...)
+	if err != nil {
+		gcsStoreError(err, w)
+		return
+	}
+	if existing == nil {
+		a.publishCreated(copied.ID)
+	}
+	resource := a.gcsObjectResource(r, destBucket, destName, copied)
+	if !rewrite {
+		gcsWriteJSON(w, http.StatusOK, resource)
+		return
+	}
+	size := strconv.FormatInt(copied.Size, 10)
+	gcsWriteJSON(w, http.StatusOK, gcsRewriteResponse{
+		Kind:                "storage#rewriteResponse",
+		TotalBytesRewritten: size,
+		ObjectSize:          size,
+		Done:                true,
+		Resource:            resource,
+	})
+}
+
+// GCSDownload serves /download/storage/v1/b/{bucket}/o/{object}.
+func (a *api) GCSDownload(w http.ResponseWriter, r *http.Request) {
+	segments, ok := gcsSegments(r, gcsDownloadPrefix)
+	if !ok || len(segments) < 4 || segments[2] != "o" {
+		gcsWriteError(w, http.StatusNotFound, "notFound", "Not Found")
+		return
+	}
+	if r.Method != http.MethodGet {
+		gcsWriteError(w, http.StatusMethodNotAllowed, "methodNotAllowed", "Method not allowed")
+		return
+	}
+	bucketName, name := segments[1], strings.Join(segments[3:], "/")
+	_, sf, ok := a.gcsLookup(w, bucketName, name)
+	if !ok {
+		return
+	}
+	if sf == nil {
+		gcsWriteError(w, http.StatusNotFound, "notFound", "No such object: "+bucketName+"/"+name)
+		return
+	}
+	a.gcsMedia(w, r, bucketName, sf)
+}
+
+// GCSUpload serves /upload/storage/v1/b/{bucket}/o for the media, multipart
+// and resumable upload types, and the session URLs of resumable uploads.
+func (a *api) GCSUpload(w http.ResponseWriter, r *http.Request) {
+	segments, ok := gcsSegments(r, gcsUploadPrefix)
+	if !ok || len(segments) != 3 || segments[2] != "o" {
+		gcsWriteError(w, http.StatusNotFound, "notFound", "Not Found")
+		return
+	}
+	bucketName := segments[1]
+	if _, err := a.store.GetBucket(bucketName); err != nil {
+		gcsWriteError(w, http.StatusNotFound, "notFound", "The specified bucket does not exist.")
+		return
+	}
+	query := r.URL.Query()
+	if query.Has("upload_id") {
+		a.GCSResumableUpload(w, r, bucketName, query.Get("upload_id"))
+		return
+	}
+	if r.Method != http.MethodPost {
+		gcsWriteError(w, http.StatusMethodNotAllowed, "methodNotAllowed", "Method not allowed")
+		return
+	}
+
+	switch query.Get("uploadType") {
+	case "media":
+		a.gcsWriteObject(w, r, bucketName, query.Get("name"), r.Body, r.Header.Get("Content-Type"))
+	case "multipart":
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || params["boundary"] == "" {
+			gcsWriteError(w, http.StatusBadRequest, "invalid", "Multipart uploads need a multipart/related body")
+			return
+		}
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		metadata, err := mr.NextPart()
+		if err != nil {
+			gcsWriteError(w, http.StatusBadRequest, "invalid", "Missing metadata part")
+			return
+		}
+		var req struct {
+			Name        string `json:"name"`
+			ContentType string `json:"contentType"`
+		}
+		if err := json.NewDecoder(metadata).Decode(&req); err != nil {
+			gcsWriteError(w, http.StatusBadRequest, "parseError", "Parse Error")
+			return
+		}
+		media, err := mr.NextPart()
+		if err != nil {
+			gcsWriteError(w, http.StatusBadRequest, "invalid", "Missing media part")
+			return
+		}
+		name := query.Get("name")
+		if name == "" {
+			name = req.Name
+		}
+		contentType := req.ContentType
+		if contentType == "" {
+			contentType = media.Header.Get("Content-Type")
+		}
+		a.gcsWriteObject(w, r, bucketName, name, media, contentType)
+	case "resumable":
+		var req struct {
+			Name        string `json:"name"`
+			ContentType string `json:"contentType"`
+		}
+		// The metadata is optional, the name may come as a parameter
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			gcsWriteError(w, http.StatusBadRequest, "parseError", "Parse Error")
+			return
+		}
+		name := query.Get("name")
+		if name == "" {
+			name = req.Name
+		}
+		p, existing, ok := a.gcsLookup(w, bucketName, name)
+		if !ok {
+			return
+		}
+		// Checked again when the upload completes, the session URL carries
+		// the precondition along
+		if err := checkPreconditions(existing, gcsPreconditions(r)); err != nil {
+			gcsStoreError(err, w)
+			return
+		}
+		contentType := req.ContentType
+		if contentType == "" {
+			contentType = r.Header.Get("X-Upload-Content-Type")
+		}
+		upload, err := a.store.CreateMultipartUpload(bucketName, name, p, WithContentType(contentType))
+		if err != nil {
+			gcsInternalError(err, w)
+			return
+		}
+		location := fmt.Sprintf("%s%sb/%s/o?uploadType=resumable&upload_id=%s",
+			gcsBaseURL(r), gcsUploadPrefix, url.PathEscape(bucketName), upload.UploadID)
+		if match := query.Get("ifGenerationMatch"); match != "" {
+			location += "&ifGenerationMatch=" + url.QueryEscape(match)
+		}
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusOK)
+	default:
+		gcsWriteError(w, http.StatusBadRequest, "invalid", "Unsupported uploadType '"+query.Get("uploadType")+"'")
+	}
+}
+
+// GCSResumableUpload takes the chunks sent to a resumable upload session. The
+// Content-Range of each says where it starts and, once known, the total size.
+// Chunks are staged as parts in order, and the object is written when all of
+// it has arrived.
+func (a *api) GCSResumableUpload(w http.ResponseWriter, r *http.Request, bucketName, uploadID string) {
+	upload, err := a.store.GetMultipartUpload(uploadID)
+	if err != nil || upload.Bucket != bucketName {
+		gcsWriteError(w, http.StatusNotFound, "notFound", "No such upload")
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if err := a.store.AbortMultipartUpload(uploadID); err != nil && !errors.Is(err, errNoSuchUpload) {
+			gcsInternalError(err, w)
+			return
+		}
+		w.WriteHeader(gcsStatusCancelled)
+		return
+	}
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		gcsWriteError(w, http.StatusMethodNotAllowed, "methodNotAllowed", "Method not allowed")
+		return
+	}
+
+	start, total, hasData, err := parseGCSContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		gcsWriteError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	parts, err := a.store.ListParts(uploadID)
+	if err != nil {
+		gcsInternalError(err, w)
+		return
+	}
+	var offset int64
+	for _, part := range parts {
+		offset += part.Size
+	}
+
+	if hasData {
+		if start > offset {
+			// A chunk got lost, have the client resume from what we have
+			gcsResumeIncomplete(w, offset)
+			return
+		}
+		// Skip what we already have of a resent chunk
+		if _, err := io.CopyN(io.Discard, r.Body, offset-start); err != nil {
+			gcsResumeIncomplete(w, offset)
+			return
+		}
+		part, err := a.store.UploadPart(uploadID, len(parts)+1, r.Body)
+		if err != nil {
+			if errors.Is(err, errInvalidPartNum) {
+				gcsWriteError(w, http.StatusBadRequest, "invalid", "Too many chunks, use a larger chunk size")
+				return
+			}
+			gcsInternalError(err, w)
+			return
+		}
+		parts = append(parts, *part)
+		offset += part.Size
+	}
+	if total < 0 || offset < total {
+		gcsResumeIncomplete(w, offset)
+		return
+	}
+	if offset > total {
+		gcsWriteError(w, http.StatusBadRequest, "invalid", "Received more data than the declared size")
+		return
+	}
+
+	completed := make([]completedPart, 0, len(parts))
+	for _, part := range parts {
+		if part.Size > 0 {
+			completed = append(completed, completedPart{Number: part.Number, ETag: part.ETag})
+		}
+	}
+	var sf *storedFile
+	created := false
+	if len(completed) == 0 {
+		// Empty object, there are no parts to complete
+		sf, created, err = a.store.UpsertFile(upload.Path, strings.NewReader(""), gcsPreconditions(r)...)
+		if err == nil {
+			err = a.store.AbortMultipartUpload(uploadID)
+		}
+	} else {
+		sf, created, err = a.store.completeUpload(uploadID, completed, 0, gcsPreconditions(r)...)
+	}
+	if err != nil {
+		gcsStoreError(err, w)
+		return
+	}
+	if created {
+		a.publishCreated(sf.ID)
+	}
+	gcsWriteJSON(w, http.StatusOK, a.gcsObjectResource(r, bucketName, upload.Key, sf))
+}
+
+// parseGCSContentRange parses "bytes first-last/total", "bytes first-last/*"
+// and the "bytes */total" or "bytes */*" of status checks. total is -1 when
+// unknown. Without a Content-Range the body is the whole object.
+func parseGCSContentRange(s string) (start, total int64, hasData bool, err error) {
+	if s == "" {
+		return 0, -1, true, nil
+	}
+	errInvalid := errors.New("Invalid Content-Range '" + s + "'")
+	spec, ok := strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, 0, false, errInvalid
+	}
+	byteRange, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, false, errInvalid
+	}
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil || total < 0 {
+			return 0, 0, false, errInvalid
+		}
+	}
+	if byteRange == "*" {
+		return 0, total, false, nil
+	}
+	first, last, ok := strings.Cut(byteRange, "-")
+	if !ok {
+		return 0, 0, false, errInvalid
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false, errInvalid
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false, errInvalid
+	}
+	return start, total, true, nil
+}
+
+func gcsResumeIncomplete(w http.ResponseWriter, offset int64) {
+	if offset > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", offset-1))
+	}
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+func (a *api) gcsWriteObject(w http.ResponseWriter, r *http.Request, bucketName, name string, body io.Reader, contentType string) {
+	p, _, ok := a.gcsLookup(w, bucketName, name)
+	if !ok {
+		return
+	}
+	options := append(gcsPreconditions(r), WithContentType(contentType))
+	sf, created, err := a.store.UpsertFile(p, body, options...)
+	if err != nil {
+		gcsStoreError(err, w)
+		return
+	}
+	if created {
+		a.publishCreated(sf.ID)
+	}
+	gcsWriteJSON(w, http.StatusOK, a.gcsObjectResource(r, bucketName, name, sf))
+}
+
+// gcsLookup resolves an object name to its path and the object there, nil
+// when there is none. It writes the error and returns false for unknown
+// buckets and unsupported names.
+func (a *api) gcsLookup(w http.ResponseWriter, bucketName, name string) (string, *storedFile, bool) {
+	if _, err := a.store.GetBucket(bucketName); err != nil {
+		gcsWriteError(w, http.StatusNotFound, "notFound", "The specified bucket does not exist.")
+		return "", nil, false
+	}
+	p, ok := a.keyPath(bucketName, name)
+	if !ok {
+		gcsWriteError(w, http.StatusBadRequest, "invalid", "Unsupported object name: '"+name+"'")
+		return "", nil, false
+	}
+	sf, err := a.store.GetFileByPath(p)
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			return p, nil, true
+		}
+		gcsInternalError(err, w)
+		return "", nil, false
+	}
+	return p, sf, true
+}
+
+// gcsPreconditions returns ifGenerationMatch as a precondition on the object
+// about to be replaced, where 0 means there must be none.
+func gcsPreconditions(r *http.Request) []FileOption {
+	match := r.URL.Query().Get("ifGenerationMatch")
+	if match == "" {
+		return nil
+	}
+	return []FileOption{WithPrecondition(func(existing *storedFile) error {
+		generation := "0"
+		if existing != nil {
+			generation = strconv.FormatInt(gcsGeneration(existing), 10)
+		}
+		if match != generation {
+			return fmt.Errorf("%w: ifGenerationMatch is %s, the generation is %s", errPreconditionFailed, match, generation)
+		}
+		return nil
+	})}
+}
+
+func (a *api) gcsMedia(w http.ResponseWriter, r *http.Request, bucketName string, sf *storedFile) {
+	header := w.Header()
+	header.Set("Content-Type", sf.contentType())
+	header.Set("Content-Length", strconv.FormatInt(sf.Size, 10))
+	header.Set("ETag", objectETag(sf))
+	header.Set("Last-Modified", sf.lastModified().UTC().Format(http.TimeFormat))
+	header.Set("X-Goog-Generation", strconv.FormatInt(gcsGeneration(sf), 10))
+	header.Set("X-Goog-Metageneration", "1")
+	header.Set("X-Goog-Stored-Content-Length", strconv.FormatInt(sf.Size, 10))
+	header.Set("X-Goog-Stored-Content-Encoding", "identity")
+	f, sf, err := a.store.OpenFile(sf.ID)
+	if err != nil {
+		if errors.Is(err, errNotExist) || errors.Is(err, os.ErrNotExist) {
+			gcsWriteError(w, http.StatusNotFound, "notFound", "No such object")
+			return
+		}
+		gcsInternalError(err, w)
+		return
+	}
+	defer f.Close()
+	serveObject(w, r, f, sf)
+}
+
+// gcsGeneration stands in for the object generation, GCS uses microsecond
+// timestamps too.
+func gcsGeneration(sf *storedFile) int64 {
+	return sf.lastModified().UnixMicro()
+}
+
+func (a *api) gcsBucketResource(r *http.Request, b bucket) gcsBucket {
+	created := b.Created.UTC().Format(time.RFC3339Nano)
+	return gcsBucket{
+		Kind:           "storage#bucket",
+		ID:             b.Name,
+		SelfLink:       gcsBaseURL(r) + gcsPrefix + "b/" + url.PathEscape(b.Name),
+		Name:           b.Name,
+		Location:       "US",
+		StorageClass:   "STANDARD",
+		Metageneration: "1",
+		TimeCreated:    created,
+		Updated:        created,
+	}
+}
+
+func (a *api) gcsObjectResource(r *http.Request, bucketName, name string, sf *storedFile) gcsObject {
+	generation := strconv.FormatInt(gcsGeneration(sf), 10)
+	// Every write makes a new generation, created when the content changed
+	created := sf.lastModified().UTC().Format(time.RFC3339Nano)
+	base := gcsBaseURL(r)
+	objectPath := "b/" + url.PathEscape(bucketName) + "/o/" + url.PathEscape(name)
+	return gcsObject{
+		Kind:           "storage#object",
+		ID:             bucketName + "/" + name + "/" + generation,
+		SelfLink:       base + gcsPrefix + objectPath,
+		MediaLink:      base + gcsDownloadPrefix + objectPath + "?generation=" + generation + "&alt=media",
+		Name:           name,
+		Bucket:         bucketName,
+		Generation:     generation,
+		Metageneration: "1",
+		ContentType:    sf.contentType(),
+		StorageClass:   "STANDARD",
+		Size:           strconv.FormatInt(sf.Size, 10),
+		Etag:           strings.Trim(objectETag(sf), `"`),
+		TimeCreated:    created,
+		Updated:        created,
+	}
+}
+
+func gcsBaseURL(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+func gcsWriteJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.Encode(v)
+}
+
+func gcsWriteError(w http.ResponseWriter, status int, reason, message string) {
+	gcsWriteJSON(w, status, gcsErrorResponse{
+		Error: gcsErrorBody{
+			Code:    status,
+			Message: message,
+			Errors: []gcsErrorItem{{
+				Domain:  "global",
+				Reason:  reason,
+				Message: message,
+			}},
+		},
+	})
+}
+
+// gcsStoreError writes the error of a failed write to the store.
+func gcsStoreError(err error, w http.ResponseWriter) {
+	if errors.Is(err, errTooLarge) {
+		gcsWriteError(w, http.StatusRequestEntityTooLarge, "uploadTooLarge", err.Error())
+		return
+	}
+	if errors.Is(err, errLocked) {
+		gcsWriteError(w, http.StatusForbidden, "retentionPolicyNotMet", err.Error())
+		return
+	}
+	if errors.Is(err, errPreconditionFailed) {
+		gcsWriteError(w, http.StatusPreconditionFailed, "conditionNotMet", "At least one of the pre-conditions you specified did not hold.")
+		return
+	}
+	gcsInternalError(err, w)
+}
+
+func gcsInternalError(err error, w http.ResponseWriter) {
+	log.Printf("Internal Server Error: '%s'\n", err)
+	gcsWriteError(w, http.StatusInternalServerError, "backendError", "Internal Error")
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeJSON(t *testing.T, resp *http.Response, v any) {
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+}
+
+func TestGCSAPI(t *testing.T) {
+	t.Parallel()
+	_, url := setupS3(t)
+
+	resp := doRequest(t, http.MethodPost, url+"/storage/v1/b?project=test", strings.NewReader(`{"name": "assets"}`))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var b gcsBucket
+	decodeJSON(t, resp, &b)
+	assert.Equal(t, "assets", b.Name)
+	resp = doRequest(t, http.MethodPost, url+"/storage/v1/b?project=test", strings.NewReader(`{"name": "assets"}`))
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	t.Run("media upload", func(t *testing.T) {
+		resp := doRequest(t, http.MethodPost, url+"/upload/storage/v1/b/assets/o?uploadType=media&name=img/logo.png", strings.NewReader("png"))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var obj gcsObject
+		decodeJSON(t, resp, &obj)
+		assert.Equal(t, "img/logo.png", obj.Name)
+		assert.Equal(t, "3", obj.Size)
+		assert.NotEmpty(t, obj.Generation)
+
+		resp = doRequest(t, http.MethodPost, url+"/upload/storage/v1/b/assets/o?uploadType=media&ifGenerationMatch=0&name=img/logo.png", strings.NewReader("png"))
+		assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+		resp = doRequest(t, http.MethodPost, url+"/upload/storage/v1/b/assets/o?uploadType=media&ifGenerationMatch="+obj.Generation+"&name=img/logo.png", strings.NewReader("PNG"))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("multipart upload", func(t *testing.T) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		pw, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+		require.NoError(t, err)
+		fmt.Fprint(pw, `{"name": "img/icon.svg"}`)
+		pw, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"image/svg+xml"}})
+		require.NoError(t, err)
+		fmt.Fprint(pw, "<svg/>")
+		mw.Close()
+
+		resp := doRequest(t, http.MethodPost, url+"/upload/storage/v1/b/assets/o?uploadType=multipart", &buf,
+			"Content-Type", "multipart/related; boundary="+mw.Boundary())
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var obj gcsObject
+		decodeJSON(t, resp, &obj)
+		assert.Equal(t, "img/icon.svg", obj.Name)
+		assert.Equal(t, "6", obj.Size)
+	})
+
+	t.Run("resumable upload", func(t *testing.T) {
+		resp := doRequest(t, http.MethodPost, url+"/upload/storage/v1/b/assets/o?uploadType=resumable", strings.NewReader(`{"name": "data.csv"}`))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		session := resp.Header.Get("Location")
+		require.True(t, strings.HasPrefix(session, url+"/upload/storage/v1/b/assets/o?"), session)
+
+		resp = doRequest(t, http.MethodPut, session, strings.NewReader("a,b\n"), "Content-Range", "bytes 0-3/*")
+		require.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+		assert.Equal(t, "bytes=0-3", resp.Header.Get("Range"))
+
+		// Resending part of a chunk only keeps the new bytes
+		resp = doRequest(t, http.MethodPut, session, strings.NewReader("b\n1,2\n"), "Content-Range", "bytes 2-7/*")
+		require.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+		assert.Equal(t, "bytes=0-7", resp.Header.Get("Range"))
+
+		resp = doRequest(t, http.MethodPut, session, nil, "Content-Range", "bytes */*")
+		require.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+		assert.Equal(t, "bytes=0-7", resp.Header.Get("Range"))
+
+		resp = doRequest(t, http.MethodPut, session, strings.NewReader("3,4\n"), "Content-Range", "bytes 8-11/12")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var obj gcsObject
+		decodeJSON(t, resp, &obj)
+		assert.Equal(t, "data.csv", obj.Name)
+		assert.Equal(t, "12", obj.Size)
+
+		resp = doRequest(t, http.MethodGet, url+"/storage/v1/b/assets/o/data.csv?alt=media", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		content, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "a,b\n1,2\n3,4\n", string(content))
+
+		resp = doRequest(t, http.MethodPut, session, strings.NewReader("x"), "Content-Range", "bytes 12-12/13")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("cancel resumable upload", func(t *testing.T) {
+		resp := doRequest(t, http.MethodPost, url+"/upload/storage/v1/b/assets/o?uploadType=resumable&name=cancelled", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		session := resp.Header.Get("Location")
+		resp = doRequest(t, http.MethodDelete, session, nil)
+		assert.Equal(t, gcsStatusCancelled, resp.StatusCode)
+		resp = doRequest(t, http.MethodGet, url+"/storage/v1/b/assets/o/cancelled", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("resumable upload precondition", func(t *testing.T) {
+		resp := doRequest(t, http.MethodPost, url+"/upload/storage/v1/b/assets/o?uploadType=resumable&ifGenerationMatch=0&name=raced.csv", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		session := resp.Header.Get("Location")
+		// Another writer gets there while the upload is in progress
+		resp = doRequest(t, http.MethodPost, url+"/upload/storage/v1/b/assets/o?uploadType=media&name=raced.csv", strings.NewReader("first"))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = doRequest(t, http.MethodPut, session, strings.NewReader("second"), "Content-Range", "bytes 0-5/6")
+		assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+		resp = doRequest(t, http.MethodGet, url+"/storage/v1/b/assets/o/raced.csv?alt=media", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		content, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "first", string(content))
+		resp = doRequest(t, http.MethodDelete, url+"/storage/v1/b/assets/o/raced.csv", nil)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	})
+
+	t.Run("get object", func(t *testing.T) {
+		resp := doRequest(t, http.MethodGet, url+"/storage/v1/b/assets/o/img%2Flogo.png", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var obj gcsObject
+		decodeJSON(t, resp, &obj)
+		assert.Equal(t, "assets", obj.Bucket)
+		assert.Contains(t, obj.MediaLink, "/download/storage/v1/b/assets/o/img%2Flogo.png")
+
+		resp = doRequest(t, http.MethodGet, url+"/download/storage/v1/b/assets/o/img%2Flogo.png?alt=media", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		content, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "PNG", string(content))
+		assert.Equal(t, obj.Generation, resp.Header.Get("X-Goog-Generation"))
+	})
+
+	t.Run("missing object", func(t *testing.T) {
+		resp := doRequest(t, http.MethodGet, url+"/storage/v1/b/assets/o/missing", nil)
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+		var gcsErr gcsErrorResponse
+		decodeJSON(t, resp, &gcsErr)
+		assert.Equal(t, http.StatusNotFound, gcsErr.Error.Code)
+		assert.Equal(t, "notFound", gcsErr.Error.Errors[0].Reason)
+
+		resp = doRequest(t, http.MethodGet, url+"/storage/v1/b/missing/o", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("list objects", func(t *testing.T) {
+		resp := doRequest(t, http.MethodGet, url+"/storage/v1/b/assets/o?delimiter=/", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var result gcsObjects
+		decodeJSON(t, resp, &result)
+		require.Len(t, result.Items, 1)
+		assert.Equal(t, "data.csv", result.Items[0].Name)
+		assert.Equal(t, []string{"img/"}, result.Prefixes)
+
+		var names []string
+		token := ""
+		for {
+			resp := doRequest(t, http.MethodGet, url+"/storage/v1/b/assets/o?maxResults=1&pageToken="+token, nil)
+			var page gcsObjects
+			decodeJSON(t, resp, &page)
+			for _, obj := range page.Items {
+				names = append(names, obj.Name)
+			}
+			if page.NextPageToken == "" {
+				break
+			}
+			token = page.NextPageToken
+		}
+		assert.Equal(t, []string{"data.csv", "img/icon.svg", "img/logo.png"}, names)
+	})
+
+	t.Run("rewrite", func(t *testing.T) {
+		resp := doRequest(t, http.MethodPost, url+"/storage/v1/b/assets/o/data.csv/rewriteTo/b/assets/o/backup%2Fdata.csv", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var result gcsRewriteResponse
+		decodeJSON(t, resp, &result)
+		assert.True(t, result.Done)
+		assert.Equal(t, "backup/data.csv", result.Resource.Name)
+
+		resp = doRequest(t, http.MethodGet, url+"/storage/v1/b/assets/o/backup%2Fdata.csv?alt=media", nil)
+		content, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "a,b\n1,2\n3,4\n", string(content))
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		resp := doRequest(t, http.MethodDelete, url+"/storage/v1/b/assets", nil)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+		for _, name := range []string{"data.csv", "backup%2Fdata.csv", "img%2Flogo.png", "img%2Ficon.svg"} {
+			resp := doRequest(t, http.MethodDelete, url+"/storage/v1/b/assets/o/"+name, nil)
+			assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		}
+		resp = doRequest(t, http.MethodDelete, url+"/storage/v1/b/assets/o/data.csv", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		resp = doRequest(t, http.MethodDelete, url+"/storage/v1/b/assets", nil)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	})
+}
+
+func TestParseGCSContentRange(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		header  string
+		start   int64
+		total   int64
+		hasData bool
+		err     bool
+	}{
+		{"", 0, -1, true, false},
+		{"bytes 0-99/*", 0, -1, true, false},
+		{"bytes 100-199/200", 100, 200, true, false},
+		{"bytes */200", 0, 200, false, false},
+		{"bytes */*", 0, -1, false, false},
+		{"bytes 10-5/20", 0, 0, false, true},
+		{"items 0-1/2", 0, 0, false, true},
+		{"bytes 0-1", 0, 0, false, true},
+	}
+	for _, test := range tests {
+		start, total, hasData, err := parseGCSContentRange(test.header)
+		if test.err {
+			assert.Error(t, err, test.header)
+			continue
+		}
+		require.NoError(t, err, test.header)
+		assert.Equal(t, test.start, start, test.header)
+		assert.Equal(t, test.total, total, test.header)
+		assert.Equal(t, test.hasData, hasData, test.header)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+)
+
+// ImportExisting registers every file in the data directory the manifest
+// doesn't know about. With deterministic set the ID is derived from the path
+// relative to the data directory instead of being random, so fixtures get the
+// same ID on every fresh volume.
+func (db *Store) ImportExisting(deterministic bool) ([]storedFile, error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.aoFile == nil {
+		return nil, errExiting
+	}
+
+	untracked, err := db.untrackedFiles()
+	if err != nil {
+		return nil, err
+	}
+	imported := make([]storedFile, 0, len(untracked))
+	for _, p := range untracked {
+		id := generateRandomUUID()
+		if deterministic {
+			rel, err := filepath.Rel(db.dir, p)
+			if err != nil {
+				return imported, err
+			}
+			id = generatePathUUID(filepath.ToSlash(rel))
+			if existing, ok := db.storedFiles[id]; ok {
+				log.Printf("Not importing '%s', its ID is taken by '%s'\n", p, existing.Path)
+				continue
+			}
+		}
+		sf, err := db.adoptFile(p, id)
+		if err != nil {
+			return imported, fmt.Errorf("Failed to import '%s': %w", p, err)
+		}
+		imported = append(imported, *sf)
+	}
+	return imported, nil
+}
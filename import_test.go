@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportExisting(t *testing.T) {
+	t.Parallel()
+
+	setup := func(t *testing.T) *Store {
+		storageDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(path.Join(storageDir, "fixtures"), 0700))
+		require.NoError(t, os.WriteFile(path.Join(storageDir, "fixtures", "a.json"), []byte("{}"), 0600))
+		require.NoError(t, os.WriteFile(path.Join(storageDir, "b.txt"), []byte("b"), 0600))
+		store, err := NewStore(storageDir)
+		require.NoError(t, err)
+		t.Cleanup(func() { store.Close() })
+		return store
+	}
+
+	t.Run("random ids", func(t *testing.T) {
+		store := setup(t)
+		imported, err := store.ImportExisting(false)
+		require.NoError(t, err)
+		require.Len(t, imported, 2)
+
+		buf := bytes.NewBuffer(nil)
+		require.NoError(t, store.ReadFile(imported[0].ID, buf))
+		assert.Equal(t, "b", buf.String())
+		// The originals are left in place
+		b, err := os.ReadFile(path.Join(store.Dir(), "fixtures", "a.json"))
+		require.NoError(t, err)
+		assert.Equal(t, "{}", string(b))
+
+		// Importing again is a no-op
+		imported, err = store.ImportExisting(false)
+		require.NoError(t, err)
+		assert.Empty(t, imported)
+	})
+
+	t.Run("path ids", func(t *testing.T) {
+		store := setup(t)
+		imported, err := store.ImportExisting(true)
+		require.NoError(t, err)
+		require.Len(t, imported, 2)
+		assert.Equal(t, generatePathUUID("b.txt"), imported[0].ID)
+		assert.Equal(t, generatePathUUID("fixtures/a.json"), imported[1].ID)
+
+		// The same layout in another directory gets the same IDs
+		other := setup(t)
+		otherImported, err := other.ImportExisting(true)
+		require.NoError(t, err)
+		assert.Equal(t, imported[0].ID, otherImported[0].ID)
+	})
+}
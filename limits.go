@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errTooLarge = errors.New("Object is larger than the size limit")
+
+// WithMaxObjectSize limits the size of every object written to the store,
+// buckets with a limit of their own use theirs instead. A maxSize below one
+// disables the limit.
+func WithMaxObjectSize(maxSize int64) StoreOption {
+	return func(db *Store) {
+		db.maxObjectSize = maxSize
+	}
+}
+
+// ObjectSizeLimit returns the largest object that may be written to bucket,
+// empty for objects outside of any bucket, zero when there is no limit.
+func (db *Store) ObjectSizeLimit(bucket string) int64 {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+	return db.objectSizeLimit(bucket)
+}
+
+func (db *Store) objectSizeLimit(bucket string) int64 {
+	if b, ok := db.buckets[bucket]; ok && b.MaxObjectSize > 0 {
+		return b.MaxObjectSize
+	}
+	if db.maxObjectSize > 0 {
+		return db.maxObjectSize
+	}
+	return 0
+}
+
+// checkObjectSize fails with errTooLarge when an object of size bytes is
+// past the limit of p, for copies whose size is known up front.
+func (db *Store) checkObjectSize(p string, size int64) error {
+	if limit := db.objectSizeLimit(db.bucketOf(p)); limit > 0 && size > limit {
+		return fmt.Errorf("%w of %d bytes", errTooLarge, limit)
+	}
+	return nil
+}
+
+// limitObjectSize fails reads from reader with errTooLarge once an object at
+// p, already holding size bytes, would grow past its limit.
+func (db *Store) limitObjectSize(p string, size int64, reader io.Reader) io.Reader {
+	limit := db.objectSizeLimit(db.bucketOf(p))
+	if limit == 0 {
+		return reader
+	}
+	return &sizeLimitedReader{reader: reader, remaining: limit - size, limit: limit}
+}
+
+type sizeLimitedReader struct {
+	reader    io.Reader
+	remaining int64
+	limit     int64
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, fmt.Errorf("%w of %d bytes", errTooLarge, l.limit)
+	}
+	// Reading one byte past the limit tells a body ending right at it apart
+	// from one going over
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.reader.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, fmt.Errorf("%w of %d bytes", errTooLarge, l.limit)
+	}
+	return n, err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unsized hides the length of a reader the way a chunked request body does.
+func unsized(s string) io.Reader {
+	return io.MultiReader(strings.NewReader(s))
+}
+
+func TestObjectSizeLimits(t *testing.T) {
+	t.Parallel()
+	store, err := NewStore(t.TempDir(), WithMaxObjectSize(8))
+	require.NoError(t, err)
+	defer store.Close()
+	p := filepath.Join(store.Dir(), "limited.txt")
+
+	read := func(id string) string {
+		var buf bytes.Buffer
+		require.NoError(t, store.ReadFile(id, &buf))
+		return buf.String()
+	}
+
+	t.Run("create", func(t *testing.T) {
+		_, err := store.CreateFile(p, unsized("123456789"))
+		assert.ErrorIs(t, err, errTooLarge)
+		_, err = os.Stat(p)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	sf, err := store.CreateFile(p, unsized("12345678"))
+	require.NoError(t, err)
+
+	t.Run("overwrite", func(t *testing.T) {
+		err := store.UpdateFile(sf.ID, unsized("abcdefghi"), true)
+		assert.ErrorIs(t, err, errTooLarge)
+		assert.Equal(t, "12345678", read(sf.ID))
+	})
+
+	t.Run("append", func(t *testing.T) {
+		require.NoError(t, store.UpdateFile(sf.ID, unsized("1234"), true))
+		err := store.UpdateFile(sf.ID, unsized("56789"), false)
+		assert.ErrorIs(t, err, errTooLarge)
+		assert.Equal(t, "1234", read(sf.ID))
+		require.NoError(t, store.UpdateFile(sf.ID, unsized("5678"), false))
+		assert.Equal(t, "12345678", read(sf.ID))
+	})
+
+	t.Run("bucket", func(t *testing.T) {
+		_, err := store.CreateBucket("small")
+		require.NoError(t, err)
+		_, err = store.UpdateBucket("small", func(b *bucket) { b.MaxObjectSize = 2 })
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), store.ObjectSizeLimit("small"))
+		assert.Equal(t, int64(8), store.ObjectSizeLimit(""))
+
+		_, _, err = store.UpsertFile(filepath.Join(store.BucketDir("small"), "a.txt"), unsized("abc"))
+		assert.ErrorIs(t, err, errTooLarge)
+		// Copies only write a record but are held to the limit all the same
+		_, err = store.CopyFileTo(sf.ID, filepath.Join(store.BucketDir("small"), "copy.txt"))
+		assert.ErrorIs(t, err, errTooLarge)
+		_, err = store.GetFileByPath(filepath.Join(store.BucketDir("small"), "copy.txt"))
+		assert.ErrorIs(t, err, errNotExist)
+
+		// Survives a restart
+		require.NoError(t, store.Close())
+		reopened, err := NewStore(store.Dir())
+		require.NoError(t, err)
+		defer reopened.Close()
+		assert.Equal(t, int64(2), reopened.ObjectSizeLimit("small"))
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxListLimit caps the objects and common prefixes in a page of
+// GET /objects/, also the page size when no limit is given.
+const maxListLimit = 1000
+
+type keyListing struct {
+	Keys []string
+	// Prefixes rolled up at the delimiter, each ending with the delimiter
+	CommonPrefixes []string
+	Truncated      bool
+	// Last key or common prefix returned, pass it as marker to resume
+	NextMarker string
+}
+
+// listKeys pages through sorted keys the way S3 does. Keys not starting with
+// prefix or sorting at or before marker are skipped, and when delimiter is set
+// keys sharing a prefix up to the next delimiter are rolled up into a single
+// common prefix. At most max keys and common prefixes are returned.
+func listKeys(sorted []string, prefix, delimiter, marker string, max int) keyListing {
+	var (
+		listing keyListing
+		last    string
+	)
+	for _, key := range sorted {
+		if !strings.HasPrefix(key, prefix) || key <= marker {
+			continue
+		}
+		commonPrefix := ""
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				commonPrefix = key[:len(prefix)+i+len(delimiter)]
+				// Already returned, either on this page or a previous one
+				if commonPrefix == last || commonPrefix == marker {
+					continue
+				}
+			}
+		}
+		if len(listing.Keys)+len(listing.CommonPrefixes) >= max {
+			listing.Truncated = true
+			listing.NextMarker = last
+			return listing
+		}
+		if commonPrefix != "" {
+			listing.CommonPrefixes = append(listing.CommonPrefixes, commonPrefix)
+			last = commonPrefix
+		} else {
+			listing.Keys = append(listing.Keys, key)
+			last = key
+		}
+	}
+	return listing
+}
+
+// ListObjectsResponse is a page of GET /objects/. Keys are the paths of the
+// objects relative to the bucket the request is scoped to, or to the root of
+// the store.
+type ListObjectsResponse struct {
+	Objects []storedFile `json:"objects"`
+	// Prefixes rolled up at the delimiter, each ending with the delimiter
+	CommonPrefixes []string `json:"commonPrefixes"`
+	Truncated      bool     `json:"truncated"`
+	// Pass as continuationToken to get the next page
+	NextContinuationToken string `json:"nextContinuationToken,omitempty"`
+}
+
+// listParameters are the query parameters that page GET /objects/.
+var listParameters = []string{"prefix", "delimiter", "limit", "continuationToken"}
+
+// ListObjects lists the objects matching the tag filters of the request,
+// sorted by key. Without any of listParameters it returns a plain array of
+// every object, as it always did, otherwise a ListObjectsResponse.
+func (a *api) ListObjects(w http.ResponseWriter, r *http.Request) {
+	files, err := a.store.ListFiles(listFilters(r)...)
+	if err != nil {
+		internalError(err, w, r)
+		return
+	}
+	base := a.store.Dir()
+	if bucket := requestBucket(r); bucket != "" {
+		base = a.store.BucketDir(bucket)
+	}
+	byKey := make(map[string]storedFile, len(files))
+	keys := make([]string, 0, len(files))
+	for _, sf := range files {
+		rel, err := filepath.Rel(base, sf.Path)
+		if err != nil {
+			continue
+		}
+		key := filepath.ToSlash(rel)
+		byKey[key] = sf
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	query := r.URL.Query()
+	paged := false
+	for _, parameter := range listParameters {
+		paged = paged || query.Has(parameter)
+	}
+	if !paged {
+		sorted := make([]storedFile, len(keys))
+		for i, key := range keys {
+			sorted[i] = byKey[key]
+		}
+		w.Header().Add("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.Encode(sorted)
+		return
+	}
+
+	limit := maxListLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			badRequest(w, r, "limit must be a positive integer")
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+	var marker string
+	if token := query.Get("continuationToken"); token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			badRequest(w, r, "Malformed continuationToken")
+			return
+		}
+		marker = string(decoded)
+	}
+
+	listing := listKeys(keys, query.Get("prefix"), query.Get("delimiter"), marker, limit)
+	result := ListObjectsResponse{
+		Objects:        make([]storedFile, 0, len(listing.Keys)),
+		CommonPrefixes: []string{},
+		Truncated:      listing.Truncated,
+	}
+	for _, key := range listing.Keys {
+		result.Objects = append(result.Objects, byKey[key])
+	}
+	result.CommonPrefixes = append(result.CommonPrefixes, listing.CommonPrefixes...)
+	if listing.Truncated {
+		result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(listing.NextMarker))
+	}
+	w.Header().Add("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(result)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListKeys(t *testing.T) {
+	keys := []string{"a.txt", "dir/a.txt", "dir/b.txt", "dir/sub/c.txt", "other/d.txt", "z.txt"}
+
+	t.Run("all", func(t *testing.T) {
+		listing := listKeys(keys, "", "", "", 1000)
+		assert.Equal(t, keys, listing.Keys)
+		assert.False(t, listing.Truncated)
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		listing := listKeys(keys, "dir/", "", "", 1000)
+		assert.Equal(t, []string{"dir/a.txt", "dir/b.txt", "dir/sub/c.txt"}, listing.Keys)
+	})
+
+	t.Run("delimiter", func(t *testing.T) {
+		listing := listKeys(keys, "", "/", "", 1000)
+		assert.Equal(t, []string{"a.txt", "z.txt"}, listing.Keys)
+		assert.Equal(t, []string{"dir/", "other/"}, listing.CommonPrefixes)
+
+		listing = listKeys(keys, "dir/", "/", "", 1000)
+		assert.Equal(t, []string{"dir/a.txt", "dir/b.txt"}, listing.Keys)
+		assert.Equal(t, []string{"dir/sub/"}, listing.CommonPrefixes)
+	})
+
+	t.Run("pagination", func(t *testing.T) {
+		var (
+			pages  [][]string
+			marker string
+		)
+		for {
+			listing := listKeys(keys, "", "/", marker, 2)
+			pages = append(pages, append(listing.Keys, listing.CommonPrefixes...))
+			if !listing.Truncated {
+				break
+			}
+			marker = listing.NextMarker
+		}
+		assert.Equal(t, [][]string{{"a.txt", "dir/"}, {"z.txt", "other/"}}, pages)
+	})
+}
+
+func TestListObjects(t *testing.T) {
+	t.Parallel()
+	store, url := setupS3(t)
+	for _, key := range []string{"a.txt", "dir/a.txt", "dir/b.txt", "dir/sub/c.txt", "z.txt"} {
+		p := filepath.Join(store.Dir(), filepath.FromSlash(key))
+		_, err := store.CreateFile(p, strings.NewReader(key))
+		require.NoError(t, err)
+	}
+	list := func(query string) ListObjectsResponse {
+		resp := doRequest(t, http.MethodGet, url+"/objects/?"+query, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var result ListObjectsResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return result
+	}
+	keys := func(files []storedFile) []string {
+		var keys []string
+		for _, sf := range files {
+			rel, err := filepath.Rel(store.Dir(), sf.Path)
+			require.NoError(t, err)
+			keys = append(keys, filepath.ToSlash(rel))
+		}
+		return keys
+	}
+
+	t.Run("unpaged", func(t *testing.T) {
+		resp := doRequest(t, http.MethodGet, url+"/objects/", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var files []storedFile
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&files))
+		assert.Equal(t, []string{"a.txt", "dir/a.txt", "dir/b.txt", "dir/sub/c.txt", "z.txt"}, keys(files))
+	})
+
+	t.Run("prefix and delimiter", func(t *testing.T) {
+		result := list("delimiter=/")
+		assert.Equal(t, []string{"a.txt", "z.txt"}, keys(result.Objects))
+		assert.Equal(t, []string{"dir/"}, result.CommonPrefixes)
+		assert.False(t, result.Truncated)
+
+		result = list("prefix=dir/&delimiter=/")
+		assert.Equal(t, []string{"dir/a.txt", "dir/b.txt"}, keys(result.Objects))
+		assert.Equal(t, []string{"dir/sub/"}, result.CommonPrefixes)
+	})
+
+	t.Run("continuation", func(t *testing.T) {
+		var all []string
+		query := "limit=2"
+		for {
+			result := list(query)
+			all = append(all, keys(result.Objects)...)
+			all = append(all, result.CommonPrefixes...)
+			if !result.Truncated {
+				assert.Empty(t, result.NextContinuationToken)
+				break
+			}
+			require.NotEmpty(t, result.NextContinuationToken)
+			query = "limit=2&continuationToken=" + result.NextContinuationToken
+		}
+		assert.Equal(t, []string{"a.txt", "dir/a.txt", "dir/b.txt", "dir/sub/c.txt", "z.txt"}, all)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		resp := doRequest(t, http.MethodGet, url+"/objects/?limit=0", nil)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		resp = doRequest(t, http.MethodGet, url+"/objects/?continuationToken=!", nil)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Retention modes, governance retention can be bypassed with
+// bypassGovernanceHeader while compliance retention can't be by anyone.
+const (
+	retentionGovernance = "GOVERNANCE"
+	retentionCompliance = "COMPLIANCE"
+)
+
+// Lets a write or delete through governance retention when set to "true"
+const (
+	bypassGovernanceHeader   = "X-Bypass-Governance-Retention"
+	s3BypassGovernanceHeader = "X-Amz-Bypass-Governance-Retention"
+)
+
+var (
+	errLocked           = errors.New("Object is locked")
+	errInvalidRetention = errors.New("Retention needs a mode of GOVERNANCE or COMPLIANCE and a retainUntil date")
+)
+
+// ObjectRetention keeps an object from being overwritten, appended to or
+// deleted until RetainUntil.
+type ObjectRetention struct {
+	Mode        string    `json:"mode"`
+	RetainUntil time.Time `json:"retainUntil"`
+}
+
+// LegalHold keeps an object from being written to or deleted until lifted,
+// whatever its retention.
+type LegalHold struct {
+	Enabled bool `json:"enabled"`
+}
+
+// BypassGovernance lets a write or delete through governance retention.
+// Legal holds and compliance retention still apply.
+func BypassGovernance() FileOption {
+	return func(sf *storedFile) {
+		sf.bypassGovernance = true
+	}
+}
+
+// bypassOptions returns BypassGovernance when header asks for it.
+func bypassOptions(header http.Header, name string) []FileOption {
+	if strings.EqualFold(header.Get(name), "true") {
+		return []FileOption{BypassGovernance()}
+	}
+	return nil
+}
+
+// bypassing reports whether options include BypassGovernance.
+func bypassing(options []FileOption) bool {
+	var probe storedFile
+	for _, option := range options {
+		option(&probe)
+	}
+	return probe.bypassGovernance
+}
+
+// checkLock returns errLocked while sf is under a legal hold or retention at
+// now that bypass doesn't let through.
+func (sf *storedFile) checkLock(now time.Time, bypass bool) error {
+	if sf.LegalHold {
+		return fmt.Errorf("%w by a legal hold", errLocked)
+	}
+	r := sf.Retention
+	if r == nil || !r.RetainUntil.After(now) {
+		return nil
+	}
+	if r.Mode == retentionGovernance && bypass {
+		return nil
+	}
+	return fmt.Errorf("%w until %s", errLocked, r.RetainUntil.UTC().Format(time.RFC3339))
+}
+
+// SetRetention replaces the retention of an object, nil removes it. Active
+// retention can always be extended but only shortened or removed in
+// governance mode with BypassGovernance, and never turned from compliance
+// back into governance.
+func (db *Store) SetRetention(id string, retention *ObjectRetention, options ...FileOption) (*storedFile, error) {
+	if retention != nil && (retention.RetainUntil.IsZero() || retention.Mode != retentionGovernance && retention.Mode != retentionCompliance) {
+		return nil, errInvalidRetention
+	}
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.aoFile == nil {
+		return nil, errExiting
+	}
+	sf, err := db.getFileMetadata(id)
+	if err != nil {
+		return nil, err
+	}
+	current := sf.Retention
+	if current != nil && current.RetainUntil.After(time.Now()) {
+		weakened := retention == nil || retention.RetainUntil.Before(current.RetainUntil) ||
+			(current.Mode == retentionCompliance && retention.Mode != retentionCompliance)
+		if weakened && (current.Mode != retentionGovernance || !bypassing(options)) {
+			return nil, fmt.Errorf("%w until %s", errLocked, current.RetainUntil.UTC().Format(time.RFC3339))
+		}
+	}
+	return db.updateMetadata(id, func(sf *storedFile) {
+		sf.Retention = retention
+	})
+}
+
+// SetLegalHold places or lifts a legal hold on an object.
+func (db *Store) SetLegalHold(id string, enabled bool) (*storedFile, error) {
+	return db.UpdateMetadata(id, func(sf *storedFile) {
+		sf.LegalHold = enabled
+	})
+}
+
+// ObjectLock serves the retention of an object on GET and PUT
+// /objects/{id}/retention, DELETE removing it, and its legal hold on GET and
+// PUT /objects/{id}/legal-hold.
+func (a *api) ObjectLock(w http.ResponseWriter, r *http.Request) {
+	id, setting, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/objects/"), "/")
+	if id == "" || !a.inBucket(r, id) {
+		http.NotFound(w, r)
+		return
+	}
+	var (
+		sf  *storedFile
+		err error
+	)
+	switch {
+	case r.Method == http.MethodGet:
+		sf, err = a.store.GetFileMetadata(id)
+	case setting == "retention" && r.Method == http.MethodPut:
+		var retention ObjectRetention
+		if err := json.NewDecoder(r.Body).Decode(&retention); err != nil {
+			badRequest(w, r, "Malformed retention due to: '%s'", err)
+			return
+		}
+		sf, err = a.store.SetRetention(id, &retention, bypassOptions(r.Header, bypassGovernanceHeader)...)
+	case setting == "retention" && r.Method == http.MethodDelete:
+		sf, err = a.store.SetRetention(id, nil, bypassOptions(r.Header, bypassGovernanceHeader)...)
+	case setting == "legal-hold" && r.Method == http.MethodPut:
+		var hold LegalHold
+		if err := json.NewDecoder(r.Body).Decode(&hold); err != nil {
+			badRequest(w, r, "Malformed legal hold due to: '%s'", err)
+			return
+		}
+		sf, err = a.store.SetLegalHold(id, hold.Enabled)
+	default:
+		methodNotAllowed(w, r)
+		return
+	}
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if errors.Is(err, errInvalidRetention) {
+			badRequest(w, r, "%s", err)
+			return
+		}
+		if errors.Is(err, errLocked) {
+			forbidden(w, r, "%s", err)
+			return
+		}
+		internalError(err, w, r)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if setting == "legal-hold" {
+		enc.Encode(LegalHold{Enabled: sf.LegalHold})
+		return
+	}
+	if sf.Retention == nil {
+		enc.Encode(struct{}{})
+		return
+	}
+	enc.Encode(sf.Retention)
+}
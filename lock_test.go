@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObjectLock(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	store, err := NewStore(dir)
+	require.NoError(t, err)
+	defer func() { store.Close() }()
+	until := time.Now().Add(time.Hour)
+
+	governed, err := store.CreateFile(filepath.Join(dir, "governed"), strings.NewReader("1"))
+	require.NoError(t, err)
+	_, err = store.SetRetention(governed.ID, &ObjectRetention{Mode: retentionGovernance, RetainUntil: until})
+	require.NoError(t, err)
+	assert.ErrorIs(t, store.UpdateFile(governed.ID, strings.NewReader("2"), true), errLocked)
+	assert.ErrorIs(t, store.UpdateFile(governed.ID, strings.NewReader("2"), false), errLocked)
+	assert.ErrorIs(t, store.DeleteFile(governed.ID), errLocked)
+	_, _, err = store.UpsertFile(governed.Path, strings.NewReader("2"))
+	assert.ErrorIs(t, err, errLocked)
+	require.NoError(t, store.UpdateFile(governed.ID, strings.NewReader("2"), true, BypassGovernance()))
+	sf, err := store.GetFileMetadata(governed.ID)
+	require.NoError(t, err)
+	require.NotNil(t, sf.Retention)
+	assert.False(t, sf.bypassGovernance)
+
+	compliant, err := store.CreateFile(filepath.Join(dir, "compliant"), strings.NewReader("1"))
+	require.NoError(t, err)
+	_, err = store.SetRetention(compliant.ID, &ObjectRetention{Mode: retentionCompliance, RetainUntil: until})
+	require.NoError(t, err)
+	assert.ErrorIs(t, store.DeleteFile(compliant.ID, BypassGovernance()), errLocked)
+	_, err = store.SetRetention(compliant.ID, nil, BypassGovernance())
+	assert.ErrorIs(t, err, errLocked)
+	_, err = store.SetRetention(compliant.ID, &ObjectRetention{Mode: retentionGovernance, RetainUntil: until.Add(time.Hour)})
+	assert.ErrorIs(t, err, errLocked)
+	_, err = store.SetRetention(compliant.ID, &ObjectRetention{Mode: retentionCompliance, RetainUntil: until.Add(time.Hour)})
+	assert.NoError(t, err)
+	_, err = store.SetRetention(compliant.ID, &ObjectRetention{Mode: "FOREVER", RetainUntil: until})
+	assert.ErrorIs(t, err, errInvalidRetention)
+
+	held, err := store.CreateFile(filepath.Join(dir, "held"), strings.NewReader("1"), WithExpires(time.Now()))
+	require.NoError(t, err)
+	_, err = store.SetLegalHold(held.ID, true)
+	require.NoError(t, err)
+	assert.ErrorIs(t, store.DeleteFile(held.ID, BypassGovernance()), errLocked)
+	expired, err := store.ExpireObjects(time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, expired)
+
+	t.Run("versions", func(t *testing.T) {
+		_, err := store.CreateBucket("ledgers")
+		require.NoError(t, err)
+		_, err = store.UpdateBucket("ledgers", func(b *bucket) { b.Versioning = true })
+		require.NoError(t, err)
+		sf, err := store.CreateFile(filepath.Join(store.BucketDir("ledgers"), "ledger"), strings.NewReader("1"))
+		require.NoError(t, err)
+		_, err = store.SetRetention(sf.ID, &ObjectRetention{Mode: retentionGovernance, RetainUntil: until})
+		require.NoError(t, err)
+		require.NoError(t, store.UpdateFile(sf.ID, strings.NewReader("2"), true, BypassGovernance()))
+
+		// Versions keep the retention they were archived with
+		assert.ErrorIs(t, store.DeleteVersion(sf.ID, sf.VersionID), errLocked)
+		assert.ErrorIs(t, store.DeleteBucket("ledgers", true), errLocked)
+		assert.NoError(t, store.DeleteVersion(sf.ID, sf.VersionID, BypassGovernance()))
+	})
+
+	t.Run("survives restarts and compaction", func(t *testing.T) {
+		_, err := store.Compact()
+		require.NoError(t, err)
+		require.NoError(t, store.Close())
+		store, err = NewStore(dir)
+		require.NoError(t, err)
+		assert.ErrorIs(t, store.DeleteFile(held.ID), errLocked)
+		assert.ErrorIs(t, store.DeleteFile(compliant.ID), errLocked)
+	})
+
+	t.Run("released", func(t *testing.T) {
+		_, err := store.SetLegalHold(held.ID, false)
+		require.NoError(t, err)
+		assert.NoError(t, store.DeleteFile(held.ID))
+		_, err = store.SetRetention(governed.ID, nil, BypassGovernance())
+		require.NoError(t, err)
+		assert.NoError(t, store.DeleteFile(governed.ID))
+		// Retention that has run out doesn't hold anything
+		lapsed, err := store.CreateFile(filepath.Join(dir, "lapsed"), strings.NewReader("1"))
+		require.NoError(t, err)
+		_, err = store.SetRetention(lapsed.ID, &ObjectRetention{Mode: retentionCompliance, RetainUntil: time.Now().Add(-time.Minute)})
+		require.NoError(t, err)
+		assert.NoError(t, store.UpdateFile(lapsed.ID, strings.NewReader("2"), true))
+		assert.NoError(t, store.DeleteFile(lapsed.ID))
+	})
+}
+
+func TestObjectLockAPI(t *testing.T) {
+	t.Parallel()
+	_, url := setupS3(t)
+
+	objects := url + "/objects/"
+	id := uploadMultipart(t, objects, "ledger.csv", "a,b")
+	resp := doRequest(t, http.MethodGet, objects+id+"/retention", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	until := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	resp = doRequest(t, http.MethodPut, objects+id+"/retention", strings.NewReader(`{"mode": "GOVERNANCE", "retainUntil": "`+until+`"}`))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var retention ObjectRetention
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&retention))
+	assert.Equal(t, retentionGovernance, retention.Mode)
+	resp = doRequest(t, http.MethodPut, objects+id+"/retention", strings.NewReader(`{"mode": "GOVERNANCE"}`))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPut, objects+id, strings.NewReader("c,d"))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = doRequest(t, http.MethodPatch, objects+id, strings.NewReader("c,d"))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = doRequest(t, http.MethodDelete, objects+id, nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = doRequest(t, http.MethodDelete, objects+id+"/retention", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = doRequest(t, http.MethodPut, objects+id, strings.NewReader("c,d"), "X-Bypass-Governance-Retention", "true")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPut, objects+id+"/legal-hold", strings.NewReader(`{"enabled": true}`))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var hold LegalHold
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&hold))
+	assert.True(t, hold.Enabled)
+	resp = doRequest(t, http.MethodDelete, objects+id, nil, "X-Bypass-Governance-Retention", "true")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = doRequest(t, http.MethodPut, objects+id+"/legal-hold", strings.NewReader(`{"enabled": false}`))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodDelete, objects+id, nil, "X-Bypass-Governance-Retention", "true")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	t.Run("presigned", func(t *testing.T) {
+		signed := url + string(toURL([]byte("testing"), &signedURL{Path: "locked.txt", Expiry: time.Now().Add(time.Minute)}))
+		resp := doRequest(t, http.MethodPut, signed, strings.NewReader("first"))
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var created CreateObjectResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+		resp = doRequest(t, http.MethodPut, objects+created.ID+"/legal-hold", strings.NewReader(`{"enabled": true}`))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = doRequest(t, http.MethodPut, signed, strings.NewReader("second"))
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("S3", func(t *testing.T) {
+		resp := doRequest(t, http.MethodPut, url+"/vault", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = doRequest(t, http.MethodPut, url+"/vault/key", strings.NewReader("a"))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = doRequest(t, http.MethodGet, url+"/buckets/vault/objects/", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var files []storedFile
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&files))
+		require.Len(t, files, 1)
+		resp = doRequest(t, http.MethodPut, objects+files[0].ID+"/retention", strings.NewReader(`{"mode": "GOVERNANCE", "retainUntil": "`+until+`"}`))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = doRequest(t, http.MethodPut, url+"/vault/key", strings.NewReader("b"))
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		resp = doRequest(t, http.MethodDelete, url+"/vault/key", nil)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		resp = doRequest(t, http.MethodDelete, url+"/vault/key", nil, "X-Amz-Bypass-Governance-Retention", "true")
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	})
+
+	t.Run("versions", func(t *testing.T) {
+		resp := doRequest(t, http.MethodPut, url+"/buckets/archive", strings.NewReader(`{"versioning": true}`))
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		id := uploadMultipart(t, url+"/buckets/archive/objects/", "ledger.csv", "a,b")
+		resp = doRequest(t, http.MethodPut, objects+id+"/retention", strings.NewReader(`{"mode": "GOVERNANCE", "retainUntil": "`+until+`"}`))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = doRequest(t, http.MethodPut, objects+id, strings.NewReader("c,d"), "X-Bypass-Governance-Retention", "true")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = doRequest(t, http.MethodGet, objects+id+"/versions", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var versions []objectVersion
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&versions))
+		require.Len(t, versions, 2)
+
+		archived := objects + id + "?versionId=" + versions[1].VersionID
+		resp = doRequest(t, http.MethodDelete, archived, nil)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		resp = doRequest(t, http.MethodDelete, archived, nil, "X-Bypass-Governance-Retention", "true")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
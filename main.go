@@ -1,18 +1,39 @@
 package main
 
 import (
+	"encoding/base64"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"path"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		os.Exit(runFsck(os.Args[2:], os.Stdout))
+	}
+
 	host := flag.String("host", getEnvWithDefault("HOST_ADDR", ":8080"), "Host address where to run server")
 	filePath := flag.String("path", getEnvWithDefault("FILE_PATH", "/var/data"), "Path where files are written")
 	secretEnv := getEnvWithDefault("SECRET", "")
 	secret := flag.String("secret", "", "Secret used to sign URLs")
+	compactSize := flag.Int64("compact-size", getEnvInt64WithDefault("COMPACT_SIZE", defaultCompactMinSize), "Minimum manifest size in bytes before it is compacted automatically, -1 disables")
+	compactRatio := flag.Float64("compact-ratio", getEnvFloat64WithDefault("COMPACT_RATIO", defaultCompactRatio), "Fraction of dead manifest records that triggers compaction")
+	s3Credentials := flag.String("s3-credentials", getEnvWithDefault("S3_CREDENTIALS", ""), "Comma separated ACCESS_KEY:SECRET pairs accepted by the S3 API, leaves it unauthenticated when empty")
+	azureAccounts := flag.String("azure-accounts", getEnvWithDefault("AZURE_ACCOUNTS", ""), "Comma separated ACCOUNT:KEY pairs served by the Azure Blob API, keys base64 encoded")
+	importExisting := flag.Bool("import-existing", getEnvWithDefault("IMPORT_EXISTING", "") == "true", "Register files already in the data directory on startup")
+	importIDs := flag.String("import-ids", getEnvWithDefault("IMPORT_IDS", "random"), "How imported files get their IDs, 'random' or 'path' to derive them from the relative path")
+	maxUploadSize := flag.Int64("max-upload-size", getEnvInt64WithDefault("MAX_UPLOAD_SIZE", defaultMaxUploadSize), "Largest upload in bytes accepted by /objects/, -1 disables the limit")
+	maxObjectSize := flag.Int64("max-object-size", getEnvInt64WithDefault("MAX_OBJECT_SIZE", -1), "Largest object in bytes accepted on any write path unless its bucket sets a limit of its own, -1 disables the limit")
+	trash := flag.Bool("trash", getEnvWithDefault("TRASH", "") == "true", "Move deleted objects to the trash instead of removing them")
+	trashRetention := flag.Duration("trash-retention", getEnvDurationWithDefault("TRASH_RETENTION", defaultTrashRetention), "Age after which objects in the trash are purged, 0 keeps them until restored or deleted")
+	expiryInterval := flag.Duration("expiry-interval", getEnvDurationWithDefault("EXPIRY_INTERVAL", defaultExpiryInterval), "How often objects past their expiry or bucket lifecycle rules are deleted, 0 disables")
+	multipartTTL := flag.Duration("multipart-ttl", getEnvDurationWithDefault("MULTIPART_TTL", defaultUploadTTL), "Age after which unfinished multipart uploads are aborted, 0 disables")
 
 	flag.Parse()
 
@@ -25,17 +46,45 @@ func main() {
 		}
 	}
 
-	p := *filePath
-	if err := os.MkdirAll(p, 0700); err != nil {
-		log.Fatalf("Failed to create directory: %s", err)
+	credentials, err := parseCredentials(*s3Credentials)
+	if err != nil {
+		log.Fatal(err.Error())
 	}
 
-	appendFilePath := path.Join(p, dbFileName)
-	if err := InitializeDB(appendFilePath); err != nil {
+	accounts, err := parseAzureAccounts(*azureAccounts)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	store, err := NewStore(*filePath, WithCompaction(*compactSize, *compactRatio), WithMaxObjectSize(*maxObjectSize), WithTrash(*trash))
+	if err != nil {
 		log.Fatalf("Error while initializing db due to '%s'", err)
 	}
 
-	api := NewAPI(p, []byte(*secret))
+	if *importExisting {
+		if *importIDs != "random" && *importIDs != "path" {
+			log.Fatalf("Unknown -import-ids '%s', must be 'random' or 'path'", *importIDs)
+		}
+		imported, err := store.ImportExisting(*importIDs == "path")
+		if err != nil {
+			log.Fatalf("Error while importing existing files due to '%s'", err)
+		}
+		log.Printf("Imported %d existing files\n", len(imported))
+	}
+
+	go abortExpiredUploads(store, *multipartTTL)
+	go purgeTrash(store, *trashRetention)
+
+	c := make(chan os.Signal, 1)
+	go func() {
+		<-c
+		store.Close()
+		os.Exit(0)
+	}()
+	signal.Notify(c, os.Interrupt, os.Kill)
+
+	api := NewAPI(store, []byte(*secret), WithS3Credentials(credentials), WithAzureAccounts(accounts), WithMaxUploadSize(*maxUploadSize))
+	go api.SweepExpired(*expiryInterval)
 	if err := http.ListenAndServe(*host, api); err != nil {
 		log.Fatal(err.Error())
 	}
@@ -47,3 +96,109 @@ func getEnvWithDefault(varName, def string) string {
 	}
 	return def
 }
+
+func getEnvInt64WithDefault(varName string, def int64) int64 {
+	if result, err := strconv.ParseInt(os.Getenv(varName), 10, 64); err == nil {
+		return result
+	}
+	return def
+}
+
+func getEnvFloat64WithDefault(varName string, def float64) float64 {
+	if result, err := strconv.ParseFloat(os.Getenv(varName), 64); err == nil {
+		return result
+	}
+	return def
+}
+
+func getEnvDurationWithDefault(varName string, def time.Duration) time.Duration {
+	if result, err := time.ParseDuration(os.Getenv(varName)); err == nil {
+		return result
+	}
+	return def
+}
+
+// abortExpiredUploads periodically drops multipart uploads older than ttl,
+// and Azure blocks staged longer ago than that.
+func abortExpiredUploads(store *Store, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	interval := ttl
+	if interval > 10*time.Minute {
+		interval = 10 * time.Minute
+	}
+	for range time.Tick(interval) {
+		aborted, err := store.AbortExpiredUploads(ttl)
+		if err != nil {
+			log.Printf("Error while aborting expired uploads due to '%s'\n", err)
+		}
+		if aborted > 0 {
+			log.Printf("Aborted %d expired multipart uploads\n", aborted)
+		}
+		discarded, err := store.DiscardExpiredBlocks(ttl)
+		if err != nil {
+			log.Printf("Error while discarding expired blocks due to '%s'\n", err)
+		}
+		if discarded > 0 {
+			log.Printf("Discarded expired blocks of %d blobs\n", discarded)
+		}
+	}
+}
+
+// parseCredentials parses comma separated ACCESS_KEY:SECRET pairs.
+func parseCredentials(s string) (map[string]string, error) {
+	credentials := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		accessKey, secret, ok := strings.Cut(pair, ":")
+		if !ok || accessKey == "" || secret == "" {
+			return nil, fmt.Errorf("Invalid S3 credentials '%s', expected ACCESS_KEY:SECRET", pair)
+		}
+		credentials[accessKey] = secret
+	}
+	return credentials, nil
+}
+
+// parseAzureAccounts parses comma separated ACCOUNT:KEY pairs, keys being
+// base64 encoded like the ones in Azure connection strings.
+func parseAzureAccounts(s string) (map[string]string, error) {
+	accounts := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		account, key, ok := strings.Cut(pair, ":")
+		if !ok || account == "" || key == "" {
+			return nil, fmt.Errorf("Invalid Azure account '%s', expected ACCOUNT:KEY", pair)
+		}
+		if _, err := base64.StdEncoding.DecodeString(key); err != nil {
+			return nil, fmt.Errorf("Invalid Azure account '%s', the key must be base64 encoded", account)
+		}
+		accounts[account] = key
+	}
+	return accounts, nil
+}
+
+// purgeTrash periodically removes objects deleted more than retention ago
+// from the trash.
+func purgeTrash(store *Store, retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	interval := retention
+	if interval > 10*time.Minute {
+		interval = 10 * time.Minute
+	}
+	for range time.Tick(interval) {
+		purged, err := store.PurgeTrash(retention)
+		if err != nil {
+			log.Printf("Error while purging the trash due to '%s'\n", err)
+		}
+		if purged > 0 {
+			log.Printf("Purged %d objects from the trash\n", purged)
+		}
+	}
+}
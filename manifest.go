@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+)
+
+// The manifest starts with an 8 byte header, a magic string followed by the
+// format version. Every record after it is framed as
+//
+//	uint32 payload length | uint32 CRC32 of the payload | JSON payload
+//
+// in big endian, so a record cut short by a crash can be detected and
+// dropped. Manifests without the header are the legacy text format of
+// "ACTION ID JSON" lines and get rewritten on startup.
+const (
+	manifestMagic   = "LOBJ"
+	manifestVersion = uint32(2)
+
+	manifestHeaderSize = len(manifestMagic) + 4
+	recordHeaderSize   = 8
+	// Upper bound on a single record, anything larger is garbage.
+	maxRecordSize = 16 << 20
+)
+
+var (
+	errCorruptManifest     = errors.New("Manifest is corrupt")
+	errUnsupportedManifest = errors.New("Unsupported manifest version")
+)
+
+type manifestRecord struct {
+	Action string      `json:"action"`
+	ID     string      `json:"id"`
+	File   *storedFile `json:"file,omitempty"`
+	Bucket *bucket     `json:"bucket,omitempty"`
+	// Version of the object ID, for ADD_VERSION and DEL_VERSION
+	Version *objectVersion `json:"version,omitempty"`
+}
+
+func manifestHeader() []byte {
+	b := make([]byte, manifestHeaderSize)
+	copy(b, manifestMagic)
+	binary.BigEndian.PutUint32(b[len(manifestMagic):], manifestVersion)
+	return b
+}
+
+func encodeRecord(rec manifestRecord) []byte {
+	payload, _ := json.Marshal(rec)
+	b := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(b[4:8], crc32.ChecksumIEEE(payload))
+	copy(b[recordHeaderSize:], payload)
+	return b
+}
+
+// readRecords calls apply for every intact record in r, which must be
+// positioned just after the header. It returns the offset, relative to r,
+// where the intact records end. A damaged record is only tolerated when it
+// is the last write cut short by a crash: its header is incomplete, its
+// declared length runs past the end or its checksum fails with nothing
+// following it.
+func readRecords(r io.Reader, size int64, apply func(manifestRecord) error) (int64, error) {
+	br := bufio.NewReader(r)
+	var (
+		offset int64
+		header = make([]byte, recordHeaderSize)
+	)
+	for offset < size {
+		if _, err := io.ReadFull(br, header); err != nil {
+			return offset, nil
+		}
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if length > maxRecordSize {
+			// No record is ever this large, the length itself is damaged
+			return offset, corruptRecord(offset, "has length %d", length)
+		}
+		end := offset + recordHeaderSize + length
+		if end > size {
+			return offset, nil
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return offset, nil
+		}
+		var rec manifestRecord
+		if crc32.ChecksumIEEE(payload) != checksum || json.Unmarshal(payload, &rec) != nil {
+			if end == size {
+				return offset, nil
+			}
+			return offset, corruptRecord(offset, "fails its checksum")
+		}
+		if err := apply(rec); err != nil {
+			return offset, err
+		}
+		offset = end
+	}
+	return offset, nil
+}
+
+// corruptRecord describes damage to the record at offset that can't be a
+// torn write, which is never repaired automatically since every record after
+// it would be lost.
+func corruptRecord(offset int64, problem string, extras ...any) error {
+	return fmt.Errorf("%w; Record at offset %d %s, truncate the manifest there or restore it from a backup and run fsck",
+		errCorruptManifest, int64(manifestHeaderSize)+offset, fmt.Sprintf(problem, extras...))
+}
+
+// readLegacyRecords replays the text manifest written before records were
+// framed.
+func readLegacyRecords(r io.Reader, apply func(manifestRecord) error) error {
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		text := scanner.Text()
+		if text == "" {
+			continue
+		}
+		var (
+			action string
+			id     string
+			js     []byte
+			sf     storedFile
+		)
+		_, err := fmt.Sscanf(text, "%s %s %s", &action, &id, &js)
+		if err != nil {
+			continue
+		}
+
+		rec := manifestRecord{Action: action, ID: id}
+		if action == "ADD" {
+			if err := json.Unmarshal(js, &sf); err != nil {
+				return fmt.Errorf("File is corrupt '%s'; Attempting to parse '%s'", err.Error(), js)
+			}
+			rec.File = &sf
+		}
+		if err := apply(rec); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// loadManifest replays the manifest at filepath through apply. It returns
+// true when the manifest is in the legacy format and needs rewriting.
+func loadManifest(filepath string, apply func(manifestRecord) error) (legacy bool, err error) {
+	f, err := os.OpenFile(filepath, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() == 0 {
+		return false, os.WriteFile(filepath, manifestHeader(), 0600)
+	}
+
+	header := make([]byte, manifestHeaderSize)
+	n, _ := io.ReadFull(f, header)
+	if n < len(manifestMagic) || !bytes.Equal(header[:len(manifestMagic)], []byte(manifestMagic)) {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		return true, readLegacyRecords(f, apply)
+	}
+	if n < manifestHeaderSize {
+		// Crashed while writing the header of a fresh manifest
+		return false, os.WriteFile(filepath, manifestHeader(), 0600)
+	}
+	if version := binary.BigEndian.Uint32(header[len(manifestMagic):]); version != manifestVersion {
+		return false, fmt.Errorf("%w %d", errUnsupportedManifest, version)
+	}
+
+	size := info.Size() - int64(manifestHeaderSize)
+	end, err := readRecords(f, size, apply)
+	if err != nil {
+		return false, err
+	}
+	if end < size {
+		log.Printf("Truncating torn record at the end of '%s' (%d bytes)\n", filepath, size-end)
+		return false, os.Truncate(filepath, int64(manifestHeaderSize)+end)
+	}
+	return false, nil
+}
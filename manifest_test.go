@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateLegacyManifest(t *testing.T) {
+	t.Parallel()
+	storageDir := t.TempDir()
+	manifestPath := path.Join(storageDir, dbFileName)
+
+	require.NoError(t, os.WriteFile(manifestPath, []byte(`
+ADD 739375fe-ac9d-41e8-9360-357c7575d866 {"id":"739375fe-ac9d-41e8-9360-357c7575d866","path":"/tmp/a"}
+ADD 5d6bdf4b-7e0e-4a4b-9d0e-5a7f4a4c8c0e {"id":"5d6bdf4b-7e0e-4a4b-9d0e-5a7f4a4c8c0e","path":"/tmp/b"}
+DEL 5d6bdf4b-7e0e-4a4b-9d0e-5a7f4a4c8c0e {}`), 0600))
+
+	store, err := NewStore(storageDir)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	b, err := os.ReadFile(manifestPath)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(b, manifestHeader()))
+
+	reloaded, err := NewStore(storageDir)
+	require.NoError(t, err)
+	defer reloaded.Close()
+	require.Len(t, reloaded.storedFiles, 1)
+	assert.Equal(t, "/tmp/a", reloaded.storedFiles["739375fe-ac9d-41e8-9360-357c7575d866"].Path)
+}
+
+func TestTornManifestRecovery(t *testing.T) {
+	t.Parallel()
+
+	setup := func(t *testing.T) (string, *storedFile, int64) {
+		storageDir := t.TempDir()
+		store, err := NewStore(storageDir, WithCompaction(-1, 0))
+		require.NoError(t, err)
+		sf, err := store.CreateFile(fname(t, storageDir), strings.NewReader("1"))
+		require.NoError(t, err)
+		require.NoError(t, store.Close())
+		info, err := os.Stat(store.manifestPath())
+		require.NoError(t, err)
+		return storageDir, sf, info.Size()
+	}
+
+	appendBytes := func(t *testing.T, storageDir string, b []byte) {
+		f, err := os.OpenFile(path.Join(storageDir, dbFileName), os.O_WRONLY|os.O_APPEND, 0600)
+		require.NoError(t, err)
+		defer f.Close()
+		_, err = f.Write(b)
+		require.NoError(t, err)
+	}
+
+	t.Run("partial record", func(t *testing.T) {
+		storageDir, sf, size := setup(t)
+		appendBytes(t, storageDir, encodeRecord(manifestRecord{Action: "DEL", ID: sf.ID})[:10])
+
+		store, err := NewStore(storageDir)
+		require.NoError(t, err)
+		defer store.Close()
+		_, err = store.GetFileMetadata(sf.ID)
+		assert.NoError(t, err)
+
+		info, err := os.Stat(store.manifestPath())
+		require.NoError(t, err)
+		assert.Equal(t, size, info.Size())
+	})
+
+	t.Run("bad checksum on last record", func(t *testing.T) {
+		storageDir, sf, size := setup(t)
+		rec := encodeRecord(manifestRecord{Action: "DEL", ID: sf.ID})
+		rec[len(rec)-1] ^= 0xff
+		appendBytes(t, storageDir, rec)
+
+		store, err := NewStore(storageDir)
+		require.NoError(t, err)
+		defer store.Close()
+		_, err = store.GetFileMetadata(sf.ID)
+		assert.NoError(t, err)
+
+		info, err := os.Stat(store.manifestPath())
+		require.NoError(t, err)
+		assert.Equal(t, size, info.Size())
+	})
+
+	t.Run("bad checksum before the tail", func(t *testing.T) {
+		storageDir, sf, _ := setup(t)
+		rec := encodeRecord(manifestRecord{Action: "DEL", ID: sf.ID})
+		rec[len(rec)-1] ^= 0xff
+		appendBytes(t, storageDir, rec)
+		appendBytes(t, storageDir, encodeRecord(manifestRecord{Action: "DEL", ID: sf.ID}))
+
+		_, err := NewStore(storageDir)
+		assert.ErrorIs(t, err, errCorruptManifest)
+	})
+
+	t.Run("damaged length before the tail", func(t *testing.T) {
+		storageDir, sf, size := setup(t)
+		rec := encodeRecord(manifestRecord{Action: "DEL", ID: sf.ID})
+		binary.BigEndian.PutUint32(rec[0:4], maxRecordSize+1)
+		appendBytes(t, storageDir, rec)
+		appendBytes(t, storageDir, encodeRecord(manifestRecord{Action: "DEL", ID: sf.ID}))
+
+		_, err := NewStore(storageDir)
+		assert.ErrorIs(t, err, errCorruptManifest)
+		// Nothing is dropped from a manifest that failed to load
+		info, err := os.Stat(path.Join(storageDir, dbFileName))
+		require.NoError(t, err)
+		assert.Greater(t, info.Size(), size)
+	})
+}
+
+func TestUnsupportedManifestVersion(t *testing.T) {
+	t.Parallel()
+	storageDir := t.TempDir()
+	header := manifestHeader()
+	binary.BigEndian.PutUint32(header[len(manifestMagic):], manifestVersion+1)
+	require.NoError(t, os.WriteFile(path.Join(storageDir, dbFileName), header, 0600))
+
+	_, err := NewStore(storageDir)
+	assert.ErrorIs(t, err, errUnsupportedManifest)
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Multipart uploads are staged in .uploads/<upload id>/ inside the data
+// directory, one file per part next to a sidecar holding its MD5, until they
+// are completed into a regular object or aborted. Nothing about them goes
+// into the manifest, the staging directory is the state.
+
+const (
+	uploadsDirName   = ".uploads"
+	uploadFileName   = "upload.json"
+	minPartNumber    = 1
+	maxPartNumber    = 10000
+	minPartSize      = 5 << 20
+	partFilePrefix   = "part-"
+	partETagSuffix   = ".etag"
+	partTmpSuffix    = ".tmp"
+	defaultUploadTTL = 24 * time.Hour
+)
+
+var (
+	errNoSuchUpload     = errors.New("Upload does not exist")
+	errInvalidPart      = errors.New("Part is missing or its ETag doesn't match")
+	errInvalidPartOrder = errors.New("Parts must be listed in ascending order")
+	errEntityTooSmall   = errors.New("Part is smaller than the minimum allowed size")
+	errInvalidPartNum   = errors.New("Part number must be between 1 and 10000")
+)
+
+var uploadIDPattern = regexp.MustCompile(`^[0-9a-f-]{36}$`)
+
+type multipartUpload struct {
+	UploadID string `json:"uploadId"`
+	Bucket   string `json:"bucket"`
+	// Name the object is completed under, e.g. the S3 key
+	Key       string    `json:"key"`
+	Path      string    `json:"path"`
+	Initiated time.Time `json:"initiated"`
+	// Declared when the upload was created, recorded with the object once
+	// it is completed
+	ContentType string            `json:"contentType,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+type uploadPart struct {
+	Number       int       `json:"partNumber"`
+	ETag         string    `json:"etag"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// completedPart is a part listed in a complete request.
+type completedPart struct {
+	Number int
+	ETag   string
+}
+
+func (db *Store) uploadsDir() string {
+	return filepath.Join(db.dir, uploadsDirName)
+}
+
+func (db *Store) uploadDir(uploadID string) (string, error) {
+	if !uploadIDPattern.MatchString(uploadID) {
+		return "", errNoSuchUpload
+	}
+	return filepath.Join(db.uploadsDir(), uploadID), nil
+}
+
+func partFileName(number int) string {
+	return fmt.Sprintf("%s%05d", partFilePrefix, number)
+}
+
+// CreateMultipartUpload starts staging an object that will be written to p
+// with the content type, metadata and tags set by options.
+func (db *Store) CreateMultipartUpload(bucket, key, p string, options ...FileOption) (*multipartUpload, error) {
+	var declared storedFile
+	for _, option := range options {
+		option(&declared)
+	}
+	upload := multipartUpload{
+		UploadID:    generateRandomUUID(),
+		Bucket:      bucket,
+		Key:         key,
+		Path:        p,
+		Initiated:   time.Now(),
+		ContentType: declared.ContentType,
+		Metadata:    declared.Metadata,
+		Tags:        declared.Tags,
+	}
+	dir, _ := db.uploadDir(upload.UploadID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	b, _ := json.Marshal(upload)
+	if err := os.WriteFile(filepath.Join(dir, uploadFileName), b, 0600); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func (db *Store) GetMultipartUpload(uploadID string) (*multipartUpload, error) {
+	dir, err := db.uploadDir(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(dir, uploadFileName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errNoSuchUpload
+		}
+		return nil, err
+	}
+	var upload multipartUpload
+	if err := json.Unmarshal(b, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// ListMultipartUploads lists in progress uploads, optionally only those for
+// bucket, oldest first.
+func (db *Store) ListMultipartUploads(bucket string) ([]multipartUpload, error) {
+	entries, err := os.ReadDir(db.uploadsDir())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	uploads := []multipartUpload{}
+	for _, entry := range entries {
+		upload, err := db.GetMultipartUpload(entry.Name())
+		if err != nil {
+			// Aborted or completed while listing
+			continue
+		}
+		if bucket == "" || upload.Bucket == bucket {
+			uploads = append(uploads, *upload)
+		}
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		if uploads[i].Initiated.Equal(uploads[j].Initiated) {
+			return uploads[i].UploadID < uploads[j].UploadID
+		}
+		return uploads[i].Initiated.Before(uploads[j].Initiated)
+	})
+	return uploads, nil
+}
+
+// UploadPart stages a part, replacing any earlier upload of the same number.
+func (db *Store) UploadPart(uploadID string, number int, reader io.Reader) (*uploadPart, error) {
+	if number < minPartNumber || number > maxPartNumber {
+		return nil, errInvalidPartNum
+	}
+	if _, err := db.GetMultipartUpload(uploadID); err != nil {
+		return nil, err
+	}
+	dir, _ := db.uploadDir(uploadID)
+	partPath := filepath.Join(dir, partFileName(number))
+	tmpPath := partPath + "." + generateRandomUUID() + partTmpSuffix
+
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	h := md5.New()
+	n, err := io.Copy(io.MultiWriter(f, h), reader)
+	f.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	etag := hex.EncodeToString(h.Sum(nil))
+	if err := os.WriteFile(partPath+partETagSuffix, []byte(etag), 0600); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, partPath); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	return &uploadPart{
+		Number:       number,
+		ETag:         etag,
+		Size:         n,
+		LastModified: time.Now(),
+	}, nil
+}
+
+// ListParts lists the staged parts of an upload by part number.
+func (db *Store) ListParts(uploadID string) ([]uploadPart, error) {
+	if _, err := db.GetMultipartUpload(uploadID); err != nil {
+		return nil, err
+	}
+	dir, _ := db.uploadDir(uploadID)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	parts := []uploadPart{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, partFilePrefix) || strings.Contains(name, ".") {
+			continue
+		}
+		number, err := strconv.Atoi(strings.TrimPrefix(name, partFilePrefix))
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		etag, err := os.ReadFile(filepath.Join(dir, name+partETagSuffix))
+		if err != nil {
+			continue
+		}
+		parts = append(parts, uploadPart{
+			Number:       number,
+			ETag:         string(etag),
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Number < parts[j].Number
+	})
+	return parts, nil
+}
+
+// CompleteMultipartUpload concatenates the listed parts into the object at
+// the upload's path, overwriting whatever was there, and drops the staging
+// area. The object gets the S3 style "<md5 of part md5s>-<part count>" ETag.
+func (db *Store) CompleteMultipartUpload(uploadID string, completed []completedPart) (*storedFile, bool, error) {
+	return db.completeUpload(uploadID, completed, minPartSize)
+}
+
+// completeUpload completes an upload whose parts, but the last, are at least
+// minSize bytes. It fails with errPreconditionFailed unless preconditions,
+// see WithPrecondition, hold for the object it replaces.
+func (db *Store) completeUpload(uploadID string, completed []completedPart, minSize int64, preconditions ...FileOption) (*storedFile, bool, error) {
+	upload, err := db.GetMultipartUpload(uploadID)
+	if err != nil {
+		return nil, false, err
+	}
+	staged, err := db.ListParts(uploadID)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(completed) == 0 {
+		return nil, false, errInvalidPart
+	}
+	for i := 1; i < len(completed); i++ {
+		if completed[i].Number <= completed[i-1].Number {
+			return nil, false, errInvalidPartOrder
+		}
+	}
+	byNumber := make(map[int]uploadPart, len(staged))
+	for _, part := range staged {
+		byNumber[part.Number] = part
+	}
+
+	dir, _ := db.uploadDir(uploadID)
+	var (
+		readers  []io.Reader
+		partMD5s []byte
+	)
+	for i, c := range completed {
+		part, ok := byNumber[c.Number]
+		if !ok || strings.Trim(c.ETag, `"`) != part.ETag {
+			return nil, false, errInvalidPart
+		}
+		if i < len(completed)-1 && part.Size < minSize {
+			return nil, false, errEntityTooSmall
+		}
+		sum, err := hex.DecodeString(part.ETag)
+		if err != nil {
+			return nil, false, errInvalidPart
+		}
+		partMD5s = append(partMD5s, sum...)
+
+		f, err := os.Open(filepath.Join(dir, partFileName(c.Number)))
+		if err != nil {
+			return nil, false, err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	etag := md5.Sum(partMD5s)
+	options := []FileOption{
+		WithContentType(upload.ContentType),
+		WithMetadata(upload.Metadata),
+		WithTags(upload.Tags),
+		withETag(fmt.Sprintf("%s-%d", hex.EncodeToString(etag[:]), len(completed))),
+	}
+	options = append(options, preconditions...)
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	sf, created, err := db.upsertFile(upload.Path, io.MultiReader(readers...), options...)
+	if err != nil {
+		return nil, false, err
+	}
+	os.RemoveAll(dir)
+	return sf, created, nil
+}
+
+// withETag overrides the ETag of the content being written.
+func withETag(etag string) FileOption {
+	return func(sf *storedFile) {
+		sf.ETag = etag
+	}
+}
+
+func (db *Store) AbortMultipartUpload(uploadID string) error {
+	if _, err := db.GetMultipartUpload(uploadID); err != nil {
+		return err
+	}
+	dir, _ := db.uploadDir(uploadID)
+	return os.RemoveAll(dir)
+}
+
+// AbortExpiredUploads aborts uploads started more than ttl ago and returns
+// how many there were.
+func (db *Store) AbortExpiredUploads(ttl time.Duration) (int, error) {
+	uploads, err := db.ListMultipartUploads("")
+	if err != nil {
+		return 0, err
+	}
+	aborted := 0
+	for _, upload := range uploads {
+		if time.Since(upload.Initiated) < ttl {
+			continue
+		}
+		if err := db.AbortMultipartUpload(upload.UploadID); err != nil && !errors.Is(err, errNoSuchUpload) {
+			return aborted, err
+		}
+		aborted++
+	}
+	return aborted, nil
+}
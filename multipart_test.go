@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultipartUpload(t *testing.T) {
+	t.Parallel()
+	store, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+	_, err = store.CreateBucket("uploads")
+	require.NoError(t, err)
+	p := filepath.Join(store.BucketDir("uploads"), "big.bin")
+
+	t.Run("complete", func(t *testing.T) {
+		upload, err := store.CreateMultipartUpload("uploads", "big.bin", p,
+			WithContentType("video/mp4"), WithMetadata(map[string]string{"camera": "front"}))
+		require.NoError(t, err)
+
+		first := bytes.Repeat([]byte("a"), minPartSize)
+		part1, err := store.UploadPart(upload.UploadID, 1, bytes.NewReader(first))
+		require.NoError(t, err)
+		// Uploading a part again replaces it
+		_, err = store.UploadPart(upload.UploadID, 2, strings.NewReader("stale"))
+		require.NoError(t, err)
+		part2, err := store.UploadPart(upload.UploadID, 2, strings.NewReader("tail"))
+		require.NoError(t, err)
+
+		parts, err := store.ListParts(upload.UploadID)
+		require.NoError(t, err)
+		require.Len(t, parts, 2)
+		assert.Equal(t, int64(minPartSize), parts[0].Size)
+		assert.Equal(t, part2.ETag, parts[1].ETag)
+
+		uploads, err := store.ListMultipartUploads("uploads")
+		require.NoError(t, err)
+		require.Len(t, uploads, 1)
+		assert.Equal(t, upload.UploadID, uploads[0].UploadID)
+
+		sf, created, err := store.CompleteMultipartUpload(upload.UploadID, []completedPart{
+			{Number: 1, ETag: `"` + part1.ETag + `"`},
+			{Number: 2, ETag: part2.ETag},
+		})
+		require.NoError(t, err)
+		assert.True(t, created)
+		assert.Equal(t, int64(minPartSize+4), sf.Size)
+		assert.Equal(t, "uploads", sf.Bucket)
+
+		sum1, sum2 := md5.Sum(first), md5.Sum([]byte("tail"))
+		etag := md5.Sum(append(sum1[:], sum2[:]...))
+		assert.Equal(t, fmt.Sprintf("%s-2", hex.EncodeToString(etag[:])), sf.ETag)
+		assert.Equal(t, "video/mp4", sf.ContentType)
+		assert.Equal(t, map[string]string{"camera": "front"}, sf.Metadata)
+
+		var buf bytes.Buffer
+		require.NoError(t, store.ReadFile(sf.ID, &buf))
+		assert.Equal(t, append(first, "tail"...), buf.Bytes())
+
+		_, err = store.GetMultipartUpload(upload.UploadID)
+		assert.ErrorIs(t, err, errNoSuchUpload)
+
+		// Overwriting the object drops the multipart ETag
+		require.NoError(t, store.UpdateFile(sf.ID, strings.NewReader("small"), true))
+		got, err := store.GetFileMetadata(sf.ID)
+		require.NoError(t, err)
+		assert.Empty(t, got.ETag)
+	})
+
+	t.Run("invalid parts", func(t *testing.T) {
+		upload, err := store.CreateMultipartUpload("uploads", "small.bin", filepath.Join(store.BucketDir("uploads"), "small.bin"))
+		require.NoError(t, err)
+		_, err = store.UploadPart(upload.UploadID, 0, strings.NewReader("x"))
+		assert.ErrorIs(t, err, errInvalidPartNum)
+		_, err = store.UploadPart(upload.UploadID, maxPartNumber+1, strings.NewReader("x"))
+		assert.ErrorIs(t, err, errInvalidPartNum)
+
+		part1, err := store.UploadPart(upload.UploadID, 1, strings.NewReader("one"))
+		require.NoError(t, err)
+		part2, err := store.UploadPart(upload.UploadID, 2, strings.NewReader("two"))
+		require.NoError(t, err)
+
+		_, _, err = store.CompleteMultipartUpload(upload.UploadID, nil)
+		assert.ErrorIs(t, err, errInvalidPart)
+		_, _, err = store.CompleteMultipartUpload(upload.UploadID, []completedPart{{Number: 1, ETag: "wrong"}})
+		assert.ErrorIs(t, err, errInvalidPart)
+		_, _, err = store.CompleteMultipartUpload(upload.UploadID, []completedPart{{Number: 3, ETag: part1.ETag}})
+		assert.ErrorIs(t, err, errInvalidPart)
+		_, _, err = store.CompleteMultipartUpload(upload.UploadID, []completedPart{
+			{Number: 2, ETag: part2.ETag},
+			{Number: 1, ETag: part1.ETag},
+		})
+		assert.ErrorIs(t, err, errInvalidPartOrder)
+		_, _, err = store.CompleteMultipartUpload(upload.UploadID, []completedPart{
+			{Number: 1, ETag: part1.ETag},
+			{Number: 2, ETag: part2.ETag},
+		})
+		assert.ErrorIs(t, err, errEntityTooSmall)
+
+		// A single small part is fine, only the last part may be small
+		sf, _, err := store.CompleteMultipartUpload(upload.UploadID, []completedPart{{Number: 2, ETag: part2.ETag}})
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), sf.Size)
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		upload, err := store.CreateMultipartUpload("uploads", "aborted.bin", filepath.Join(store.BucketDir("uploads"), "aborted.bin"))
+		require.NoError(t, err)
+		_, err = store.UploadPart(upload.UploadID, 1, strings.NewReader("data"))
+		require.NoError(t, err)
+		require.NoError(t, store.AbortMultipartUpload(upload.UploadID))
+		assert.ErrorIs(t, store.AbortMultipartUpload(upload.UploadID), errNoSuchUpload)
+		_, err = store.UploadPart(upload.UploadID, 1, strings.NewReader("data"))
+		assert.ErrorIs(t, err, errNoSuchUpload)
+		_, err = store.GetMultipartUpload("../../etc")
+		assert.ErrorIs(t, err, errNoSuchUpload)
+	})
+
+	t.Run("expire", func(t *testing.T) {
+		upload, err := store.CreateMultipartUpload("uploads", "old.bin", filepath.Join(store.BucketDir("uploads"), "old.bin"))
+		require.NoError(t, err)
+		aborted, err := store.AbortExpiredUploads(time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, 0, aborted)
+		aborted, err = store.AbortExpiredUploads(0)
+		require.NoError(t, err)
+		assert.Equal(t, 1, aborted)
+		_, err = store.GetMultipartUpload(upload.UploadID)
+		assert.ErrorIs(t, err, errNoSuchUpload)
+	})
+
+	t.Run("fsck ignores staged parts", func(t *testing.T) {
+		upload, err := store.CreateMultipartUpload("uploads", "staged.bin", filepath.Join(store.BucketDir("uploads"), "staged.bin"))
+		require.NoError(t, err)
+		_, err = store.UploadPart(upload.UploadID, 1, strings.NewReader("data"))
+		require.NoError(t, err)
+		report, err := store.Fsck(FsckOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, report.Orphaned)
+	})
+}
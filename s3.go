@@ -0,0 +1,1009 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 compatible, path style API. Buckets are the same buckets served under
+// /buckets/ and keys map to paths inside the bucket directory.
+
+const (
+	s3TimeFormat  = "2006-01-02T15:04:05.000Z"
+	s3MaxKeys     = 1000
+	s3XMLNS       = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3OwnerID     = "lobjectstore"
+	s3DisplayName = "lobjectstore"
+)
+
+var errMalformedChunk = errors.New("Malformed aws-chunked body")
+
+type s3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	XMLNS   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListBucketResult struct {
+	XMLName        xml.Name         `xml:"ListBucketResult"`
+	XMLNS          string           `xml:"xmlns,attr"`
+	Name           string           `xml:"Name"`
+	Prefix         string           `xml:"Prefix"`
+	Delimiter      string           `xml:"Delimiter,omitempty"`
+	MaxKeys        int              `xml:"MaxKeys"`
+	IsTruncated    bool             `xml:"IsTruncated"`
+	Contents       []s3Object       `xml:"Contents"`
+	CommonPrefixes []s3CommonPrefix `xml:"CommonPrefixes"`
+	// ListObjects (v1)
+	Marker     *string `xml:"Marker"`
+	NextMarker string  `xml:"NextMarker,omitempty"`
+	// ListObjectsV2
+	KeyCount              *int   `xml:"KeyCount"`
+	ContinuationToken     string `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string `xml:"StartAfter,omitempty"`
+}
+
+type s3CopyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+}
+
+type s3Delete struct {
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+	Quiet bool `xml:"Quiet"`
+}
+
+type s3DeletedObject struct {
+	Key string `xml:"Key"`
+}
+
+type s3DeleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name          `xml:"DeleteResult"`
+	XMLNS   string            `xml:"xmlns,attr"`
+	Deleted []s3DeletedObject `xml:"Deleted"`
+	Errors  []s3DeleteError   `xml:"Error"`
+}
+
+type s3LocationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	XMLNS   string   `xml:"xmlns,attr"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	XMLNS    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type s3CompleteMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	XMLNS    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+type s3Part struct {
+	PartNumber   int    `xml:"PartNumber"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+type s3ListPartsResult struct {
+	XMLName              xml.Name `xml:"ListPartsResult"`
+	XMLNS                string   `xml:"xmlns,attr"`
+	Bucket               string   `xml:"Bucket"`
+	Key                  string   `xml:"Key"`
+	UploadID             string   `xml:"UploadId"`
+	PartNumberMarker     int      `xml:"PartNumberMarker"`
+	NextPartNumberMarker int      `xml:"NextPartNumberMarker"`
+	MaxParts             int      `xml:"MaxParts"`
+	IsTruncated          bool     `xml:"IsTruncated"`
+	Parts                []s3Part `xml:"Part"`
+	StorageClass         string   `xml:"StorageClass"`
+}
+
+type s3Upload struct {
+	Key          string `xml:"Key"`
+	UploadID     string `xml:"UploadId"`
+	Initiated    string `xml:"Initiated"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3ListMultipartUploadsResult struct {
+	XMLName            xml.Name         `xml:"ListMultipartUploadsResult"`
+	XMLNS              string           `xml:"xmlns,attr"`
+	Bucket             string           `xml:"Bucket"`
+	KeyMarker          string           `xml:"KeyMarker"`
+	UploadIDMarker     string           `xml:"UploadIdMarker"`
+	NextKeyMarker      string           `xml:"NextKeyMarker,omitempty"`
+	NextUploadIDMarker string           `xml:"NextUploadIdMarker,omitempty"`
+	Prefix             string           `xml:"Prefix"`
+	Delimiter          string           `xml:"Delimiter,omitempty"`
+	MaxUploads         int              `xml:"MaxUploads"`
+	IsTruncated        bool             `xml:"IsTruncated"`
+	Uploads            []s3Upload       `xml:"Upload"`
+	CommonPrefixes     []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+func (a *api) S3(w http.ResponseWriter, r *http.Request) {
+	if !a.s3Authenticate(w, r) {
+		return
+	}
+	bucketName, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucketName == "" {
+		if r.Method != http.MethodGet {
+			s3WriteError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+			return
+		}
+		a.S3ListBuckets(w, r)
+		return
+	}
+	if key == "" {
+		a.S3Bucket(w, r, bucketName)
+		return
+	}
+
+	if _, err := a.store.GetBucket(bucketName); err != nil {
+		s3WriteError(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+		return
+	}
+	p, ok := a.keyPath(bucketName, key)
+	if !ok {
+		s3WriteError(w, r, http.StatusBadRequest, "InvalidArgument", "Unsupported object key.")
+		return
+	}
+	query := r.URL.Query()
+	if query.Has("uploadId") {
+		a.S3MultipartUpload(w, r, bucketName, key)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		a.S3GetObject(w, r, p)
+	case http.MethodPut:
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			a.S3CopyObject(w, r, p)
+			return
+		}
+		a.S3PutObject(w, r, p)
+	case http.MethodPost:
+		if !query.Has("uploads") {
+			s3WriteError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+			return
+		}
+		a.S3CreateMultipartUpload(w, r, bucketName, key, p)
+	case http.MethodDelete:
+		a.S3DeleteObject(w, r, p)
+	default:
+		s3WriteError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+	}
+}
+
+// s3Authenticate verifies the SigV4 signature when credentials are
+// configured, writing the S3 error and returning false when it doesn't hold.
+func (a *api) s3Authenticate(w http.ResponseWriter, r *http.Request) bool {
+	if len(a.s3Credentials) == 0 {
+		return true
+	}
+	s, err := verifySigV4(r, a.s3Credentials, time.Now())
+	if err != nil {
+		var sigErr *sigV4Error
+		if errors.As(err, &sigErr) {
+			s3WriteError(w, r, sigErr.status, sigErr.code, sigErr.message)
+			return false
+		}
+		s3InternalError(err, w, r)
+		return false
+	}
+	if isSHA256Hex(s.PayloadHash) {
+		r.Body = io.NopCloser(newSHA256VerifyingReader(r.Body, s.PayloadHash))
+	}
+	return true
+}
+
+func (a *api) S3ListBuckets(w http.ResponseWriter, r *http.Request) {
+	result := s3ListAllMyBucketsResult{
+		XMLNS:   s3XMLNS,
+		Owner:   s3Owner{ID: s3OwnerID, DisplayName: s3DisplayName},
+		Buckets: []s3Bucket{},
+	}
+	for _, b := range a.store.ListBuckets() {
+		result.Buckets = append(result.Buckets, s3Bucket{
+			Name:         b.Name,
+			CreationDate: b.Created.UTC().Format(s3TimeFormat),
+		})
+	}
+	s3WriteXML(w, http.StatusOK, result)
+}
+
+func (a *api) S3Bucket(w http.ResponseWriter, r *http.Request, name string) {
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodPut:
+		if _, err := a.store.CreateBucket(name); err != nil {
+			if errors.Is(err, errInvalidBucketName) {
+				s3WriteError(w, r, http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid.")
+				return
+			}
+			if errors.Is(err, errBucketExist) {
+				s3WriteError(w, r, http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it.")
+				return
+			}
+			s3InternalError(err, w, r)
+			return
+		}
+		w.Header().Set("Location", "/"+name)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		if _, err := a.store.GetBucket(name); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		if err := a.store.DeleteBucket(name, false); err != nil {
+			if errors.Is(err, errBucketNotExist) {
+				s3WriteError(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+				return
+			}
+			if errors.Is(err, errBucketNotEmpty) {
+				s3WriteError(w, r, http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty.")
+				return
+			}
+			s3InternalError(err, w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		if _, err := a.store.GetBucket(name); err != nil {
+			s3WriteError(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+			return
+		}
+		if query.Has("location") {
+			s3WriteXML(w, http.StatusOK, s3LocationConstraint{XMLNS: s3XMLNS})
+			return
+		}
+		if query.Has("uploads") {
+			a.S3ListMultipartUploads(w, r, name)
+			return
+		}
+		a.S3ListObjects(w, r, name)
+	case http.MethodPost:
+		if !query.Has("delete") {
+			s3WriteError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+			return
+		}
+		if _, err := a.store.GetBucket(name); err != nil {
+			s3WriteError(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+			return
+		}
+		a.S3DeleteObjects(w, r, name)
+	default:
+		s3WriteError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+	}
+}
+
+// S3ListObjects serves both ListObjects and ListObjectsV2 (list-type=2).
+func (a *api) S3ListObjects(w http.ResponseWriter, r *http.Request, bucketName string) {
+	query := r.URL.Query()
+	maxKeys := s3MaxKeys
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s3WriteError(w, r, http.StatusBadRequest, "InvalidArgument", "max-keys must be a non negative integer.")
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	files, err := a.store.ListFiles()
+	if err != nil {
+		s3InternalError(err, w, r)
+		return
+	}
+	byKey := make(map[string]storedFile)
+	keys := make([]string, 0, len(files))
+	for _, sf := range files {
+		if sf.Bucket != bucketName {
+			continue
+		}
+		key, ok := a.objectKey(sf)
+		if !ok {
+			continue
+		}
+		byKey[key] = sf
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	v2 := query.Get("list-type") == "2"
+	result := s3ListBucketResult{
+		XMLNS:          s3XMLNS,
+		Name:           bucketName,
+		Prefix:         query.Get("prefix"),
+		Delimiter:      query.Get("delimiter"),
+		MaxKeys:        maxKeys,
+		Contents:       []s3Object{},
+		CommonPrefixes: []s3CommonPrefix{},
+	}
+	marker := query.Get("marker")
+	if v2 {
+		result.StartAfter = query.Get("start-after")
+		result.ContinuationToken = query.Get("continuation-token")
+		marker = result.StartAfter
+		if result.ContinuationToken != "" {
+			decoded, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+			if err != nil {
+				s3WriteError(w, r, http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect.")
+				return
+			}
+			marker = string(decoded)
+		}
+	} else {
+		result.Marker = &marker
+	}
+
+	listing := listKeys(keys, result.Prefix, result.Delimiter, marker, maxKeys)
+	for _, key := range listing.Keys {
+		sf := byKey[key]
+		result.Contents = append(result.Contents, s3Object{
+			Key:          key,
+			LastModified: sf.lastModified().UTC().Format(s3TimeFormat),
+			ETag:         objectETag(&sf),
+			Size:         sf.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+	for _, prefix := range listing.CommonPrefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: prefix})
+	}
+	result.IsTruncated = listing.Truncated
+	if v2 {
+		count := len(listing.Keys) + len(listing.CommonPrefixes)
+		result.KeyCount = &count
+		if listing.Truncated {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(listing.NextMarker))
+		}
+	} else if listing.Truncated && result.Delimiter != "" {
+		result.NextMarker = listing.NextMarker
+	}
+	s3WriteXML(w, http.StatusOK, result)
+}
+
+func (a *api) S3GetObject(w http.ResponseWriter, r *http.Request, p string) {
+	sf, err := a.store.GetFileByPath(p)
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			s3WriteError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		s3InternalError(err, w, r)
+		return
+	}
+	s3ObjectHeaders(w.Header(), sf)
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	f, sf, err := a.store.OpenFile(sf.ID)
+	if err != nil {
+		if errors.Is(err, errNotExist) || errors.Is(err, os.ErrNotExist) {
+			s3WriteError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		s3InternalError(err, w, r)
+		return
+	}
+	defer f.Close()
+	serveObject(w, r, f, sf)
+}
+
+func (a *api) S3PutObject(w http.ResponseWriter, r *http.Request, p string) {
+	options, err := headerFileOptions(r.Header, s3MetadataHeaderPrefix, "X-Amz-Tagging")
+	if err != nil {
+		s3WriteError(w, r, http.StatusBadRequest, "InvalidTag", "The tag provided was not a valid tag.")
+		return
+	}
+	expires, err := expiresOption(r.Header)
+	if err != nil {
+		s3WriteError(w, r, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+	options = append(options, expires)
+	options = append(options, WithContentType(r.Header.Get("Content-Type")))
+	sf, created, err := a.store.UpsertFile(p, s3Body(r), options...)
+	if err != nil {
+		s3StoreError(err, w, r)
+		return
+	}
+	if created {
+		a.publishCreated(sf.ID)
+	}
+	w.Header().Set("ETag", objectETag(sf))
+	if sf.VersionID != "" {
+		w.Header().Set("X-Amz-Version-Id", sf.VersionID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *api) S3CopyObject(w http.ResponseWriter, r *http.Request, dest string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		s3WriteError(w, r, http.StatusBadRequest, "InvalidArgument", "Copy Source must mention the source bucket and key: sourcebucket/sourcekey.")
+		return
+	}
+	source, _, _ = strings.Cut(source, "?")
+	sourceBucket, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	if _, err := a.store.GetBucket(sourceBucket); err != nil {
+		s3WriteError(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+		return
+	}
+	sourcePath, ok := a.keyPath(sourceBucket, sourceKey)
+	if !ok {
+		s3WriteError(w, r, http.StatusBadRequest, "InvalidArgument", "Copy Source must mention the source bucket and key: sourcebucket/sourcekey.")
+		return
+	}
+	sf, err := a.store.GetFileByPath(sourcePath)
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			s3WriteError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		s3InternalError(err, w, r)
+		return
+	}
+
+	_, err = a.store.GetFileByPath(dest)
+	created := errors.Is(err, errNotExist)
+	copied, err := a.store.CopyFileTo(sf.ID, dest)
+	if err != nil {
+		s3StoreError(err, w, r)
+		return
+	}
+	if created {
+		a.publishCreated(copied.ID)
+	}
+	s3WriteXML(w, http.StatusOK, s3CopyObjectResult{
+		LastModified: time.Now().UTC().Format(s3TimeFormat),
+		ETag:         objectETag(copied),
+	})
+}
+
+func (a *api) S3DeleteObject(w http.ResponseWriter, r *http.Request, p string) {
+	if err := a.deleteByPath(p, bypassOptions(r.Header, s3BypassGovernanceHeader)...); err != nil {
+		s3StoreError(err, w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) S3DeleteObjects(w http.ResponseWriter, r *http.Request, bucketName string) {
+	var req s3Delete
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		s3WriteError(w, r, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema.")
+		return
+	}
+	result := s3DeleteResult{XMLNS: s3XMLNS}
+	for _, obj := range req.Objects {
+		p, ok := a.keyPath(bucketName, obj.Key)
+		if !ok {
+			result.Errors = append(result.Errors, s3DeleteError{Key: obj.Key, Code: "InvalidArgument", Message: "Unsupported object key."})
+			continue
+		}
+		if err := a.deleteByPath(p, bypassOptions(r.Header, s3BypassGovernanceHeader)...); err != nil {
+			code := "InternalError"
+			if errors.Is(err, errLocked) {
+				code = "AccessDenied"
+			}
+			result.Errors = append(result.Errors, s3DeleteError{Key: obj.Key, Code: code, Message: err.Error()})
+			continue
+		}
+		if !req.Quiet {
+			result.Deleted = append(result.Deleted, s3DeletedObject{Key: obj.Key})
+		}
+	}
+	s3WriteXML(w, http.StatusOK, result)
+}
+
+func (a *api) S3CreateMultipartUpload(w http.ResponseWriter, r *http.Request, bucketName, key, p string) {
+	options, err := headerFileOptions(r.Header, s3MetadataHeaderPrefix, "X-Amz-Tagging")
+	if err != nil {
+		s3WriteError(w, r, http.StatusBadRequest, "InvalidTag", "The tag provided was not a valid tag.")
+		return
+	}
+	options = append(options, WithContentType(r.Header.Get("Content-Type")))
+	upload, err := a.store.CreateMultipartUpload(bucketName, key, p, options...)
+	if err != nil {
+		s3InternalError(err, w, r)
+		return
+	}
+	s3WriteXML(w, http.StatusOK, s3InitiateMultipartUploadResult{
+		XMLNS:    s3XMLNS,
+		Bucket:   bucketName,
+		Key:      key,
+		UploadID: upload.UploadID,
+	})
+}
+
+// S3MultipartUpload serves the requests addressing an upload with ?uploadId,
+// uploading, listing and completing parts or aborting the upload.
+func (a *api) S3MultipartUpload(w http.ResponseWriter, r *http.Request, bucketName, key string) {
+	query := r.URL.Query()
+	upload, err := a.store.GetMultipartUpload(query.Get("uploadId"))
+	if err == nil && (upload.Bucket != bucketName || upload.Key != key) {
+		err = errNoSuchUpload
+	}
+	if err != nil {
+		s3StoreError(err, w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		// Not a number is out of range too
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		part, err := a.store.UploadPart(upload.UploadID, number, s3Body(r))
+		if err != nil {
+			s3StoreError(err, w, r)
+			return
+		}
+		w.Header().Set("ETag", `"`+part.ETag+`"`)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPost:
+		var req s3CompleteMultipartUpload
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			s3WriteError(w, r, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema.")
+			return
+		}
+		parts := make([]completedPart, len(req.Parts))
+		for i, part := range req.Parts {
+			parts[i] = completedPart{Number: part.PartNumber, ETag: part.ETag}
+		}
+		sf, created, err := a.store.CompleteMultipartUpload(upload.UploadID, parts)
+		if err != nil {
+			s3StoreError(err, w, r)
+			return
+		}
+		if created {
+			a.publishCreated(sf.ID)
+		}
+		s3WriteXML(w, http.StatusOK, s3CompleteMultipartUploadResult{
+			XMLNS:    s3XMLNS,
+			Location: "/" + bucketName + "/" + key,
+			Bucket:   bucketName,
+			Key:      key,
+			ETag:     objectETag(sf),
+		})
+	case http.MethodDelete:
+		if err := a.store.AbortMultipartUpload(upload.UploadID); err != nil {
+			s3StoreError(err, w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		a.S3ListParts(w, r, upload)
+	default:
+		s3WriteError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+	}
+}
+
+func (a *api) S3ListParts(w http.ResponseWriter, r *http.Request, upload *multipartUpload) {
+	query := r.URL.Query()
+	maxParts := s3MaxKeys
+	if v := query.Get("max-parts"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s3WriteError(w, r, http.StatusBadRequest, "InvalidArgument", "max-parts must be a non negative integer.")
+			return
+		}
+		if n < maxParts {
+			maxParts = n
+		}
+	}
+	marker := 0
+	if v := query.Get("part-number-marker"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s3WriteError(w, r, http.StatusBadRequest, "InvalidArgument", "part-number-marker must be a non negative integer.")
+			return
+		}
+		marker = n
+	}
+
+	parts, err := a.store.ListParts(upload.UploadID)
+	if err != nil {
+		s3StoreError(err, w, r)
+		return
+	}
+	result := s3ListPartsResult{
+		XMLNS:            s3XMLNS,
+		Bucket:           upload.Bucket,
+		Key:              upload.Key,
+		UploadID:         upload.UploadID,
+		PartNumberMarker: marker,
+		MaxParts:         maxParts,
+		Parts:            []s3Part{},
+		StorageClass:     "STANDARD",
+	}
+	for _, part := range parts {
+		if part.Number <= marker {
+			continue
+		}
+		if len(result.Parts) >= maxParts {
+			result.IsTruncated = true
+			break
+		}
+		result.Parts = append(result.Parts, s3Part{
+			PartNumber:   part.Number,
+			LastModified: part.LastModified.UTC().Format(s3TimeFormat),
+			ETag:         `"` + part.ETag + `"`,
+			Size:         part.Size,
+		})
+		result.NextPartNumberMarker = part.Number
+	}
+	s3WriteXML(w, http.StatusOK, result)
+}
+
+// S3ListMultipartUploads lists the in progress uploads of a bucket, by key
+// then initiation time.
+func (a *api) S3ListMultipartUploads(w http.ResponseWriter, r *http.Request, bucketName string) {
+	query := r.URL.Query()
+	maxUploads := s3MaxKeys
+	if v := query.Get("max-uploads"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s3WriteError(w, r, http.StatusBadRequest, "InvalidArgument", "max-uploads must be a non negative integer.")
+			return
+		}
+		if n < maxUploads {
+			maxUploads = n
+		}
+	}
+	uploads, err := a.store.ListMultipartUploads(bucketName)
+	if err != nil {
+		s3InternalError(err, w, r)
+		return
+	}
+	sort.SliceStable(uploads, func(i, j int) bool {
+		return uploads[i].Key < uploads[j].Key
+	})
+
+	result := s3ListMultipartUploadsResult{
+		XMLNS:          s3XMLNS,
+		Bucket:         bucketName,
+		KeyMarker:      query.Get("key-marker"),
+		UploadIDMarker: query.Get("upload-id-marker"),
+		Prefix:         query.Get("prefix"),
+		Delimiter:      query.Get("delimiter"),
+		MaxUploads:     maxUploads,
+		Uploads:        []s3Upload{},
+		CommonPrefixes: []s3CommonPrefix{},
+	}
+	// Past the key marker, or past the upload id marker within that key
+	skipping := result.KeyMarker != ""
+	var lastPrefix string
+	for _, upload := range uploads {
+		if skipping {
+			if upload.Key < result.KeyMarker {
+				continue
+			}
+			if upload.Key == result.KeyMarker {
+				if result.UploadIDMarker == "" || upload.UploadID != result.UploadIDMarker {
+					continue
+				}
+				skipping = false
+				continue
+			}
+			skipping = false
+		}
+		if !strings.HasPrefix(upload.Key, result.Prefix) {
+			continue
+		}
+		commonPrefix := ""
+		if result.Delimiter != "" {
+			if i := strings.Index(upload.Key[len(result.Prefix):], result.Delimiter); i >= 0 {
+				commonPrefix = upload.Key[:len(result.Prefix)+i+len(result.Delimiter)]
+				if commonPrefix == lastPrefix || commonPrefix == result.KeyMarker {
+					continue
+				}
+			}
+		}
+		if len(result.Uploads)+len(result.CommonPrefixes) >= maxUploads {
+			result.IsTruncated = true
+			break
+		}
+		if commonPrefix != "" {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: commonPrefix})
+			lastPrefix = commonPrefix
+			result.NextKeyMarker = commonPrefix
+			result.NextUploadIDMarker = ""
+			continue
+		}
+		result.Uploads = append(result.Uploads, s3Upload{
+			Key:          upload.Key,
+			UploadID:     upload.UploadID,
+			Initiated:    upload.Initiated.UTC().Format(s3TimeFormat),
+			StorageClass: "STANDARD",
+		})
+		result.NextKeyMarker = upload.Key
+		result.NextUploadIDMarker = upload.UploadID
+	}
+	if !result.IsTruncated {
+		result.NextKeyMarker = ""
+		result.NextUploadIDMarker = ""
+	}
+	s3WriteXML(w, http.StatusOK, result)
+}
+
+// deleteByPath deletes the object at p, deleting something that doesn't
+// exist succeeds like it does on S3.
+func (a *api) deleteByPath(p string, options ...FileOption) error {
+	sf, err := a.store.GetFileByPath(p)
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			return nil
+		}
+		return err
+	}
+	if err := a.store.DeleteFile(sf.ID, options...); err != nil {
+		if errors.Is(err, errNotExist) {
+			return nil
+		}
+		return err
+	}
+	a.publishDeleted(sf.ID)
+	return nil
+}
+
+// keyPath maps a key to its path in the bucket directory, for the APIs
+// addressing objects by bucket and key. Keys that
+// wouldn't map back to themselves, like "a/../b" or "dir/", are refused.
+func (a *api) keyPath(bucketName, key string) (string, bool) {
+	if key == "" || path.Clean(key) != key || strings.HasPrefix(key, "/") || key == ".." || strings.HasPrefix(key, "../") {
+		return "", false
+	}
+	return filepath.Join(a.store.BucketDir(bucketName), filepath.FromSlash(key)), true
+}
+
+func (a *api) objectKey(sf storedFile) (string, bool) {
+	rel, err := filepath.Rel(a.store.BucketDir(sf.Bucket), sf.Path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// objectETag returns the quoted ETag of an object, shared by all the APIs.
+func objectETag(sf *storedFile) string {
+	if sf.ETag != "" {
+		return `"` + sf.ETag + `"`
+	}
+	return `"` + sf.Checksum + `"`
+}
+
+func s3ObjectHeaders(header http.Header, sf *storedFile) {
+	header.Set("Content-Length", strconv.FormatInt(sf.Size, 10))
+	header.Set("Content-Type", sf.contentType())
+	header.Set("ETag", objectETag(sf))
+	header.Set("Last-Modified", sf.lastModified().UTC().Format(http.TimeFormat))
+	header.Set("Accept-Ranges", "bytes")
+	if sf.VersionID != "" {
+		header.Set("X-Amz-Version-Id", sf.VersionID)
+	}
+	setMetadataHeaders(header, s3MetadataHeaderPrefix, sf.Metadata)
+	if len(sf.Tags) > 0 {
+		header.Set("X-Amz-Tagging-Count", strconv.Itoa(len(sf.Tags)))
+	}
+}
+
+func s3WriteXML(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprint(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Encode(v)
+}
+
+func s3WriteError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	s3WriteXML(w, status, s3Error{
+		Code:      code,
+		Message:   message,
+		Resource:  r.URL.Path,
+		RequestID: generateRandomUUID(),
+	})
+}
+
+// s3StoreError answers with the S3 error matching an error from the store or
+// from reading the request body.
+func s3StoreError(err error, w http.ResponseWriter, r *http.Request) {
+	switch {
+	case errors.Is(err, errMalformedChunk):
+		s3WriteError(w, r, http.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header.")
+	case errors.Is(err, errContentSHA256Mismatch):
+		s3WriteError(w, r, http.StatusBadRequest, "XAmzContentSHA256Mismatch", err.Error())
+	case errors.Is(err, errNotExist):
+		s3WriteError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+	case errors.Is(err, errNoSuchUpload):
+		s3WriteError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist. The upload ID might be invalid, or the multipart upload might have been aborted or completed.")
+	case errors.Is(err, errInvalidPart):
+		s3WriteError(w, r, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found. The part might not have been uploaded, or the specified entity tag might not have matched the part's entity tag.")
+	case errors.Is(err, errInvalidPartOrder):
+		s3WriteError(w, r, http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order. Parts must be ordered by part number.")
+	case errors.Is(err, errEntityTooSmall):
+		s3WriteError(w, r, http.StatusBadRequest, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size.")
+	case errors.Is(err, errTooLarge):
+		s3WriteError(w, r, http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size.")
+	case errors.Is(err, errLocked):
+		s3WriteError(w, r, http.StatusForbidden, "AccessDenied", "Access Denied because object protected by object lock.")
+	case errors.Is(err, errInvalidPartNum):
+		s3WriteError(w, r, http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive.")
+	default:
+		s3InternalError(err, w, r)
+	}
+}
+
+// s3Body returns the request body, decoding aws-chunked when needed.
+func s3Body(r *http.Request) io.Reader {
+	if isAWSChunked(r) {
+		return newAWSChunkedReader(r.Body)
+	}
+	return r.Body
+}
+
+func s3InternalError(err error, w http.ResponseWriter, r *http.Request) {
+	log.Printf("Internal Server Error: '%s'\n", err)
+	s3WriteError(w, r, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.")
+}
+
+// isAWSChunked reports whether the body uses the aws-chunked encoding the
+// AWS SDKs use to stream payloads with trailing checksums.
+func isAWSChunked(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") ||
+		strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked")
+}
+
+// awsChunkedReader decodes an aws-chunked body, a sequence of
+//
+//	hex-size[;chunk-signature=...]\r\n<data>\r\n
+//
+// ended by a zero sized chunk and optional trailing headers.
+type awsChunkedReader struct {
+	r         *bufio.Reader
+	remaining int64
+	done      bool
+}
+
+func newAWSChunkedReader(r io.Reader) *awsChunkedReader {
+	return &awsChunkedReader{r: bufio.NewReader(r)}
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	if c.remaining == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.nextChunk(); err != nil {
+			return 0, err
+		}
+		if c.done {
+			return 0, io.EOF
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		return n, errMalformedChunk
+	}
+	if err == nil && c.remaining == 0 {
+		err = c.readCRLF()
+	}
+	return n, err
+}
+
+func (c *awsChunkedReader) nextChunk() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return errMalformedChunk
+	}
+	sizeField, _, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+	if err != nil || size < 0 {
+		return errMalformedChunk
+	}
+	if size == 0 {
+		c.done = true
+		// Trailing headers, e.g. x-amz-checksum-crc32, up to an empty line
+		for {
+			line, err := c.r.ReadString('\n')
+			if strings.TrimRight(line, "\r\n") == "" || err != nil {
+				return nil
+			}
+		}
+	}
+	c.remaining = size
+	return nil
+}
+
+func (c *awsChunkedReader) readCRLF() error {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c.r, b); err != nil || string(b) != "\r\n" {
+		return errMalformedChunk
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupS3(t *testing.T) (*Store, string) {
+	store, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	server := httptest.NewServer(NewAPI(store, []byte("testing")))
+	t.Cleanup(server.Close)
+	return store, server.URL
+}
+
+func TestS3API(t *testing.T) {
+	t.Parallel()
+	_, url := setupS3(t)
+
+	resp := doRequest(t, http.MethodPut, url+"/artifacts", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodHead, url+"/artifacts", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodPut, url+"/Invalid_Bucket", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	for _, key := range []string{"a.txt", "dir/b.txt", "dir/sub/c.txt"} {
+		resp = doRequest(t, http.MethodPut, url+"/artifacts/"+key, strings.NewReader("content of "+key))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get("ETag"))
+	}
+
+	t.Run("get object", func(t *testing.T) {
+		resp := doRequest(t, http.MethodGet, url+"/artifacts/dir/b.txt", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		b, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "content of dir/b.txt", string(b))
+		assert.Equal(t, "20", resp.Header.Get("Content-Length"))
+
+		resp = doRequest(t, http.MethodHead, url+"/artifacts/dir/b.txt", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, int64(20), resp.ContentLength)
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		resp := doRequest(t, http.MethodGet, url+"/artifacts/missing", nil)
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+		var s3Err s3Error
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&s3Err))
+		assert.Equal(t, "NoSuchKey", s3Err.Code)
+
+		resp = doRequest(t, http.MethodGet, url+"/missing/key", nil)
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&s3Err))
+		assert.Equal(t, "NoSuchBucket", s3Err.Code)
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		resp := doRequest(t, http.MethodPut, url+"/artifacts/a.txt", strings.NewReader("new"))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = doRequest(t, http.MethodGet, url+"/artifacts/a.txt", nil)
+		b, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "new", string(b))
+	})
+
+	t.Run("aws-chunked", func(t *testing.T) {
+		body := "5;chunk-signature=abc\r\nhello\r\n6;chunk-signature=def\r\n world\r\n0;chunk-signature=ghi\r\nx-amz-checksum-crc32:AAAAAA==\r\n\r\n"
+		resp := doRequest(t, http.MethodPut, url+"/artifacts/chunked", strings.NewReader(body),
+			"X-Amz-Content-Sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER",
+			"Content-Encoding", "aws-chunked")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = doRequest(t, http.MethodGet, url+"/artifacts/chunked", nil)
+		b, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "hello world", string(b))
+	})
+
+	t.Run("list objects v2", func(t *testing.T) {
+		resp := doRequest(t, http.MethodGet, url+"/artifacts?list-type=2&prefix=dir/&delimiter=/", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var result s3ListBucketResult
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&result))
+		require.Len(t, result.Contents, 1)
+		assert.Equal(t, "dir/b.txt", result.Contents[0].Key)
+		assert.Equal(t, []s3CommonPrefix{{Prefix: "dir/sub/"}}, result.CommonPrefixes)
+
+		var keys []string
+		token := ""
+		for {
+			resp := doRequest(t, http.MethodGet, url+"/artifacts?list-type=2&max-keys=1&continuation-token="+token, nil)
+			var page s3ListBucketResult
+			require.NoError(t, xml.NewDecoder(resp.Body).Decode(&page))
+			for _, obj := range page.Contents {
+				keys = append(keys, obj.Key)
+			}
+			if !page.IsTruncated {
+				break
+			}
+			token = page.NextContinuationToken
+		}
+		assert.Equal(t, []string{"a.txt", "chunked", "dir/b.txt", "dir/sub/c.txt"}, keys)
+	})
+
+	t.Run("copy object", func(t *testing.T) {
+		resp := doRequest(t, http.MethodPut, url+"/artifacts/copied.txt", nil, "X-Amz-Copy-Source", "/artifacts/dir/b.txt")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var result s3CopyObjectResult
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&result))
+		assert.NotEmpty(t, result.ETag)
+
+		resp = doRequest(t, http.MethodGet, url+"/artifacts/copied.txt", nil)
+		b, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "content of dir/b.txt", string(b))
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		resp := doRequest(t, http.MethodDelete, url+"/artifacts", nil)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		resp = doRequest(t, http.MethodDelete, url+"/artifacts/a.txt", nil)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		resp = doRequest(t, http.MethodGet, url+"/artifacts/a.txt", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		body := `<Delete><Object><Key>chunked</Key></Object><Object><Key>dir/b.txt</Key></Object><Object><Key>dir/sub/c.txt</Key></Object><Object><Key>copied.txt</Key></Object></Delete>`
+		resp = doRequest(t, http.MethodPost, url+"/artifacts?delete", strings.NewReader(body))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var result s3DeleteResult
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&result))
+		assert.Len(t, result.Deleted, 4)
+
+		resp = doRequest(t, http.MethodDelete, url+"/artifacts", nil)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	})
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	t.Parallel()
+	_, url := setupS3(t)
+	resp := doRequest(t, http.MethodPut, url+"/media", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPost, url+"/media/videos/clip.mp4?uploads", nil,
+		"Content-Type", "video/quicktime", "X-Amz-Meta-Camera", "front")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var initiated s3InitiateMultipartUploadResult
+	require.NoError(t, xml.NewDecoder(resp.Body).Decode(&initiated))
+	assert.Equal(t, "videos/clip.mp4", initiated.Key)
+	uploadID := initiated.UploadID
+	require.NotEmpty(t, uploadID)
+
+	first := strings.Repeat("a", minPartSize)
+	resp = doRequest(t, http.MethodPut, url+"/media/videos/clip.mp4?partNumber=1&uploadId="+uploadID, strings.NewReader(first))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	etag1 := resp.Header.Get("ETag")
+	resp = doRequest(t, http.MethodPut, url+"/media/videos/clip.mp4?partNumber=2&uploadId="+uploadID, strings.NewReader("end"))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	etag2 := resp.Header.Get("ETag")
+
+	t.Run("invalid part number", func(t *testing.T) {
+		resp := doRequest(t, http.MethodPut, url+"/media/videos/clip.mp4?partNumber=x&uploadId="+uploadID, strings.NewReader("x"))
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		resp := doRequest(t, http.MethodGet, url+"/media/other.mp4?uploadId="+uploadID, nil)
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+		var s3Err s3Error
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&s3Err))
+		assert.Equal(t, "NoSuchUpload", s3Err.Code)
+	})
+
+	t.Run("list parts", func(t *testing.T) {
+		resp := doRequest(t, http.MethodGet, url+"/media/videos/clip.mp4?max-parts=1&uploadId="+uploadID, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var result s3ListPartsResult
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&result))
+		require.Len(t, result.Parts, 1)
+		assert.True(t, result.IsTruncated)
+		assert.Equal(t, etag1, result.Parts[0].ETag)
+
+		resp = doRequest(t, http.MethodGet, url+"/media/videos/clip.mp4?part-number-marker=1&uploadId="+uploadID, nil)
+		var next s3ListPartsResult
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&next))
+		require.Len(t, next.Parts, 1)
+		assert.Equal(t, 2, next.Parts[0].PartNumber)
+		assert.Equal(t, int64(3), next.Parts[0].Size)
+	})
+
+	t.Run("list uploads", func(t *testing.T) {
+		resp := doRequest(t, http.MethodPost, url+"/media/notes.txt?uploads", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var other s3InitiateMultipartUploadResult
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&other))
+
+		resp = doRequest(t, http.MethodGet, url+"/media?uploads", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var result s3ListMultipartUploadsResult
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&result))
+		require.Len(t, result.Uploads, 2)
+		assert.Equal(t, "notes.txt", result.Uploads[0].Key)
+		assert.Equal(t, "videos/clip.mp4", result.Uploads[1].Key)
+
+		resp = doRequest(t, http.MethodGet, url+"/media?uploads&delimiter=/", nil)
+		var delimited s3ListMultipartUploadsResult
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&delimited))
+		require.Len(t, delimited.Uploads, 1)
+		assert.Equal(t, []s3CommonPrefix{{Prefix: "videos/"}}, delimited.CommonPrefixes)
+
+		resp = doRequest(t, http.MethodDelete, url+"/media/notes.txt?uploadId="+other.UploadID, nil)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		resp = doRequest(t, http.MethodDelete, url+"/media/notes.txt?uploadId="+other.UploadID, nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("complete", func(t *testing.T) {
+		body := `<CompleteMultipartUpload><Part><PartNumber>2</PartNumber><ETag>` + etag2 + `</ETag></Part><Part><PartNumber>1</PartNumber><ETag>` + etag1 + `</ETag></Part></CompleteMultipartUpload>`
+		resp := doRequest(t, http.MethodPost, url+"/media/videos/clip.mp4?uploadId="+uploadID, strings.NewReader(body))
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		var s3Err s3Error
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&s3Err))
+		assert.Equal(t, "InvalidPartOrder", s3Err.Code)
+
+		body = `<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>` + etag1 + `</ETag></Part><Part><PartNumber>2</PartNumber><ETag>` + etag2 + `</ETag></Part></CompleteMultipartUpload>`
+		resp = doRequest(t, http.MethodPost, url+"/media/videos/clip.mp4?uploadId="+uploadID, strings.NewReader(body))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var result s3CompleteMultipartUploadResult
+		require.NoError(t, xml.NewDecoder(resp.Body).Decode(&result))
+		assert.True(t, strings.HasSuffix(result.ETag, `-2"`))
+
+		resp = doRequest(t, http.MethodGet, url+"/media/videos/clip.mp4", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, result.ETag, resp.Header.Get("ETag"))
+		assert.Equal(t, "video/quicktime", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "front", resp.Header.Get("X-Amz-Meta-Camera"))
+		b, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, first+"end", string(b))
+
+		resp = doRequest(t, http.MethodGet, url+"/media/videos/clip.mp4?uploadId="+uploadID, nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
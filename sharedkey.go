@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Azure Storage Shared Key authorization. See
+// https://learn.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+const sharedKeyMaxSkew = 15 * time.Minute
+
+type sharedKeyError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *sharedKeyError) Error() string {
+	return e.message
+}
+
+var (
+	errSharedKeyMissing = &sharedKeyError{http.StatusForbidden, "NoAuthenticationInformation", "Server failed to authenticate the request. Please refer to the information in the www-authenticate header."}
+	errSharedKeyAccount = &sharedKeyError{http.StatusForbidden, "AuthenticationFailed", "Server failed to authenticate the request. The account does not exist."}
+	errSharedKeyMatch   = &sharedKeyError{http.StatusForbidden, "AuthenticationFailed", "Server failed to authenticate the request. Make sure the value of Authorization header is formed correctly including the signature."}
+	errSharedKeySkewed  = &sharedKeyError{http.StatusForbidden, "AuthenticationFailed", "Request date header too old or too new."}
+	errSharedKeyInvalid = &sharedKeyError{http.StatusBadRequest, "InvalidAuthenticationInfo", "Authentication information is not given in the correct format. Check the value of Authorization header."}
+)
+
+// verifySharedKey checks the request is signed for account with its key from
+// accounts, a map of account names to base64 encoded keys.
+func verifySharedKey(r *http.Request, account string, accounts map[string]string, now time.Time) error {
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return errSharedKeyMissing
+	}
+	scheme, credential, _ := strings.Cut(authorization, " ")
+	if scheme != "SharedKey" {
+		return errSharedKeyInvalid
+	}
+	name, signature, ok := strings.Cut(credential, ":")
+	if !ok || name != account {
+		return errSharedKeyInvalid
+	}
+	encodedKey, ok := accounts[account]
+	if !ok {
+		return errSharedKeyAccount
+	}
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return errSharedKeyAccount
+	}
+
+	date := r.Header.Get("X-Ms-Date")
+	if date == "" {
+		date = r.Header.Get("Date")
+	}
+	t, err := http.ParseTime(date)
+	if err != nil {
+		return errSharedKeyInvalid
+	}
+	if d := now.Sub(t); d > sharedKeyMaxSkew || d < -sharedKeyMaxSkew {
+		return errSharedKeySkewed
+	}
+
+	// Path style URLs are signed with the account in the path, repeated
+	// after the account the resource starts with
+	escapedPath := r.URL.EscapedPath()
+	for _, resource := range []string{"/" + account + escapedPath, "/" + account + strings.TrimPrefix(escapedPath, "/"+account)} {
+		expected := base64.StdEncoding.EncodeToString(hmacSHA256(key, []byte(sharedKeyStringToSign(r, resource))))
+		if hmac.Equal([]byte(expected), []byte(signature)) {
+			return nil
+		}
+	}
+	return errSharedKeyMatch
+}
+
+func sharedKeyStringToSign(r *http.Request, resource string) string {
+	// Empty rather than 0 since version 2015-02-21
+	contentLength := ""
+	if r.ContentLength > 0 {
+		contentLength = strconv.FormatInt(r.ContentLength, 10)
+	}
+	date := r.Header.Get("Date")
+	if r.Header.Get("X-Ms-Date") != "" {
+		date = ""
+	}
+	return strings.Join([]string{
+		r.Method,
+		r.Header.Get("Content-Encoding"),
+		r.Header.Get("Content-Language"),
+		contentLength,
+		r.Header.Get("Content-Md5"),
+		r.Header.Get("Content-Type"),
+		date,
+		r.Header.Get("If-Modified-Since"),
+		r.Header.Get("If-Match"),
+		r.Header.Get("If-None-Match"),
+		r.Header.Get("If-Unmodified-Since"),
+		r.Header.Get("Range"),
+		sharedKeyCanonicalHeaders(r.Header) + sharedKeyCanonicalResource(resource, r.URL.Query()),
+	}, "\n")
+}
+
+// sharedKeyCanonicalHeaders returns the x-ms- headers as sorted "name:value"
+// lines.
+func sharedKeyCanonicalHeaders(header http.Header) string {
+	var names []string
+	for name := range header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(strings.TrimSpace(strings.Join(header.Values(name), ",")))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func sharedKeyCanonicalResource(resource string, query url.Values) string {
+	var b strings.Builder
+	b.WriteString(resource)
+	params := make(map[string][]string, len(query))
+	names := make([]string, 0, len(query))
+	for name, values := range query {
+		lower := strings.ToLower(name)
+		if _, ok := params[lower]; !ok {
+			names = append(names, lower)
+		}
+		params[lower] = append(params[lower], values...)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := params[name]
+		sort.Strings(values)
+		b.WriteByte('\n')
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(values, ","))
+	}
+	return b.String()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testAzureAccounts = map[string]string{
+		"devaccount": base64.StdEncoding.EncodeToString([]byte("azure testing key")),
+	}
+	testAzureTime = time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+)
+
+// signSharedKey signs r for account the way the Azure SDKs do for path style
+// URLs, with the account repeated in the canonical resource.
+func signSharedKey(r *http.Request, account, encodedKey string, now time.Time) {
+	r.Header.Set("X-Ms-Date", now.UTC().Format(http.TimeFormat))
+	r.Header.Set("X-Ms-Version", azureVersion)
+	key, _ := base64.StdEncoding.DecodeString(encodedKey)
+	stringToSign := sharedKeyStringToSign(r, "/"+account+r.URL.EscapedPath())
+	signature := base64.StdEncoding.EncodeToString(hmacSHA256(key, []byte(stringToSign)))
+	r.Header.Set("Authorization", "SharedKey "+account+":"+signature)
+}
+
+func exampleSharedKeyRequest() *http.Request {
+	r := httptest.NewRequest(http.MethodPut, "http://localhost/devaccount/photos/cat.jpg?comp=block&blockid=YQ%3D%3D", nil)
+	r.Header.Set("Content-Type", "image/jpeg")
+	signSharedKey(r, "devaccount", testAzureAccounts["devaccount"], testAzureTime)
+	return r
+}
+
+func TestVerifySharedKey(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		require.NoError(t, verifySharedKey(exampleSharedKeyRequest(), "devaccount", testAzureAccounts, testAzureTime))
+	})
+
+	t.Run("resource without the account repeated", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost/devaccount/photos?restype=container", nil)
+		r.Header.Set("X-Ms-Date", testAzureTime.Format(http.TimeFormat))
+		key, _ := base64.StdEncoding.DecodeString(testAzureAccounts["devaccount"])
+		signature := base64.StdEncoding.EncodeToString(hmacSHA256(key, []byte(sharedKeyStringToSign(r, "/devaccount/photos"))))
+		r.Header.Set("Authorization", "SharedKey devaccount:"+signature)
+		assert.NoError(t, verifySharedKey(r, "devaccount", testAzureAccounts, testAzureTime))
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		r := exampleSharedKeyRequest()
+		r.Header.Set("Content-Type", "text/plain")
+		assert.ErrorIs(t, verifySharedKey(r, "devaccount", testAzureAccounts, testAzureTime), errSharedKeyMatch)
+		r = exampleSharedKeyRequest()
+		r.URL.RawQuery = "comp=block&blockid=Yg%3D%3D"
+		assert.ErrorIs(t, verifySharedKey(r, "devaccount", testAzureAccounts, testAzureTime), errSharedKeyMatch)
+	})
+
+	t.Run("skewed", func(t *testing.T) {
+		err := verifySharedKey(exampleSharedKeyRequest(), "devaccount", testAzureAccounts, testAzureTime.Add(time.Hour))
+		assert.ErrorIs(t, err, errSharedKeySkewed)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		r := exampleSharedKeyRequest()
+		r.Header.Del("Authorization")
+		assert.ErrorIs(t, verifySharedKey(r, "devaccount", testAzureAccounts, testAzureTime), errSharedKeyMissing)
+	})
+
+	t.Run("other account", func(t *testing.T) {
+		r := exampleSharedKeyRequest()
+		r.Header.Set("Authorization", "SharedKey someone:c2lnbmF0dXJl")
+		assert.ErrorIs(t, verifySharedKey(r, "devaccount", testAzureAccounts, testAzureTime), errSharedKeyInvalid)
+		assert.ErrorIs(t, verifySharedKey(exampleSharedKeyRequest(), "devaccount", map[string]string{}, testAzureTime), errSharedKeyAccount)
+	})
+}
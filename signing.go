@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
@@ -65,3 +66,18 @@ func generateRandomUUID() string {
 	b[8] = (b[8] & 0x3f) | 0x80
 	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 }
+
+// Namespace for IDs derived from object paths, so the same relative path
+// always maps to the same ID.
+var pathUUIDNamespace = []byte("lobjectstore:path")
+
+// generatePathUUID returns a name based (version 5 style) UUID for name.
+func generatePathUUID(name string) string {
+	h := sha1.New()
+	h.Write(pathUUIDNamespace)
+	h.Write([]byte(name))
+	b := h.Sum(nil)[:16]
+	b[6] = (b[6] & 0x0f) | 0x50
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
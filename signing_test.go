@@ -20,3 +20,11 @@ func TestSign(t *testing.T) {
 	_, err := verify(secret, b)
 	require.NoError(t, err)
 }
+
+func TestGeneratePathUUID(t *testing.T) {
+	id := generatePathUUID("fixtures/a.json")
+	require.Equal(t, id, generatePathUUID("fixtures/a.json"))
+	require.NotEqual(t, id, generatePathUUID("fixtures/b.json"))
+	require.Len(t, id, 36)
+	require.Equal(t, byte('5'), id[14])
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4, both the Authorization header flavour the SDKs use
+// for regular calls and the query string flavour used by presigned URLs. See
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	sigV4DateFormat = "20060102"
+	sigV4Terminator = "aws4_request"
+	// Allowed clock difference for signed headers
+	sigV4MaxSkew = 15 * time.Minute
+	// Longest lifetime of a presigned URL
+	sigV4MaxExpires = 7 * 24 * time.Hour
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// sigV4Error carries the S3 error code to answer a failed verification with.
+type sigV4Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *sigV4Error) Error() string {
+	return e.message
+}
+
+var (
+	errSigV4Missing = &sigV4Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errSigV4Expired = &sigV4Error{http.StatusForbidden, "AccessDenied", "Request has expired"}
+	errSigV4Skewed  = &sigV4Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the current time is too large."}
+	errSigV4Key     = &sigV4Error{http.StatusForbidden, "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records."}
+	errSigV4Match   = &sigV4Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."}
+
+	errContentSHA256Mismatch = errors.New("The provided 'x-amz-content-sha256' header does not match what was computed.")
+)
+
+func sigV4Malformed(message string) *sigV4Error {
+	return &sigV4Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", message}
+}
+
+type sigV4Request struct {
+	AccessKey     string
+	Date          string
+	Region        string
+	Service       string
+	SignedHeaders []string
+	Signature     string
+	Time          time.Time
+	PayloadHash   string
+	Presigned     bool
+	Expires       time.Duration
+}
+
+func (s *sigV4Request) scope() string {
+	return strings.Join([]string{s.Date, s.Region, s.Service, sigV4Terminator}, "/")
+}
+
+// parseSigV4 extracts the signature from the Authorization header or, for
+// presigned URLs, the query string.
+func parseSigV4(r *http.Request) (*sigV4Request, error) {
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") != "" {
+		return parseSigV4Query(query)
+	}
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return nil, errSigV4Missing
+	}
+	algorithm, fields, _ := strings.Cut(authorization, " ")
+	if algorithm != sigV4Algorithm {
+		return nil, sigV4Malformed("Unsupported authorization algorithm")
+	}
+
+	s := &sigV4Request{}
+	var credential, signedHeaders string
+	for _, field := range strings.Split(fields, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch key {
+		case "Credential":
+			credential = value
+		case "SignedHeaders":
+			signedHeaders = value
+		case "Signature":
+			s.Signature = value
+		}
+	}
+	if err := s.parseCredential(credential); err != nil {
+		return nil, err
+	}
+	if signedHeaders == "" || s.Signature == "" {
+		return nil, sigV4Malformed("The authorization header is malformed")
+	}
+	s.SignedHeaders = strings.Split(signedHeaders, ";")
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	if amzDate == "" {
+		return nil, sigV4Malformed("Missing x-amz-date header")
+	}
+	t, err := time.Parse(sigV4TimeFormat, amzDate)
+	if err != nil {
+		return nil, sigV4Malformed("Invalid x-amz-date header")
+	}
+	s.Time = t
+	s.PayloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	if s.PayloadHash == "" {
+		return nil, &sigV4Error{http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: x-amz-content-sha256"}
+	}
+	return s, nil
+}
+
+func parseSigV4Query(query url.Values) (*sigV4Request, error) {
+	if query.Get("X-Amz-Algorithm") != sigV4Algorithm {
+		return nil, sigV4Malformed("Unsupported authorization algorithm")
+	}
+	s := &sigV4Request{
+		Presigned:   true,
+		Signature:   query.Get("X-Amz-Signature"),
+		PayloadHash: unsignedPayload,
+	}
+	if err := s.parseCredential(query.Get("X-Amz-Credential")); err != nil {
+		return nil, err
+	}
+	if s.Signature == "" || query.Get("X-Amz-SignedHeaders") == "" {
+		return nil, sigV4Malformed("Query-string authentication requires the X-Amz-Signature and X-Amz-SignedHeaders parameters")
+	}
+	s.SignedHeaders = strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+	t, err := time.Parse(sigV4TimeFormat, query.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, sigV4Malformed("Invalid X-Amz-Date parameter")
+	}
+	s.Time = t
+	seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > sigV4MaxExpires {
+		return nil, sigV4Malformed("X-Amz-Expires must be between 0 and 604800 seconds")
+	}
+	s.Expires = time.Duration(seconds) * time.Second
+	if hash := query.Get("X-Amz-Content-Sha256"); hash != "" {
+		s.PayloadHash = hash
+	}
+	return s, nil
+}
+
+// parseCredential parses AKID/date/region/service/aws4_request.
+func (s *sigV4Request) parseCredential(credential string) error {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != sigV4Terminator {
+		return sigV4Malformed("The credential is malformed")
+	}
+	s.AccessKey, s.Date, s.Region, s.Service = parts[0], parts[1], parts[2], parts[3]
+	return nil
+}
+
+// verifySigV4 checks the request is signed by one of credentials, an access
+// key to secret map, and still valid at now.
+func verifySigV4(r *http.Request, credentials map[string]string, now time.Time) (*sigV4Request, error) {
+	s, err := parseSigV4(r)
+	if err != nil {
+		return nil, err
+	}
+	secret, ok := credentials[s.AccessKey]
+	if !ok {
+		return nil, errSigV4Key
+	}
+	if s.Time.Format(sigV4DateFormat) != s.Date {
+		return nil, sigV4Malformed("The credential date does not match x-amz-date")
+	}
+	if s.Presigned {
+		if now.After(s.Time.Add(s.Expires)) {
+			return nil, errSigV4Expired
+		}
+		if s.Time.After(now.Add(sigV4MaxSkew)) {
+			return nil, errSigV4Skewed
+		}
+	} else if d := now.Sub(s.Time); d > sigV4MaxSkew || d < -sigV4MaxSkew {
+		return nil, errSigV4Skewed
+	}
+
+	canonical := sigV4CanonicalRequest(r, s.SignedHeaders, s.PayloadHash)
+	stringToSign := sigV4StringToSign(s.Time.Format(sigV4TimeFormat), s.scope(), canonical)
+	key := sigV4SigningKey(secret, s.Date, s.Region, s.Service)
+	expected := hex.EncodeToString(hmacSHA256(key, []byte(stringToSign)))
+	if !hmac.Equal([]byte(expected), []byte(s.Signature)) {
+		return nil, errSigV4Match
+	}
+	return s, nil
+}
+
+func sigV4CanonicalRequest(r *http.Request, signedHeaders []string, payloadHash string) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte('\n')
+	b.WriteString(awsURIEncode(r.URL.Path, false))
+	b.WriteByte('\n')
+	b.WriteString(sigV4CanonicalQuery(r.URL.Query()))
+	b.WriteByte('\n')
+	for _, name := range signedHeaders {
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(sigV4HeaderValue(r, name))
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.WriteString(strings.Join(signedHeaders, ";"))
+	b.WriteByte('\n')
+	b.WriteString(payloadHash)
+	return b.String()
+}
+
+func sigV4CanonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for key, values := range query {
+		if key == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, awsURIEncode(key, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func sigV4HeaderValue(r *http.Request, name string) string {
+	if name == "host" {
+		return r.Host
+	}
+	values := r.Header.Values(name)
+	trimmed := make([]string, len(values))
+	for i, value := range values {
+		trimmed[i] = strings.Join(strings.Fields(value), " ")
+	}
+	return strings.Join(trimmed, ",")
+}
+
+func sigV4StringToSign(amzDate, scope, canonicalRequest string) string {
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	return strings.Join([]string{sigV4Algorithm, amzDate, scope, hex.EncodeToString(hashed[:])}, "\n")
+}
+
+func sigV4SigningKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), []byte(date))
+	key = hmacSHA256(key, []byte(region))
+	key = hmacSHA256(key, []byte(service))
+	return hmacSHA256(key, []byte(sigV4Terminator))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// awsURIEncode percent encodes everything but unreserved characters, and
+// slashes unless encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// sha256VerifyingReader fails at EOF when the content didn't hash to the
+// signed x-amz-content-sha256.
+type sha256VerifyingReader struct {
+	r        io.Reader
+	h        hash.Hash
+	expected string
+}
+
+func newSHA256VerifyingReader(r io.Reader, expected string) *sha256VerifyingReader {
+	return &sha256VerifyingReader{r: r, h: sha256.New(), expected: strings.ToLower(expected)}
+}
+
+func (v *sha256VerifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.h.Sum(nil)) != v.expected {
+		return n, errContentSHA256Mismatch
+	}
+	return n, err
+}
+
+// isSHA256Hex reports whether s is a hex encoded SHA-256, as opposed to one
+// of the UNSIGNED-PAYLOAD or STREAMING-* placeholders.
+func isSHA256Hex(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// Prefixes of the headers carrying user metadata
+	metadataHeaderPrefix      = "X-Meta-"
+	s3MetadataHeaderPrefix    = "X-Amz-Meta-"
+	azureMetadataHeaderPrefix = "X-Ms-Meta-"
+	// URL encoded tags, as in build=42&env=ci
+	tagsHeader = "X-Tags"
+)
+
+// WithMetadata records user defined metadata with an object. Overwrites
+// replace it, so it has to be sent again with every write.
+func WithMetadata(metadata map[string]string) FileOption {
+	return func(sf *storedFile) {
+		if len(metadata) > 0 {
+			sf.Metadata = metadata
+		}
+	}
+}
+
+// WithTags replaces the tags of an object. Tags outlive overwrites, unlike
+// metadata.
+func WithTags(tags map[string]string) FileOption {
+	return func(sf *storedFile) {
+		if len(tags) > 0 {
+			sf.Tags = tags
+		}
+	}
+}
+
+// FileFilter selects the objects ListFiles returns.
+type FileFilter func(*storedFile) bool
+
+// InBucket matches the objects in bucket, empty for the root of the store.
+func InBucket(bucket string) FileFilter {
+	return func(sf *storedFile) bool {
+		return sf.Bucket == bucket
+	}
+}
+
+// TaggedWith matches the objects tagged key=value, or tagged key at all when
+// value is empty.
+func TaggedWith(key, value string) FileFilter {
+	return func(sf *storedFile) bool {
+		v, ok := sf.Tags[key]
+		return ok && (value == "" || v == value)
+	}
+}
+
+// metadataFromHeader collects the user metadata sent as headers starting with
+// prefix, keys lower cased.
+func metadataFromHeader(header http.Header, prefix string) map[string]string {
+	var metadata map[string]string
+	for name, values := range header {
+		name = http.CanonicalHeaderKey(name)
+		if len(name) <= len(prefix) || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		metadata[strings.ToLower(name[len(prefix):])] = strings.Join(values, ",")
+	}
+	return metadata
+}
+
+// setMetadataHeaders writes the user metadata of an object as headers
+// starting with prefix.
+func setMetadataHeaders(header http.Header, prefix string, metadata map[string]string) {
+	for key, value := range metadata {
+		header.Set(prefix+key, value)
+	}
+}
+
+var errInvalidTags = errors.New("Invalid tags")
+
+// parseTags decodes URL encoded tags, as sent in X-Tags or x-amz-tagging.
+func parseTags(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	values, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, errInvalidTags
+	}
+	tags := make(map[string]string, len(values))
+	for key, v := range values {
+		tags[key] = v[0]
+	}
+	return tags, validateTags(tags)
+}
+
+// formatTags URL encodes tags, sorted by key.
+func formatTags(tags map[string]string) string {
+	values := make(url.Values, len(tags))
+	for key, value := range tags {
+		values.Set(key, value)
+	}
+	return values.Encode()
+}
+
+func validateTags(tags map[string]string) error {
+	for key := range tags {
+		if key == "" {
+			return errInvalidTags
+		}
+	}
+	return nil
+}
+
+// ListFiles returns the objects matching all of filters.
+func (db *Store) ListFiles(filters ...FileFilter) ([]storedFile, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+	if db.storedFiles == nil {
+		return nil, errNotInitialized
+	}
+	results := make([]storedFile, 0, len(db.storedFiles))
+next:
+	for _, sf := range db.storedFiles {
+		for _, filter := range filters {
+			if !filter(&sf) {
+				continue next
+			}
+		}
+		results = append(results, sf)
+	}
+	return results, nil
+}
+
+// listFilters turns the bucket of a request and its tag query parameters,
+// key=value or just key, into filters for ListFiles.
+func listFilters(r *http.Request) []FileFilter {
+	var filters []FileFilter
+	if bucket := requestBucket(r); bucket != "" {
+		filters = append(filters, InBucket(bucket))
+	}
+	for _, tag := range r.URL.Query()["tag"] {
+		key, value, _ := strings.Cut(tag, "=")
+		filters = append(filters, TaggedWith(key, value))
+	}
+	return filters
+}
+
+// ObjectTags reads the tags of an object on GET, replaces them with the JSON
+// object sent on PUT and removes them on DELETE.
+func (a *api) ObjectTags(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/objects/"), "/tags")
+	if id == "" || !a.inBucket(r, id) {
+		http.NotFound(w, r)
+		return
+	}
+	var (
+		sf  *storedFile
+		err error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		sf, err = a.store.GetFileMetadata(id)
+	case http.MethodPut:
+		var tags map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&tags); err != nil {
+			badRequest(w, r, "Malformed tags due to: '%s'", err)
+			return
+		}
+		if err := validateTags(tags); err != nil {
+			badRequest(w, r, "Tag keys can't be empty")
+			return
+		}
+		sf, err = a.store.UpdateMetadata(id, func(sf *storedFile) {
+			sf.Tags = tags
+		})
+	case http.MethodDelete:
+		sf, err = a.store.UpdateMetadata(id, func(sf *storedFile) {
+			sf.Tags = nil
+		})
+	default:
+		methodNotAllowed(w, r)
+		return
+	}
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		internalError(err, w, r)
+		return
+	}
+	tags := sf.Tags
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	w.Header().Add("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(tags)
+}
+
+// headerFileOptions returns options recording the user metadata sent as
+// headers starting with metadataPrefix and the tags sent in taggingHeader.
+func headerFileOptions(header http.Header, metadataPrefix, taggingHeader string) ([]FileOption, error) {
+	tags, err := parseTags(header.Get(taggingHeader))
+	if err != nil {
+		return nil, err
+	}
+	return []FileOption{WithMetadata(metadataFromHeader(header, metadataPrefix)), WithTags(tags)}, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataAndTags(t *testing.T) {
+	t.Parallel()
+	store, url := setupS3(t)
+
+	upload := func(name string, headers ...string) string {
+		headers = append(headers, "X-Filename", name)
+		resp := doRequest(t, http.MethodPost, url+"/objects/", strings.NewReader(name), headers...)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var created CreateObjectResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+		return created.ID
+	}
+	list := func(query string) []string {
+		resp := doRequest(t, http.MethodGet, url+"/objects/?"+query, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var files []storedFile
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&files))
+		var names []string
+		for _, sf := range files {
+			names = append(names, sf.FileName)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	first := upload("first", "X-Meta-Build-Id", "42", "X-Tags", "build=42&env=ci")
+	upload("second", "X-Tags", "build=43&env=ci")
+	upload("third")
+
+	resp := doRequest(t, http.MethodHead, url+"/objects/"+first, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "42", resp.Header.Get("X-Meta-Build-Id"))
+	assert.Equal(t, "build=42&env=ci", resp.Header.Get("X-Tags"))
+
+	assert.Equal(t, []string{"first", "second"}, list("tag=env=ci"))
+	assert.Equal(t, []string{"first"}, list("tag=env=ci&tag=build=42"))
+	assert.Equal(t, []string{"second"}, list("tag=build=43"))
+	assert.Empty(t, list("tag=missing"))
+
+	t.Run("tags endpoint", func(t *testing.T) {
+		resp := doRequest(t, http.MethodPut, url+"/objects/"+first+"/tags", strings.NewReader(`{"release": "1.0"}`))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = doRequest(t, http.MethodGet, url+"/objects/"+first+"/tags", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var tags map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&tags))
+		assert.Equal(t, map[string]string{"release": "1.0"}, tags)
+		assert.Equal(t, []string{"first"}, list("tag=release"))
+
+		resp = doRequest(t, http.MethodPut, url+"/objects/"+first+"/tags", strings.NewReader(`{"": "x"}`))
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		resp = doRequest(t, http.MethodPut, url+"/objects/missing/tags", strings.NewReader(`{}`))
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		resp = doRequest(t, http.MethodDelete, url+"/objects/"+first+"/tags", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, list("tag=release"))
+	})
+
+	t.Run("overwrites replace metadata and keep tags", func(t *testing.T) {
+		id := upload("overwritten", "X-Meta-Stage", "one", "X-Tags", "keep=yes")
+		resp := doRequest(t, http.MethodPut, url+"/objects/"+id, strings.NewReader("new"), "X-Meta-Other", "two")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		sf, err := store.GetFileMetadata(id)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"other": "two"}, sf.Metadata)
+		assert.Equal(t, map[string]string{"keep": "yes"}, sf.Tags)
+
+		resp = doRequest(t, http.MethodPost, url+"/objects/", strings.NewReader("x"), "X-Filename", "bad", "X-Tags", "=x")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("S3", func(t *testing.T) {
+		resp := doRequest(t, http.MethodPut, url+"/meta", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = doRequest(t, http.MethodPut, url+"/meta/key", strings.NewReader("x"), "X-Amz-Meta-Owner", "ci", "X-Amz-Tagging", "a=1&b=2")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = doRequest(t, http.MethodHead, url+"/meta/key", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "ci", resp.Header.Get("X-Amz-Meta-Owner"))
+		assert.Equal(t, "2", resp.Header.Get("X-Amz-Tagging-Count"))
+
+		files, err := store.ListFiles(InBucket("meta"), TaggedWith("a", "1"))
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		assert.Equal(t, filepath.Join(store.BucketDir("meta"), "key"), files[0].Path)
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How long objects stay in the trash unless -trash-retention says otherwise
+const defaultTrashRetention = 7 * 24 * time.Hour
+
+// WithTrash moves deleted objects to the trash instead of removing them, see
+// PurgeTrash for emptying it. Objects in the trash keep their blob until
+// purged.
+func WithTrash(enabled bool) StoreOption {
+	return func(db *Store) {
+		db.trashEnabled = enabled
+	}
+}
+
+// trashFile moves an object to the trash and records when it was deleted.
+func (db *Store) trashFile(sf *storedFile) error {
+	deleted := time.Now()
+	sf.Deleted = &deleted
+	db.putTrash(sf.ID, *sf)
+	db.dropFile(sf.ID)
+	return db.appendRecord(manifestRecord{Action: "TRASH", ID: sf.ID, File: sf})
+}
+
+// ListTrash returns the objects in the trash, most recently deleted first.
+func (db *Store) ListTrash() ([]storedFile, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+	if db.trash == nil {
+		return nil, errNotInitialized
+	}
+	results := make([]storedFile, 0, len(db.trash))
+	for _, sf := range db.trash {
+		results = append(results, sf)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Deleted.After(*results[j].Deleted)
+	})
+	return results, nil
+}
+
+// GetTrash returns an object in the trash.
+func (db *Store) GetTrash(id string) (*storedFile, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+	sf, ok := db.trash[id]
+	if !ok {
+		return nil, errNotExist
+	}
+	return &sf, nil
+}
+
+// RestoreTrash moves an object out of the trash back to where it was deleted
+// from, under the same ID.
+func (db *Store) RestoreTrash(id string) (*storedFile, error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.aoFile == nil {
+		return nil, errExiting
+	}
+	sf, ok := db.trash[id]
+	if !ok {
+		return nil, errNotExist
+	}
+	if _, err := db.getFileByPath(sf.Path); err == nil {
+		return nil, errExist
+	}
+	if _, ok := db.buckets[sf.Bucket]; sf.Bucket != "" && !ok {
+		return nil, errBucketNotExist
+	}
+	sf.Deleted = nil
+	db.putFile(id, sf)
+	db.dropTrash(id)
+	// Replaying the ADD takes the object out of the trash again
+	if err := db.appendRecord(manifestRecord{Action: "ADD", ID: id, File: &sf}); err != nil {
+		return nil, err
+	}
+	return &sf, nil
+}
+
+// DeleteTrash permanently removes an object from the trash.
+func (db *Store) DeleteTrash(id string) error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.aoFile == nil {
+		return errExiting
+	}
+	if _, ok := db.trash[id]; !ok {
+		return errNotExist
+	}
+	return db.deleteTrash(id)
+}
+
+func (db *Store) deleteTrash(id string) error {
+	db.dropTrash(id)
+	return db.appendRecord(manifestRecord{Action: "DEL_TRASH", ID: id})
+}
+
+// PurgeTrash permanently removes the objects deleted more than retention ago
+// and returns how many there were.
+func (db *Store) PurgeTrash(retention time.Duration) (int, error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.aoFile == nil {
+		return 0, errExiting
+	}
+	purged := 0
+	for id, sf := range db.trash {
+		if time.Since(*sf.Deleted) < retention {
+			continue
+		}
+		if err := db.deleteTrash(id); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// Trash lists the trash on GET /trash, restores an object on
+// POST /trash/{id}/restore and purges one on DELETE /trash/{id}.
+func (a *api) Trash(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/trash"), "/")
+	if id == "" {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, r)
+			return
+		}
+		files, err := a.store.ListTrash()
+		if err != nil {
+			internalError(err, w, r)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.Encode(files)
+		return
+	}
+
+	objectID := strings.TrimSuffix(id, "/restore")
+	var err error
+	switch {
+	case objectID != id && r.Method == http.MethodPost:
+		var sf *storedFile
+		if sf, err = a.store.RestoreTrash(objectID); err == nil {
+			a.publishCreated(sf.ID)
+			w.Header().Add("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.Encode(sf)
+			return
+		}
+	case !strings.Contains(id, "/") && r.Method == http.MethodDelete:
+		err = a.store.DeleteTrash(id)
+	default:
+		methodNotAllowed(w, r)
+		return
+	}
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if errors.Is(err, errExist) {
+			conflict(w, r, "Another object is stored where '%s' was deleted from", objectID)
+			return
+		}
+		if errors.Is(err, errBucketNotExist) {
+			var bucket string
+			if sf, err := a.store.GetTrash(objectID); err == nil {
+				bucket = sf.Bucket
+			}
+			conflict(w, r, "The bucket '%s' the object was deleted from no longer exists", bucket)
+			return
+		}
+		internalError(err, w, r)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrash(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	store, err := NewStore(dir, WithTrash(true))
+	require.NoError(t, err)
+	defer func() { store.Close() }()
+	p := filepath.Join(dir, "precious.txt")
+
+	sf, err := store.CreateFile(p, strings.NewReader("keep me"))
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteFile(sf.ID))
+	_, err = store.GetFileMetadata(sf.ID)
+	assert.ErrorIs(t, err, errNotExist)
+	assert.NoFileExists(t, p)
+
+	trashed, err := store.ListTrash()
+	require.NoError(t, err)
+	require.Len(t, trashed, 1)
+	assert.Equal(t, sf.ID, trashed[0].ID)
+	require.NotNil(t, trashed[0].Deleted)
+
+	report, err := store.Fsck(FsckOptions{})
+	require.NoError(t, err)
+	assert.True(t, report.Clean())
+
+	t.Run("restore", func(t *testing.T) {
+		restored, err := store.RestoreTrash(sf.ID)
+		require.NoError(t, err)
+		assert.Equal(t, sf.ID, restored.ID)
+		assert.Nil(t, restored.Deleted)
+		var buf bytes.Buffer
+		require.NoError(t, store.ReadFile(sf.ID, &buf))
+		assert.Equal(t, "keep me", buf.String())
+		_, err = store.RestoreTrash(sf.ID)
+		assert.ErrorIs(t, err, errNotExist)
+	})
+
+	t.Run("path taken", func(t *testing.T) {
+		require.NoError(t, store.DeleteFile(sf.ID))
+		other, err := store.CreateFile(p, strings.NewReader("newer"))
+		require.NoError(t, err)
+		_, err = store.RestoreTrash(sf.ID)
+		assert.ErrorIs(t, err, errExist)
+		require.NoError(t, store.DeleteFile(other.ID))
+	})
+
+	t.Run("survives restarts and compaction", func(t *testing.T) {
+		_, err := store.Compact()
+		require.NoError(t, err)
+		require.NoError(t, store.Close())
+		store, err = NewStore(dir, WithTrash(true))
+		require.NoError(t, err)
+		trashed, err := store.ListTrash()
+		require.NoError(t, err)
+		assert.Len(t, trashed, 2)
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		purged, err := store.PurgeTrash(time.Hour)
+		require.NoError(t, err)
+		assert.Zero(t, purged)
+		purged, err = store.PurgeTrash(0)
+		require.NoError(t, err)
+		assert.Equal(t, 2, purged)
+		trashed, err := store.ListTrash()
+		require.NoError(t, err)
+		assert.Empty(t, trashed)
+		assert.Empty(t, storedBlobs(t, store))
+	})
+}
+
+func TestTrashAPI(t *testing.T) {
+	t.Parallel()
+	store, err := NewStore(t.TempDir(), WithTrash(true))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	server := httptest.NewServer(NewAPI(store, []byte("testing")))
+	t.Cleanup(server.Close)
+	url := server.URL
+
+	id := uploadMultipart(t, url+"/objects/", "report.txt", "content")
+	resp := doRequest(t, http.MethodDelete, url+"/objects/"+id, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, url+"/trash", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var trashed []storedFile
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&trashed))
+	require.Len(t, trashed, 1)
+	assert.Equal(t, id, trashed[0].ID)
+
+	resp = doRequest(t, http.MethodPost, url+"/trash/"+id+"/restore", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodGet, url+"/objects/"+id, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodPost, url+"/trash/"+id+"/restore", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodDelete, url+"/objects/"+id, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodDelete, url+"/trash/"+id, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodPost, url+"/trash/"+id+"/restore", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = doRequest(t, http.MethodPut, url+"/trash/"+id, nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	t.Run("bucket gone", func(t *testing.T) {
+		resp := doRequest(t, http.MethodPut, url+"/buckets/reports", nil)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		id := uploadMultipart(t, url+"/buckets/reports/objects/", "report.txt", "content")
+		resp = doRequest(t, http.MethodDelete, url+"/buckets/reports?force=true", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = doRequest(t, http.MethodPost, url+"/trash/"+id+"/restore", nil)
+		require.Equal(t, http.StatusConflict, resp.StatusCode)
+		var errResp ErrorResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+		assert.Equal(t, "The bucket 'reports' the object was deleted from no longer exists", errResp.Error)
+	})
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Header telling which version of an object a response is about
+const versionIDHeader = "X-Version-Id"
+
+var (
+	errVersionNotExist = errors.New("Version does not exist")
+	errVersionCurrent  = errors.New("Version is the current one")
+)
+
+// objectVersion is a noncurrent version of an object, or a delete marker
+// recording that the object was deleted.
+type objectVersion struct {
+	VersionID string `json:"versionId"`
+	// Record of the object as of this version, its blob keeps the content
+	File         storedFile `json:"file"`
+	DeleteMarker bool       `json:"deleteMarker,omitempty"`
+	// When the version stopped being the current one
+	Archived time.Time `json:"archived"`
+	// Only set in listings, for the version the object currently has
+	IsLatest bool `json:"isLatest,omitempty"`
+}
+
+// versioned reports whether writes to bucket keep what they replace.
+func (db *Store) versioned(bucket string) bool {
+	b, ok := db.buckets[bucket]
+	return ok && b.Versioning
+}
+
+// archiveVersion returns the current content of sf as a version so a write
+// can replace it. The version keeps the blob of sf, nothing is copied.
+func (db *Store) archiveVersion(sf *storedFile) objectVersion {
+	versionID := sf.VersionID
+	if versionID == "" {
+		// Written before versioning was turned on
+		versionID = generateRandomUUID()
+	}
+	return objectVersion{
+		VersionID: versionID,
+		File:      *sf,
+		Archived:  time.Now(),
+	}
+}
+
+// blob returns the blob holding the content of a version, empty for delete
+// markers.
+func (v objectVersion) blob() string {
+	if v.DeleteMarker {
+		return ""
+	}
+	return v.File.Blob
+}
+
+func (db *Store) addVersion(id string, v objectVersion) error {
+	db.putVersion(id, v)
+	return db.appendRecord(manifestRecord{Action: "ADD_VERSION", ID: id, Version: &v})
+}
+
+func (db *Store) deleteVersion(id, versionID string) error {
+	for i, v := range db.versions[id] {
+		if v.VersionID != versionID {
+			continue
+		}
+		db.removeVersion(id, i)
+		return db.appendRecord(manifestRecord{Action: "DEL_VERSION", ID: id, Version: &objectVersion{VersionID: versionID}})
+	}
+	return errVersionNotExist
+}
+
+func (db *Store) removeVersion(id string, i int) {
+	db.dereference(db.versions[id][i].blob())
+	versions := append(db.versions[id][:i:i], db.versions[id][i+1:]...)
+	if len(versions) == 0 {
+		delete(db.versions, id)
+		return
+	}
+	db.versions[id] = versions
+}
+
+// purgeVersions permanently deletes every noncurrent version of an object.
+func (db *Store) purgeVersions(id string) error {
+	for len(db.versions[id]) > 0 {
+		if err := db.deleteVersion(id, db.versions[id][0].VersionID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *Store) findVersion(id, versionID string) (*objectVersion, error) {
+	for _, v := range db.versions[id] {
+		if v.VersionID == versionID {
+			return &v, nil
+		}
+	}
+	return nil, errVersionNotExist
+}
+
+// ListVersions returns the versions of an object newest first, the current
+// one included. Deleted objects keep their versions until they are purged.
+func (db *Store) ListVersions(id string) ([]objectVersion, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+	var results []objectVersion
+	if sf, ok := db.storedFiles[id]; ok {
+		results = append(results, objectVersion{
+			VersionID: sf.VersionID,
+			File:      sf,
+			IsLatest:  true,
+		})
+	}
+	versions := db.versions[id]
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		v.IsLatest = len(results) == 0
+		results = append(results, v)
+	}
+	if len(results) == 0 {
+		return nil, errNotExist
+	}
+	return results, nil
+}
+
+// OpenVersion opens a version of an object for reading along with the record
+// of the object as of that version.
+func (db *Store) OpenVersion(id, versionID string) (*os.File, *storedFile, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+	if sf, ok := db.storedFiles[id]; ok && sf.VersionID == versionID {
+		f, err := db.openBlob(sf.Blob)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, &sf, nil
+	}
+	v, err := db.findVersion(id, versionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if v.DeleteMarker {
+		return nil, nil, errVersionNotExist
+	}
+	f, err := db.openBlob(v.File.Blob)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, &v.File, nil
+}
+
+// RestoreVersion makes the content and metadata of a prior version the
+// current one again, recreating the object under its ID if it was deleted. In
+// versioned buckets what it replaces is kept as a version in turn. Only
+// records are written, the version already holds the content.
+func (db *Store) RestoreVersion(id, versionID string) (*storedFile, error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.aoFile == nil {
+		return nil, errExiting
+	}
+	if sf, ok := db.storedFiles[id]; ok && sf.VersionID == versionID {
+		return &sf, nil
+	}
+	v, err := db.findVersion(id, versionID)
+	if err != nil {
+		return nil, err
+	}
+	if v.DeleteMarker {
+		return nil, errVersionNotExist
+	}
+	options := append(v.File.fileOptions(), withID(id))
+	if sf, ok := db.storedFiles[id]; ok {
+		if err := sf.checkLock(time.Now(), false); err != nil {
+			return nil, err
+		}
+		return db.replaceContent(&sf, v.File.Size, v.File.Blob, nil, true, options...)
+	}
+	if _, err := db.getFileByPath(v.File.Path); err == nil {
+		return nil, errExist
+	}
+	sf, err := db.createRecord(v.File.Path, v.File.Size, v.File.Blob, nil, options...)
+	if err != nil {
+		return nil, err
+	}
+	// The object is back, the copy deleted to the trash would otherwise
+	// take its place again once compaction writes the trash after it
+	if _, ok := db.trash[id]; ok {
+		if err := db.deleteTrash(id); err != nil {
+			return nil, err
+		}
+	}
+	return sf, nil
+}
+
+// DeleteVersion permanently deletes a noncurrent version of an object,
+// failing with errLocked while the version is under a legal hold or retention
+// options don't let through.
+func (db *Store) DeleteVersion(id, versionID string, options ...FileOption) error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.aoFile == nil {
+		return errExiting
+	}
+	if sf, ok := db.storedFiles[id]; ok && sf.VersionID == versionID {
+		return errVersionCurrent
+	}
+	v, err := db.findVersion(id, versionID)
+	if err != nil {
+		return err
+	}
+	if err := v.File.checkLock(time.Now(), bypassing(options)); err != nil {
+		return err
+	}
+	return db.deleteVersion(id, versionID)
+}
+
+// withID creates an object under id instead of a new one.
+func withID(id string) FileOption {
+	return func(sf *storedFile) {
+		sf.ID = id
+	}
+}
+
+// ObjectVersions lists the versions of an object on
+// GET /objects/{id}/versions and restores one on
+// POST /objects/{id}/versions/{version id}/restore.
+func (a *api) ObjectVersions(w http.ResponseWriter, r *http.Request) {
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/objects/"), "/versions")
+	versions, err := a.store.ListVersions(id)
+	if err != nil {
+		if errors.Is(err, errNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		internalError(err, w, r)
+		return
+	}
+	if bucket := requestBucket(r); bucket != "" && versions[0].File.Bucket != bucket {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case rest == "" || rest == "/":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, r)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.Encode(versions)
+	case strings.HasSuffix(rest, "/restore"):
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, r)
+			return
+		}
+		versionID := strings.TrimSuffix(strings.TrimPrefix(rest, "/"), "/restore")
+		_, err := a.store.GetFileMetadata(id)
+		recreated := errors.Is(err, errNotExist)
+		sf, err := a.store.RestoreVersion(id, versionID)
+		if err != nil {
+			if errors.Is(err, errVersionNotExist) {
+				http.NotFound(w, r)
+				return
+			}
+			if errors.Is(err, errExist) {
+				conflict(w, r, "Another object has been written to '%s' since", filepath.Base(versions[0].File.Path))
+				return
+			}
+			if errors.Is(err, errTooLarge) {
+				entityTooLarge(w, r, "%s", err)
+				return
+			}
+			internalError(err, w, r)
+			return
+		}
+		if recreated {
+			a.publishCreated(sf.ID)
+		}
+		w.Header().Add("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.Encode(sf)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// DeleteObjectVersion permanently deletes a noncurrent version of an object,
+// deleted objects included.
+func (a *api) DeleteObjectVersion(w http.ResponseWriter, r *http.Request, id, versionID string) {
+	versions, err := a.store.ListVersions(id)
+	if err != nil || (requestBucket(r) != "" && versions[0].File.Bucket != requestBucket(r)) {
+		http.NotFound(w, r)
+		return
+	}
+	if err := a.store.DeleteVersion(id, versionID, bypassOptions(r.Header, bypassGovernanceHeader)...); err != nil {
+		if errors.Is(err, errVersionNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if errors.Is(err, errVersionCurrent) {
+			conflict(w, r, "Version '%s' is the current one, delete the object instead", versionID)
+			return
+		}
+		if errors.Is(err, errLocked) {
+			forbidden(w, r, "%s", err)
+			return
+		}
+		internalError(err, w, r)
+	}
+}
+
+// versionIDs returns the IDs of the objects with versions, sorted.
+func (db *Store) versionIDs() []string {
+	ids := make([]string, 0, len(db.versions))
+	for id := range db.versions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// markDeleted keeps the content of an object about to be deleted from a
+// versioned bucket, and records a delete marker for objects with versions.
+func (db *Store) markDeleted(sf *storedFile) error {
+	if db.versioned(sf.Bucket) {
+		if err := db.addVersion(sf.ID, db.archiveVersion(sf)); err != nil {
+			return err
+		}
+	}
+	if len(db.versions[sf.ID]) == 0 {
+		return nil
+	}
+	return db.addVersion(sf.ID, objectVersion{
+		VersionID:    generateRandomUUID(),
+		File:         *sf,
+		DeleteMarker: true,
+		Archived:     time.Now(),
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersioning(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	store, err := NewStore(dir)
+	require.NoError(t, err)
+	defer func() { store.Close() }()
+	_, err = store.CreateBucket("versioned")
+	require.NoError(t, err)
+	_, err = store.UpdateBucket("versioned", func(b *bucket) { b.Versioning = true })
+	require.NoError(t, err)
+	p := filepath.Join(store.BucketDir("versioned"), "config.json")
+
+	read := func(id, versionID string) string {
+		f, _, err := store.OpenVersion(id, versionID)
+		require.NoError(t, err)
+		defer f.Close()
+		b, err := io.ReadAll(f)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	sf, err := store.CreateFile(p, strings.NewReader("one"))
+	require.NoError(t, err)
+	first := sf.VersionID
+	require.NotEmpty(t, first)
+	require.NoError(t, store.UpdateFile(sf.ID, strings.NewReader("two"), true))
+	require.NoError(t, store.UpdateFile(sf.ID, strings.NewReader("+"), false))
+
+	versions, err := store.ListVersions(sf.ID)
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	assert.True(t, versions[0].IsLatest)
+	assert.Equal(t, first, versions[2].VersionID)
+	assert.Equal(t, "two+", read(sf.ID, versions[0].VersionID))
+	assert.Equal(t, "two", read(sf.ID, versions[1].VersionID))
+	assert.Equal(t, "one", read(sf.ID, first))
+
+	t.Run("delete and restore", func(t *testing.T) {
+		require.NoError(t, store.DeleteFile(sf.ID))
+		versions, err := store.ListVersions(sf.ID)
+		require.NoError(t, err)
+		require.Len(t, versions, 4)
+		assert.True(t, versions[0].DeleteMarker)
+		assert.True(t, versions[0].IsLatest)
+		_, _, err = store.OpenVersion(sf.ID, versions[0].VersionID)
+		assert.ErrorIs(t, err, errVersionNotExist)
+
+		restored, err := store.RestoreVersion(sf.ID, first)
+		require.NoError(t, err)
+		assert.Equal(t, sf.ID, restored.ID)
+		assert.Equal(t, p, restored.Path)
+		assert.NotEqual(t, first, restored.VersionID)
+		assert.Equal(t, "one", read(sf.ID, restored.VersionID))
+	})
+
+	t.Run("survives restarts and compaction", func(t *testing.T) {
+		before, err := store.ListVersions(sf.ID)
+		require.NoError(t, err)
+		_, err = store.Compact()
+		require.NoError(t, err)
+		require.NoError(t, store.Close())
+		store, err = NewStore(dir)
+		require.NoError(t, err)
+		after, err := store.ListVersions(sf.ID)
+		require.NoError(t, err)
+		assert.Equal(t, len(before), len(after))
+		assert.Equal(t, "two", read(sf.ID, before[3].VersionID))
+
+		report, err := store.Fsck(FsckOptions{})
+		require.NoError(t, err)
+		assert.True(t, report.Clean())
+	})
+
+	t.Run("delete version", func(t *testing.T) {
+		current, err := store.GetFileMetadata(sf.ID)
+		require.NoError(t, err)
+		assert.ErrorIs(t, store.DeleteVersion(sf.ID, current.VersionID), errVersionCurrent)
+		require.NoError(t, store.DeleteVersion(sf.ID, first))
+		_, _, err = store.OpenVersion(sf.ID, first)
+		assert.ErrorIs(t, err, errVersionNotExist)
+	})
+
+	t.Run("purged with the bucket", func(t *testing.T) {
+		require.NoError(t, store.DeleteBucket("versioned", true))
+		_, err := store.ListVersions(sf.ID)
+		assert.ErrorIs(t, err, errNotExist)
+		assert.Empty(t, storedBlobs(t, store))
+	})
+}
+
+func TestRestoreVersionFromTrash(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	store, err := NewStore(dir, WithTrash(true))
+	require.NoError(t, err)
+	defer func() { store.Close() }()
+	_, err = store.CreateBucket("versioned")
+	require.NoError(t, err)
+	_, err = store.UpdateBucket("versioned", func(b *bucket) { b.Versioning = true })
+	require.NoError(t, err)
+
+	sf, err := store.CreateFile(filepath.Join(store.BucketDir("versioned"), "config.json"), strings.NewReader("one"))
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteFile(sf.ID))
+	trashed, err := store.ListTrash()
+	require.NoError(t, err)
+	require.Len(t, trashed, 1)
+
+	_, err = store.RestoreVersion(sf.ID, sf.VersionID)
+	require.NoError(t, err)
+	trashed, err = store.ListTrash()
+	require.NoError(t, err)
+	assert.Empty(t, trashed)
+
+	_, err = store.Compact()
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+	store, err = NewStore(dir, WithTrash(true))
+	require.NoError(t, err)
+	_, err = store.GetFileMetadata(sf.ID)
+	assert.NoError(t, err)
+	trashed, err = store.ListTrash()
+	require.NoError(t, err)
+	assert.Empty(t, trashed)
+}
+
+func TestVersioningAPI(t *testing.T) {
+	t.Parallel()
+	_, url := setupS3(t)
+
+	resp := doRequest(t, http.MethodPut, url+"/buckets/history", strings.NewReader(`{"versioning": true}`))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var b bucket
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&b))
+	assert.True(t, b.Versioning)
+	// Settings not given are left alone
+	resp = doRequest(t, http.MethodPatch, url+"/buckets/history", strings.NewReader(`{"maxObjectSize": 1024}`))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&b))
+	assert.True(t, b.Versioning)
+
+	objects := url + "/buckets/history/objects/"
+	id := uploadMultipart(t, objects, "notes.txt", "first")
+	resp = doRequest(t, http.MethodPut, objects+id, strings.NewReader("second"))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodGet, objects+id+"/versions", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var versions []objectVersion
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&versions))
+	require.Len(t, versions, 2)
+	old := versions[1].VersionID
+
+	resp = doRequest(t, http.MethodGet, objects+id+"?versionId="+old, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, old, resp.Header.Get("X-Version-Id"))
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "first", string(body))
+	resp = doRequest(t, http.MethodGet, objects+id+"?versionId=missing", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodDelete, objects+id, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodGet, objects+id, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, http.MethodPost, objects+id+"/versions/"+old+"/restore", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodGet, objects+id, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, "first", string(body))
+
+	resp = doRequest(t, http.MethodDelete, objects+id+"?versionId="+old, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodGet, objects+id+"?versionId="+old, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = doRequest(t, http.MethodGet, url+"/objects/"+id+"/versions", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, http.MethodGet, url+"/buckets/other/objects/"+id+"/versions", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	t.Run("S3", func(t *testing.T) {
+		resp := doRequest(t, http.MethodPut, url+"/history/key", strings.NewReader("a"))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		first := resp.Header.Get("X-Amz-Version-Id")
+		require.NotEmpty(t, first)
+		resp = doRequest(t, http.MethodPut, url+"/history/key", strings.NewReader("b"))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.NotEqual(t, first, resp.Header.Get("X-Amz-Version-Id"))
+	})
+}